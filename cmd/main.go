@@ -1,52 +1,110 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"runtime"
+	"strings"
 
 	"github.com/closmarfer/glacier-backup/pkg/backup"
 	"github.com/closmarfer/glacier-backup/pkg/backup/handlers"
 	"github.com/closmarfer/glacier-backup/pkg/backup/serviceprovider"
 )
 
-const databaseName = "backup.db"
-
 const appVersion = "3.0"
 
-func main() {
-	var selectedRemote string
+// readOnlyActions do not modify the state database. --replicate reads the one of the source remote
+var readOnlyActions = map[string]bool{
+	"--sizeCount":  true,
+	"--restore":    true,
+	"--list-trash": true,
+	"--snapshots":  true,
+	"--failures":   true,
+	"--replicate":  true,
+}
+
+type arguments struct {
+	configPath string
+	profile    string
+	remote     string
+	dryRun     bool
+	// newDatabase allows starting with an empty database when the remote one cannot be loaded
+	newDatabase bool
+	action      string
+	params      []string
+}
 
+func main() {
 	if len(os.Args) == 1 {
 		printHelp()
 	}
 
-	if len(os.Args) != 3 {
-		fmt.Println("Error: invalid number of options")
+	args, err := parseArguments(os.Args[1:])
+	if err != nil {
+		fmt.Println("Error:", err)
 		printHelp()
 		os.Exit(1)
 	}
 
-	selectedRemote = os.Args[1]
-	cfg, err := serviceprovider.ProvideBackupConfiguration(selectedRemote)
+	cfg, err := serviceprovider.ProvideBackupConfiguration(args.configPath, args.profile, args.remote)
 	if err != nil {
 		fmt.Println("Error: ", err)
 		return
 	}
 
+	cfg.DryRun = args.dryRun
+	if cfg.DryRun && args.action != "--backup" && args.action != "--cleanRemote" && args.action != "--prune" {
+		fmt.Printf("Error: %v does not support --dry-run\n", args.action)
+		os.Exit(1)
+	}
+
+	if args.action == "--replicate" {
+		overwrite := len(args.params) == 3 && args.params[2] == "--force"
+		if (len(args.params) != 2 && !overwrite) || args.params[0] == args.params[1] {
+			fmt.Println("Error: --replicate requires two different remotes and only accepts --force")
+			printHelp()
+			os.Exit(1)
+		}
+		// The objects are read from the source remote only, according to its state database
+		cfg.SelectedRemote = args.params[0]
+		cfg.Replicas = nil
+	}
+
+	requeue := false
+	if args.action == "--verify" {
+		requeue = len(args.params) == 1 && args.params[0] == "--requeue"
+		if len(args.params) > 0 && !requeue {
+			fmt.Println("Error: --verify only accepts --requeue")
+			printHelp()
+			os.Exit(1)
+		}
+		// Only the objects of the selected remote are verified
+		cfg.Replicas = nil
+	}
+	// The actions only reading the database neither lock it nor upload it
+	readOnly := cfg.DryRun || readOnlyActions[args.action] || (args.action == "--verify" && !requeue)
+
 	repo, err := serviceprovider.ProvideRemoteFilesRepository(cfg)
 	if err != nil {
 		fmt.Println("Error: ", err)
 		return
 	}
+	defer closeRepository(repo)
 
 	eChecker := backup.NewSQLiteChecker(backup.SqliteConfig{
-		Path: cfg.GlacierPath + string(os.PathSeparator) + databaseName,
-		Key:  databaseName,
+		Path:            cfg.GlacierPath + string(os.PathSeparator) + cfg.Database,
+		Key:             cfg.Database,
+		ChangeDetection: cfg.ChangeDetection,
+		ReadOnly:        readOnly,
+		Copies:          cfg.DatabaseCopiesOrDefault(),
+		NewDatabase:     args.newDatabase,
+		Remote:          cfg.SelectedRemote,
 	}, repo)
 
-	arg := os.Args[2]
-	switch arg {
+	switch args.action {
 	case "--backup":
 		back := backup.NewBackuper(repo, eChecker, cfg)
 		handler := handlers.NewHandler(eChecker, back)
@@ -55,7 +113,83 @@ func main() {
 		handler := handlers.NewSizeCounter(eChecker)
 		handler.Run()
 	case "--cleanRemote":
-		handler := handlers.NewRemoteCleaner(eChecker, repo)
+		cfg.CleanRemote.Force = len(args.params) == 1 && args.params[0] == "--force"
+		if len(args.params) > 0 && !cfg.CleanRemote.Force {
+			fmt.Println("Error: --cleanRemote only accepts --force")
+			printHelp()
+			os.Exit(1)
+		}
+		handler := handlers.NewRemoteCleaner(eChecker, repo, cfg)
+		handler.Run()
+	case "--restore":
+		if len(args.params) != 2 && len(args.params) != 3 {
+			fmt.Println("Error: --restore requires a path prefix and a target folder")
+			printHelp()
+			os.Exit(1)
+		}
+		restoreCfg := handlers.RestoreConfig{
+			Prefix:     args.params[0],
+			TargetPath: args.params[1],
+		}
+		if len(args.params) == 3 {
+			restoreCfg.At, err = backup.ParseSnapshotTime(args.params[2])
+			if err != nil {
+				fmt.Println("Error: ", err)
+				os.Exit(1)
+			}
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		handler := handlers.NewRestorer(ctx, eChecker, repo, restoreCfg)
+		handler.Run()
+	case "--prune":
+		force := len(args.params) == 1 && args.params[0] == "--force"
+		if len(args.params) > 0 && !force {
+			fmt.Println("Error: --prune only accepts --force")
+			printHelp()
+			os.Exit(1)
+		}
+		handler := handlers.NewPruner(eChecker, repo, handlers.PruneConfig{
+			Retention: cfg.Retention,
+			Force:     force,
+			DryRun:    cfg.DryRun,
+		})
+		handler.Run()
+	case "--list-trash":
+		handler := handlers.NewTrashLister(eChecker, cfg)
+		handler.Run()
+	case "--untrash":
+		if len(args.params) != 1 {
+			fmt.Println("Error: --untrash requires a path prefix")
+			printHelp()
+			os.Exit(1)
+		}
+		handler := handlers.NewUntrasher(eChecker, args.params[0])
+		handler.Run()
+	case "--snapshots":
+		handler := handlers.NewSnapshotLister(eChecker)
+		handler.Run()
+	case "--verify":
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		handler := handlers.NewVerifier(ctx, eChecker, repo, handlers.VerifyConfig{Requeue: requeue})
+		handler.Run()
+	case "--failures":
+		handler := handlers.NewFailuresLister(eChecker)
+		handler.Run()
+	case "--replicate":
+		to, err := serviceprovider.ProvideDestinationRepository(cfg, args.params[1])
+		if err != nil {
+			fmt.Println("Error: ", err)
+			return
+		}
+		defer closeRepository(to)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		handler := handlers.NewReplicator(ctx, eChecker, repo, to, handlers.ReplicateConfig{
+			DatabaseKey: cfg.Database,
+			Overwrite:   len(args.params) == 3,
+		})
 		handler.Run()
 	default:
 		printHelp()
@@ -63,8 +197,78 @@ func main() {
 	}
 }
 
+// closeRepository closes the connection of the remotes keeping one open, like sftp
+func closeRepository(repo backup.RemoteFilesRepository) {
+	closer, ok := repo.(io.Closer)
+	if !ok {
+		return
+	}
+	err := closer.Close()
+	if err != nil {
+		fmt.Println("Error closing remote: ", err)
+	}
+}
+
+// parseArguments extracts the global options and returns the remote (optional when it is set in
+// the configuration file), the action and its parameters. "run [profile]" is a shortcut of
+// "--profile [profile] --backup"
+func parseArguments(osArgs []string) (arguments, error) {
+	args := arguments{}
+	var positional []string
+	for i := 0; i < len(osArgs); i++ {
+		arg := osArgs[i]
+		switch {
+		case arg == "--config":
+			if i+1 == len(osArgs) {
+				return args, fmt.Errorf("--config requires a file path")
+			}
+			i++
+			args.configPath = osArgs[i]
+		case strings.HasPrefix(arg, "--config="):
+			args.configPath = strings.TrimPrefix(arg, "--config=")
+		case arg == "--profile":
+			if i+1 == len(osArgs) {
+				return args, fmt.Errorf("--profile requires a profile name")
+			}
+			i++
+			args.profile = osArgs[i]
+		case strings.HasPrefix(arg, "--profile="):
+			args.profile = strings.TrimPrefix(arg, "--profile=")
+		case arg == "--dry-run":
+			args.dryRun = true
+		case arg == "--new-database":
+			args.newDatabase = true
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	if len(positional) > 0 && positional[0] == "run" {
+		if len(positional) != 2 {
+			return args, fmt.Errorf("run requires a profile name")
+		}
+		args.profile = positional[1]
+		args.action = "--backup"
+		return args, nil
+	}
+
+	if len(positional) > 0 && !strings.HasPrefix(positional[0], "--") {
+		args.remote = positional[0]
+		positional = positional[1:]
+	}
+
+	if len(positional) == 0 {
+		return args, fmt.Errorf("invalid number of options")
+	}
+	args.action = positional[0]
+	args.params = positional[1:]
+
+	return args, nil
+}
+
 func printHelp() {
-	help := "glacier-backup [remote] [--sizeCount] [--cleanRemote] [--backup]"
+	help := "glacier-backup [--config file] [--profile name] [--dry-run] [--new-database] [remote] [--sizeCount] [--cleanRemote [--force]] [--list-trash] [--untrash prefix] [--backup] [--failures] [--verify [--requeue]] [--snapshots] [--prune [--force]] [--restore prefix target [date|snapshot]] [--replicate from to [--force]]\n" +
+		"       glacier-backup [--config file] [--dry-run] run [profile]"
 	fmt.Printf("Application version %v %v/%v\n", appVersion, runtime.GOOS, runtime.GOARCH)
 	fmt.Println("Usage: " + help)
 }
@@ -4,19 +4,27 @@ package backup
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 )
 
-type pathInfo struct {
-	path       string
-	lastUpdate time.Time
-	sizeBytes  int64
+// LocalFile is the current state of a file to backup
+type LocalFile struct {
+	Path      string
+	ModTime   time.Time
+	SizeBytes int64
+	// SHA256 is the hex encoded hash of the contents, empty until it is computed
+	SHA256 string
 }
 
 type FileNotFoundError struct {
@@ -31,23 +39,159 @@ func (f FileNotFoundError) Error() string {
 	return "file not found " + f.filePath
 }
 
+// ObjectInfo describes a file stored in a remote repository
+type ObjectInfo struct {
+	Size    int64
+	ModTime time.Time
+	// Available is false while the object is archived and must be restored before downloading it
+	Available bool
+	// Restoring is true when a restore request has been issued and has not finished yet
+	Restoring bool
+	// SHA256 and MD5 are the hex encoded hashes of the content, empty if the remote does not provide them
+	SHA256 string
+	MD5    string
+}
+
+// FileRecord is a file uploaded to the remote repository
+type FileRecord struct {
+	Path string
+	// RemoteKey is the key of the file in the remote repository, empty if it is the path of the file
+	RemoteKey  string
+	UploadedAt time.Time
+	SizeBytes  int64
+	SHA256     string
+	// SnapshotID is the snapshot the version of the file belongs to
+	SnapshotID string
+	// BundleKey is the key of the bundle containing the file, empty if the file was uploaded alone
+	BundleKey string
+	// BundleOffset is the position of the tar header of the file in the uncompressed bundle
+	BundleOffset int64
+	// Replicas are the remotes, besides the primary one, the file has been uploaded to
+	Replicas []string
+}
+
+// BundleRecord is an uploaded bundle of packed files
+type BundleRecord struct {
+	Key       string
+	SizeBytes int64
+	// SHA256 is the hex encoded hash of the bundle, empty for the bundles uploaded before it was stored
+	SHA256 string
+}
+
+// Key returns the key of the object containing the file in the remote repository
+func (f FileRecord) Key() string {
+	if f.BundleKey != "" {
+		return f.BundleKey
+	}
+	if f.RemoteKey != "" {
+		return f.RemoteKey
+	}
+	return f.Path
+}
+
 type RemoteFilesRepository interface {
-	PutGlacier(ctx context.Context, localPath string) error
+	PutGlacier(ctx context.Context, localPath string, remotePath string) error
 	PutEditable(ctx context.Context, localPath string, remotePath string) error
 	Delete(ctx context.Context, remotePath string) error
 	Get(ctx context.Context, remotePath string) (string, error)
 	Download(ctx context.Context, key string, path string) error
+	Head(ctx context.Context, remotePath string) (ObjectInfo, error)
+	Restore(ctx context.Context, remotePath string, days int) error
+}
+
+// KeyMapper is implemented by repositories that store files under a key different from their path
+type KeyMapper interface {
+	RemoteKey(path string) string
+}
+
+// StoragePolicy is implemented by repositories whose storage class bills a minimum storage duration,
+// so deleting an object earlier is charged as if it had been stored for the whole duration
+type StoragePolicy interface {
+	MinStorageDays() int
+	PricePerGBMonth() float64
+}
+
+// Hasher is implemented by repositories able to hash their objects without downloading them
+type Hasher interface {
+	// SHA256 returns the hex encoded hash of the content of the object
+	SHA256(ctx context.Context, remotePath string) (string, error)
+}
+
+// ChecksumPutter is implemented by repositories sending a checksum of the content with the upload, so the remote
+// rejects it if the content has been corrupted
+type ChecksumPutter interface {
+	// PutGlacierChecksum uploads the file like PutGlacier and returns the hex encoded SHA-256 of the uploaded content,
+	// empty if the remote did not return it
+	PutGlacierChecksum(ctx context.Context, localPath string, remotePath string) (string, error)
+}
+
+// ConditionalWriter is implemented by repositories able to replace a small object only if it has not been modified,
+// used to lock the state database so concurrent runs do not overwrite the changes of each other
+type ConditionalWriter interface {
+	// GetVersioned returns the content of the object and its version, or a FileNotFoundError
+	GetVersioned(ctx context.Context, key string) ([]byte, string, error)
+	// PutIfMatch writes the object if its version is the given one, or if it does not exist when the version is
+	// empty, and returns the new version. It returns ErrObjectModified otherwise, or errors.ErrUnsupported if the
+	// repository wraps one without conditional writes
+	PutIfMatch(ctx context.Context, key string, content []byte, version string) (string, error)
+}
+
+// Replicator is implemented by repositories uploading the files to replicas besides the primary remote.
+// PutGlacier and PutEditable return a *ReplicationError if the file has only been uploaded to the primary remote
+// and some replicas
+type Replicator interface {
+	Replicas() []string
+	// PutReplicas uploads the file only to the given replicas
+	PutReplicas(ctx context.Context, localPath string, remotePath string, replicas []string) error
 }
 
 type ExistentFilesChecker interface {
 	Open(ctx context.Context) error
-	Add(path string, uploadedAt time.Time, size int64)
+	Add(file FileRecord)
 	Remove(path string)
-	Exists(path string, lastUpdated time.Time) bool
+	Exists(file LocalFile) bool
+	// Checkpoint uploads the database if it has changed, Close uploads it too
+	Checkpoint(ctx context.Context) error
 	Close(ctx context.Context) error
 	Ignored() int
 	Uploaded() int
-	GetFiles() map[string]time.Time
+	GetFiles() map[string]FileRecord
+	// AddBundle records the size and hash of an uploaded bundle, before adding its files
+	AddBundle(bundle BundleRecord)
+	GetBundles() map[string]BundleRecord
+	// OrphanBundles returns the uploaded bundles not containing any current file
+	OrphanBundles() []string
+	RemoveBundle(key string)
+	// BeginSnapshot starts the snapshot the files added afterwards belong to
+	BeginSnapshot(ctx context.Context) (string, error)
+	Snapshots() []Snapshot
+	// GetFilesAt returns the last version of each file uploaded until the given time
+	GetFilesAt(at time.Time) map[string]FileRecord
+	GetVersions(path string) []FileRecord
+	GetAllVersions() []FileRecord
+	RemoveVersion(path string, snapshotID string)
+	// RemoveSnapshot removes a snapshot without versions
+	RemoveSnapshot(id string)
+	// Trash marks a file deleted locally, Remove or Untrash take it out of the trash
+	Trash(path string, deletedAt time.Time)
+	Untrash(path string)
+	GetTrash() map[string]time.Time
+	// Keep takes a file out of the trash and keeps it out while it is missing locally, until Add, Remove or
+	// Untrash forget it
+	Keep(path string)
+	GetKept() map[string]bool
+	// MissingReplicas returns the last version of the file and the given replicas lacking it
+	MissingReplicas(path string, replicas []string) (FileRecord, []string)
+	AddReplicas(path string, replicas []string)
+	// AddReplicaBundle records that the replicas hold the last version of the file in a bundle only uploaded to them
+	AddReplicaBundle(file FileRecord, replicas []string)
+	// AddFailure records that the file could not be uploaded, Add or RemoveFailure forget it
+	AddFailure(path string, err error, attempts int)
+	RemoveFailure(path string)
+	GetFailures() []Failure
+	// Requeue forgets the last upload of the file and records the reason as a failure, so the next backup
+	// uploads it first
+	Requeue(path string, reason error)
 }
 
 type Backuper interface {
@@ -86,18 +230,44 @@ func (h fileBackuper) Upload(ctx context.Context, errChan chan error) error {
 		return err
 	}
 
-	paths := make(chan pathInfo)
+	var dryRun *dryRunReport
+	snapshotID := ""
+	if h.config.DryRun {
+		dryRun = &dryRunReport{}
+	} else {
+		snapshotID, err = h.eChecker.BeginSnapshot(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Snapshot: %v\n", snapshotID)
+	}
+
+	paths := make(chan LocalFile)
 
-	for i := 0; i < 5; i++ {
-		w := newWorker(&wg, h.filesRepository, h.eChecker)
+	// The packer also packs the files missing in the replicas, even if packing is disabled now
+	var p *packer
+	if dryRun == nil {
+		p = newPacker(h.config.Packing, h.filesRepository, h.eChecker, h.config.Upload.RetriesOrDefault())
+	}
+
+	if dryRun == nil {
+		stopCheckpoints := h.checkpoints(ctx)
+		defer stopCheckpoints()
+	}
+
+	// The workers share the bandwidth limit, and so do the bundles uploaded by the packer
+	ctx = WithBandwidthLimiter(ctx, NewBandwidthLimiter(h.config.Upload))
+	for i := 0; i < h.config.Upload.WorkersOrDefault(); i++ {
+		w := newWorker(&wg, h.filesRepository, h.eChecker, p, h.config.ChangeDetection, h.config.Upload.RetriesOrDefault(), snapshotID, dryRun)
 
 		w.run(ctx, paths, errChan)
 	}
 
 	go func() {
 		defer close(paths)
+		retried := h.retryFailures(ctx, paths)
 		for _, p := range h.config.PathsToBackup {
-			err := h.iterate(ctx, p, paths)
+			err := h.iterate(ctx, p, paths, retried)
 			if err != nil {
 				fmt.Printf("Error: %s\n", err)
 			}
@@ -106,10 +276,55 @@ func (h fileBackuper) Upload(ctx context.Context, errChan chan error) error {
 
 	wg.Wait()
 
+	if dryRun != nil {
+		dryRun.print()
+	}
+
+	if p != nil {
+		if ctx.Err() != nil {
+			p.discard()
+			return nil
+		}
+		err = p.flush(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (h fileBackuper) iterate(ctx context.Context, path string, paths chan<- pathInfo) error {
+// retryFailures sends first the files that could not be uploaded in the previous runs, and returns them so they
+// are not sent again
+func (h fileBackuper) retryFailures(ctx context.Context, paths chan<- LocalFile) map[string]bool {
+	retried := make(map[string]bool)
+	for _, failure := range h.eChecker.GetFailures() {
+		if !h.config.Contains(failure.Path) || h.shouldBeIgnored(failure.Path) {
+			continue
+		}
+		info, err := os.Stat(failure.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			h.eChecker.RemoveFailure(failure.Path)
+			continue
+		}
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return retried
+		case paths <- LocalFile{Path: failure.Path, ModTime: info.ModTime().UTC(), SizeBytes: info.Size()}:
+			retried[failure.Path] = true
+		}
+	}
+	if len(retried) > 0 {
+		fmt.Printf("Files failed in previous runs retried: %d\n", len(retried))
+	}
+	return retried
+}
+
+func (h fileBackuper) iterate(ctx context.Context, path string, paths chan<- LocalFile, retried map[string]bool) error {
 	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
 		select {
 		case <-ctx.Done():
@@ -119,14 +334,14 @@ func (h fileBackuper) iterate(ctx context.Context, path string, paths chan<- pat
 				return fmt.Errorf("error walking file %s: %w", path, err)
 			}
 
-			if info.IsDir() || h.shouldBeIgnored(path) {
+			if info.IsDir() || h.shouldBeIgnored(path) || retried[path] {
 				return nil
 			}
 
-			paths <- pathInfo{
-				path:       path,
-				lastUpdate: info.ModTime().UTC(),
-				sizeBytes:  info.Size(),
+			paths <- LocalFile{
+				Path:      path,
+				ModTime:   info.ModTime().UTC(),
+				SizeBytes: info.Size(),
 			}
 
 			return nil
@@ -159,33 +374,217 @@ type worker struct {
 	wg              *sync.WaitGroup
 	filesRepository RemoteFilesRepository
 	existent        ExistentFilesChecker
+	packer          *packer
+	changeDetection ChangeDetection
+	retries         int
+	snapshotID      string
+	// dryRun is not nil when the files must be reported instead of uploaded
+	dryRun *dryRunReport
 }
 
-func newWorker(wg *sync.WaitGroup, filesRepository RemoteFilesRepository, existent ExistentFilesChecker) *worker {
-	return &worker{wg: wg, filesRepository: filesRepository, existent: existent}
+func newWorker(
+	wg *sync.WaitGroup,
+	filesRepository RemoteFilesRepository,
+	existent ExistentFilesChecker,
+	packer *packer,
+	changeDetection ChangeDetection,
+	retries int,
+	snapshotID string,
+	dryRun *dryRunReport,
+) *worker {
+	return &worker{
+		wg:              wg,
+		filesRepository: filesRepository,
+		existent:        existent,
+		packer:          packer,
+		changeDetection: changeDetection,
+		retries:         retries,
+		snapshotID:      snapshotID,
+		dryRun:          dryRun,
+	}
 }
 
-func (w worker) run(ctx context.Context, paths <-chan pathInfo, errChan chan error) {
+func (w worker) run(ctx context.Context, paths <-chan LocalFile, errChan chan error) {
 	w.wg.Add(1)
 	go func() {
 		defer w.wg.Done()
 		for {
 			select {
-			case path, ok := <-paths:
+			case file, ok := <-paths:
 				if !ok {
 					return
 				}
-				if w.existent.Exists(path.path, path.lastUpdate) {
+				if w.changeDetection == ChangeDetectionHash {
+					err := file.computeHash()
+					if err != nil {
+						errChan <- err
+						break
+					}
+				}
+				if w.existent.Exists(file) && !w.replicate(ctx, file, errChan) {
+					break
+				}
+				if w.dryRun != nil {
+					w.dryRun.add(file)
 					break
 				}
-				err := w.filesRepository.PutGlacier(ctx, path.path)
+				if w.packer.accepts(file) {
+					err := w.packer.add(ctx, file)
+					if err != nil {
+						errChan <- fmt.Errorf("error packing file: %w", err)
+					}
+					break
+				}
+				putter, validated := w.filesRepository.(ChecksumPutter)
+				if !validated {
+					err := file.computeHash()
+					if err != nil {
+						errChan <- err
+						break
+					}
+				}
+				remoteKey := VersionKey(w.remoteKey(file.Path), w.snapshotID)
+				attempts, err := retry(ctx, w.retries, file.Path, func() error {
+					if !validated {
+						return w.filesRepository.PutGlacier(ctx, file.Path, remoteKey)
+					}
+					// The hash of the uploaded content replaces the one computed to detect changes, the file
+					// may have been modified since then
+					sum, err := putter.PutGlacierChecksum(ctx, file.Path, remoteKey)
+					if sum != "" {
+						file.SHA256 = sum
+					}
+					return err
+				})
 				if err != nil {
 					errChan <- fmt.Errorf("error putting file: %w", err)
 				}
-				w.existent.Add(path.path, time.Now().UTC(), path.sizeBytes)
+				// Replicas missing the file get it in the next run, but the file must be uploaded again if
+				// it is not in the primary remote
+				if err != nil && !isReplicationError(err) {
+					if ctx.Err() == nil {
+						w.existent.AddFailure(file.Path, err, attempts)
+					}
+					break
+				}
+				if hashErr := file.computeHash(); hashErr != nil {
+					errChan <- hashErr
+				}
+				w.existent.Add(FileRecord{
+					Path:       file.Path,
+					RemoteKey:  remoteKey,
+					UploadedAt: time.Now().UTC(),
+					SizeBytes:  file.SizeBytes,
+					SHA256:     file.SHA256,
+					Replicas:   uploadedReplicas(w.replicas(), err),
+				})
 			case <-ctx.Done():
 				return
 			}
 		}
 	}()
 }
+
+// replicate uploads the last version of an unmodified file to the replicas lacking it. Packed files are packed
+// again in a bundle only uploaded to those replicas. It returns true if the file must be uploaded again because
+// it is not in the primary remote
+func (w worker) replicate(ctx context.Context, file LocalFile, errChan chan error) bool {
+	replicator, ok := w.filesRepository.(Replicator)
+	if !ok {
+		return false
+	}
+	record, missing := w.existent.MissingReplicas(file.Path, replicator.Replicas())
+	if len(missing) == 0 {
+		return false
+	}
+	if w.dryRun != nil {
+		w.dryRun.addReplicas(file, missing)
+		return false
+	}
+	if record.BundleKey != "" {
+		err := w.packer.addReplica(ctx, file, missing)
+		if err != nil {
+			errChan <- fmt.Errorf("error replicating file %v: %w", file.Path, err)
+		}
+		return false
+	}
+
+	_, err := retry(ctx, w.retries, file.Path, func() error {
+		return replicator.PutReplicas(ctx, file.Path, record.Key(), missing)
+	})
+	if err != nil {
+		errChan <- fmt.Errorf("error replicating file %v: %w", file.Path, err)
+	}
+	w.existent.AddReplicas(file.Path, uploadedReplicas(missing, err))
+	return false
+}
+
+func (w worker) replicas() []string {
+	if replicator, ok := w.filesRepository.(Replicator); ok {
+		return replicator.Replicas()
+	}
+	return nil
+}
+
+// dryRunReport counts the files that would be uploaded
+type dryRunReport struct {
+	mu         sync.Mutex
+	files      int
+	bytes      int64
+	replicated int
+}
+
+func (r *dryRunReport) add(file LocalFile) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.files++
+	r.bytes += file.SizeBytes
+	fmt.Printf("Would upload: %v (%d bytes)\n", file.Path, file.SizeBytes)
+}
+
+func (r *dryRunReport) addReplicas(file LocalFile, replicas []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.replicated++
+	fmt.Printf("Would replicate: %v to %v\n", file.Path, strings.Join(replicas, ", "))
+}
+
+func (r *dryRunReport) print() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fmt.Printf("Dry run, nothing has been uploaded. Files to upload: %d (%d bytes)\n", r.files, r.bytes)
+	if r.replicated > 0 {
+		fmt.Printf("Files to replicate: %d\n", r.replicated)
+	}
+}
+
+func (w worker) remoteKey(path string) string {
+	if mapper, ok := w.filesRepository.(KeyMapper); ok {
+		return mapper.RemoteKey(path)
+	}
+	return path
+}
+
+// computeHash stores the hash of the contents of the file unless it has already been computed
+func (f *LocalFile) computeHash() error {
+	if f.SHA256 != "" {
+		return nil
+	}
+
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return fmt.Errorf("error hashing file %v: %w", f.Path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return fmt.Errorf("error hashing file %v: %w", f.Path, err)
+	}
+	f.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
@@ -0,0 +1,256 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultWorkers = 5
+	// bandwidthBurst is the maximum number of bytes read at once from a limited reader
+	bandwidthBurst = 64 * 1024
+)
+
+// UploadConfig is how --backup uploads the files, limited so it does not saturate the network
+type UploadConfig struct {
+	// Workers is the number of files uploaded at the same time
+	Workers int `yaml:"workers"`
+	// Retries is the number of times an upload failed with a transient error is retried
+	Retries int `yaml:"retries"`
+	// BandwidthKBps is the maximum upload rate shared by all the workers, 0 is unlimited
+	BandwidthKBps int `yaml:"bandwidthKBps"`
+	// Schedule replaces BandwidthKBps during some hours of the day
+	Schedule []BandwidthWindow `yaml:"schedule"`
+	// CheckpointFiles and CheckpointMinutes are how often the state database is uploaded during the backup,
+	// after uploading the given number of files or after the given minutes
+	CheckpointFiles   int `yaml:"checkpointFiles"`
+	CheckpointMinutes int `yaml:"checkpointMinutes"`
+}
+
+// BandwidthWindow is the upload rate between two times of the day (HH:MM, local time). If From is after To,
+// the window ends the next day
+type BandwidthWindow struct {
+	From          string `yaml:"from"`
+	To            string `yaml:"to"`
+	BandwidthKBps int    `yaml:"bandwidthKBps"`
+}
+
+func (c UploadConfig) WorkersOrDefault() int {
+	if c.Workers == 0 {
+		return defaultWorkers
+	}
+	return c.Workers
+}
+
+func (c UploadConfig) RetriesOrDefault() int {
+	if c.Retries == 0 {
+		return defaultRetries
+	}
+	return c.Retries
+}
+
+func (c UploadConfig) CheckpointFilesOrDefault() int {
+	if c.CheckpointFiles == 0 {
+		return defaultCheckpointFiles
+	}
+	return c.CheckpointFiles
+}
+
+func (c UploadConfig) CheckpointMinutesOrDefault() int {
+	if c.CheckpointMinutes == 0 {
+		return defaultCheckpointMinutes
+	}
+	return c.CheckpointMinutes
+}
+
+func (c UploadConfig) limited() bool {
+	return c.BandwidthKBps != 0 || len(c.Schedule) != 0
+}
+
+func (c UploadConfig) validate() error {
+	if c.Workers < 0 {
+		return fmt.Errorf("upload.workers must be positive")
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("upload.retries must be positive")
+	}
+	if c.CheckpointFiles < 0 {
+		return fmt.Errorf("upload.checkpointFiles must be positive")
+	}
+	if c.CheckpointMinutes < 0 {
+		return fmt.Errorf("upload.checkpointMinutes must be positive")
+	}
+	if c.BandwidthKBps < 0 {
+		return fmt.Errorf("upload.bandwidthKBps must be positive")
+	}
+	for _, window := range c.Schedule {
+		_, _, err := window.minutes()
+		if err != nil {
+			return err
+		}
+		if window.BandwidthKBps < 0 {
+			return fmt.Errorf("upload.schedule.bandwidthKBps must be positive")
+		}
+	}
+	return nil
+}
+
+// minutes returns the start and end of the window as minutes since midnight
+func (w BandwidthWindow) minutes() (int, int, error) {
+	from, err := time.Parse("15:04", w.From)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid upload.schedule.from '%v', the format is HH:MM", w.From)
+	}
+	to, err := time.Parse("15:04", w.To)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid upload.schedule.to '%v', the format is HH:MM", w.To)
+	}
+	return from.Hour()*60 + from.Minute(), to.Hour()*60 + to.Minute(), nil
+}
+
+func (w BandwidthWindow) contains(t time.Time) bool {
+	from, to, err := w.minutes()
+	if err != nil {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// BandwidthLimiter is a token bucket shared by the uploads of all the workers
+type BandwidthLimiter struct {
+	mu      sync.Mutex
+	cfg     UploadConfig
+	limiter *rate.Limiter
+	now     func() time.Time
+}
+
+// NewBandwidthLimiter returns nil if the upload rate is not limited
+func NewBandwidthLimiter(cfg UploadConfig) *BandwidthLimiter {
+	if !cfg.limited() {
+		return nil
+	}
+	return &BandwidthLimiter{
+		cfg:     cfg,
+		limiter: rate.NewLimiter(rate.Inf, bandwidthBurst),
+		now:     time.Now,
+	}
+}
+
+// limit returns the upload rate in bytes per second at the given time
+func (l *BandwidthLimiter) limit(t time.Time) rate.Limit {
+	kbps := l.cfg.BandwidthKBps
+	for _, window := range l.cfg.Schedule {
+		if window.contains(t) {
+			kbps = window.BandwidthKBps
+			break
+		}
+	}
+	if kbps == 0 {
+		return rate.Inf
+	}
+	return rate.Limit(kbps * 1024)
+}
+
+// waitN blocks until n bytes can be uploaded, applying the limit of the current time of the day
+func (l *BandwidthLimiter) waitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := l.now()
+	if limit := l.limit(now); limit != l.limiter.Limit() {
+		l.limiter.SetLimitAt(now, limit)
+	}
+	l.mu.Unlock()
+
+	return l.limiter.WaitN(ctx, n)
+}
+
+type bandwidthLimiterKey struct{}
+
+// WithBandwidthLimiter returns a context whose uploads share the limiter. A nil limiter does not limit them
+func WithBandwidthLimiter(ctx context.Context, limiter *BandwidthLimiter) context.Context {
+	if limiter == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, bandwidthLimiterKey{}, limiter)
+}
+
+// BandwidthLimited returns true if the uploads made with the context are limited
+func BandwidthLimited(ctx context.Context) bool {
+	_, ok := ctx.Value(bandwidthLimiterKey{}).(*BandwidthLimiter)
+	return ok
+}
+
+// LimitReader returns a reader consuming the bandwidth of the limiter of the context, or r if there is not one.
+// Readers implementing io.Seeker and io.ReaderAt, like files, keep implementing them
+func LimitReader(ctx context.Context, r io.Reader) io.Reader {
+	limiter, ok := ctx.Value(bandwidthLimiterKey{}).(*BandwidthLimiter)
+	if !ok {
+		return r
+	}
+
+	limited := limitedReader{ctx: ctx, reader: r, limiter: limiter}
+	if file, ok := r.(readSeekerAt); ok {
+		return limitedFile{limitedReader: limited, file: file}
+	}
+	return limited
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *BandwidthLimiter
+}
+
+func (r limitedReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthBurst {
+		p = p[:bandwidthBurst]
+	}
+	err := r.limiter.waitN(r.ctx, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+type readSeekerAt interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// limitedFile allows the uploaders to read the parts of a file concurrently and to read it again when retrying
+type limitedFile struct {
+	limitedReader
+	file readSeekerAt
+}
+
+func (f limitedFile) Seek(offset int64, whence int) (int64, error) {
+	return f.file.Seek(offset, whence)
+}
+
+func (f limitedFile) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		chunk := p[read:]
+		if len(chunk) > bandwidthBurst {
+			chunk = chunk[:bandwidthBurst]
+		}
+		err := f.limiter.waitN(f.ctx, len(chunk))
+		if err != nil {
+			return read, err
+		}
+		n, err := f.file.ReadAt(chunk, off+int64(read))
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
@@ -0,0 +1,228 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// at returns the given time of the day in local time
+func at(hour int, minute int) time.Time {
+	return time.Date(2024, time.March, 10, hour, minute, 0, 0, time.Local)
+}
+
+func TestBandwidthWindow_contains(t *testing.T) {
+	tests := []struct {
+		name   string
+		window BandwidthWindow
+		time   time.Time
+		want   bool
+	}{
+		{name: "should contain its start", window: BandwidthWindow{From: "09:00", To: "17:30"}, time: at(9, 0), want: true},
+		{name: "should contain the minutes before its end", window: BandwidthWindow{From: "09:00", To: "17:30"}, time: at(17, 29), want: true},
+		{name: "should not contain its end", window: BandwidthWindow{From: "09:00", To: "17:30"}, time: at(17, 30), want: false},
+		{name: "should not contain the minutes before its start", window: BandwidthWindow{From: "09:00", To: "17:30"}, time: at(8, 59), want: false},
+		{name: "should contain the night before midnight", window: BandwidthWindow{From: "22:00", To: "06:00"}, time: at(23, 59), want: true},
+		{name: "should contain midnight", window: BandwidthWindow{From: "22:00", To: "06:00"}, time: at(0, 0), want: true},
+		{name: "should contain the night after midnight", window: BandwidthWindow{From: "22:00", To: "06:00"}, time: at(5, 59), want: true},
+		{name: "should not contain the day between the nights", window: BandwidthWindow{From: "22:00", To: "06:00"}, time: at(12, 0), want: false},
+		{name: "should not contain the end of a night", window: BandwidthWindow{From: "22:00", To: "06:00"}, time: at(6, 0), want: false},
+		{name: "should be empty if it starts and ends at the same time", window: BandwidthWindow{From: "10:00", To: "10:00"}, time: at(10, 0), want: false},
+		{name: "should not contain anything if it is invalid", window: BandwidthWindow{From: "9am", To: "17:30"}, time: at(12, 0), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.window.contains(tt.time)
+			if got != tt.want {
+				t.Errorf("%v-%v contains %v: got %v, want %v", tt.window.From, tt.window.To, tt.time.Format("15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBandwidthLimiter_limit(t *testing.T) {
+	cfg := UploadConfig{
+		BandwidthKBps: 100,
+		Schedule: []BandwidthWindow{
+			{From: "09:00", To: "18:00", BandwidthKBps: 10},
+			{From: "22:00", To: "07:00", BandwidthKBps: 0},
+			// Overlapped by the first window, which is the one applied
+			{From: "12:00", To: "13:00", BandwidthKBps: 50},
+		},
+	}
+	limiter := NewBandwidthLimiter(cfg)
+
+	tests := []struct {
+		name string
+		time time.Time
+		want rate.Limit
+	}{
+		{name: "should use the default rate outside the windows", time: at(20, 0), want: 100 * 1024},
+		{name: "should use the rate of the window", time: at(10, 0), want: 10 * 1024},
+		{name: "should use the first window containing the time", time: at(12, 30), want: 10 * 1024},
+		{name: "should not limit a window without a rate", time: at(2, 0), want: rate.Inf},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := limiter.limit(tt.time)
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("should not limit outside the windows without a default rate", func(t *testing.T) {
+		limiter := NewBandwidthLimiter(UploadConfig{Schedule: cfg.Schedule[:1]})
+		if got := limiter.limit(at(20, 0)); got != rate.Inf {
+			t.Errorf("got %v, want %v", got, rate.Inf)
+		}
+	})
+
+	t.Run("should not create a limiter without rates", func(t *testing.T) {
+		if limiter := NewBandwidthLimiter(UploadConfig{Workers: 2}); limiter != nil {
+			t.Errorf("unexpected limiter %+v", limiter)
+		}
+	})
+}
+
+func TestBandwidthLimiter_waitN(t *testing.T) {
+	limiter := NewBandwidthLimiter(UploadConfig{
+		BandwidthKBps: 1000,
+		Schedule:      []BandwidthWindow{{From: "23:00", To: "01:00", BandwidthKBps: 2000}},
+	})
+	now := at(22, 59)
+	limiter.now = func() time.Time { return now }
+
+	steps := []struct {
+		time time.Time
+		want rate.Limit
+	}{
+		{time: at(22, 59), want: 1000 * 1024},
+		{time: at(23, 0), want: 2000 * 1024},
+		{time: at(0, 30), want: 2000 * 1024},
+		{time: at(1, 0), want: 1000 * 1024},
+	}
+	for _, step := range steps {
+		now = step.time
+		err := limiter.waitN(context.Background(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := limiter.limiter.Limit(); got != step.want {
+			t.Errorf("limit at %v: got %v, want %v", step.time.Format("15:04"), got, step.want)
+		}
+	}
+}
+
+func TestLimitReader(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 20*1024))
+
+	t.Run("should not wrap the reader without a limiter", func(t *testing.T) {
+		reader := bytes.NewReader(content)
+		if got := LimitReader(context.Background(), reader); got != io.Reader(reader) {
+			t.Errorf("got %T, want the reader", got)
+		}
+		if BandwidthLimited(WithBandwidthLimiter(context.Background(), nil)) {
+			t.Errorf("limited without a limiter")
+		}
+	})
+
+	limiter := NewBandwidthLimiter(UploadConfig{BandwidthKBps: 100 * 1024})
+	ctx := WithBandwidthLimiter(context.Background(), limiter)
+
+	t.Run("should keep the reader a file", func(t *testing.T) {
+		if _, ok := LimitReader(ctx, bytes.NewReader(content)).(readSeekerAt); !ok {
+			t.Errorf("the limited reader is not a file")
+		}
+		if _, ok := LimitReader(ctx, strings.NewReader("")).(io.ReaderAt); !ok {
+			t.Errorf("the limited reader is not a file")
+		}
+		if _, ok := LimitReader(ctx, io.MultiReader(bytes.NewReader(content))).(io.ReaderAt); ok {
+			t.Errorf("the limited stream is a file")
+		}
+	})
+
+	t.Run("should not read more than the burst at once", func(t *testing.T) {
+		n, err := LimitReader(ctx, io.MultiReader(bytes.NewReader(content))).Read(make([]byte, len(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != bandwidthBurst {
+			t.Errorf("read %v bytes, want %v", n, bandwidthBurst)
+		}
+	})
+
+	t.Run("should read the parts of a file larger than the burst", func(t *testing.T) {
+		file := LimitReader(ctx, bytes.NewReader(content)).(io.ReaderAt)
+		offset := int64(1000)
+		part := make([]byte, 3*bandwidthBurst+10)
+		n, err := file.ReadAt(part, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(part) || !bytes.Equal(part, content[offset:offset+int64(len(part))]) {
+			t.Errorf("read %v bytes different from the file", n)
+		}
+
+		last := make([]byte, bandwidthBurst)
+		n, err = file.ReadAt(last, int64(len(content)-100))
+		if err != io.EOF || n != 100 {
+			t.Errorf("got %v bytes and error %v at the end of the file, want 100 and EOF", n, err)
+		}
+	})
+
+	t.Run("should stop reading when the context is canceled", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		n, err := LimitReader(canceled, bytes.NewReader(content)).(io.ReaderAt).ReadAt(make([]byte, 10), 0)
+		if !errors.Is(err, context.Canceled) || n != 0 {
+			t.Errorf("got %v bytes and error %v, want 0 and context canceled", n, err)
+		}
+	})
+}
+
+func TestLimitReader_concurrent(t *testing.T) {
+	const (
+		readers    = 4
+		bytesEach  = 256 * 1024
+		kbps       = 2048
+		totalBytes = readers * bytesEach
+	)
+	limiter := NewBandwidthLimiter(UploadConfig{BandwidthKBps: kbps})
+	ctx := WithBandwidthLimiter(context.Background(), limiter)
+	content := bytes.Repeat([]byte("a"), totalBytes)
+	file := LimitReader(ctx, bytes.NewReader(content)).(io.ReaderAt)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(offset int64) {
+			defer wg.Done()
+			_, err := file.ReadAt(make([]byte, bytesEach), offset)
+			errs <- err
+		}(int64(i * bytesEach))
+	}
+	wg.Wait()
+	close(errs)
+	elapsed := time.Since(start)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The readers share the rate, only the first burst is read without waiting
+	want := time.Duration(float64(totalBytes-bandwidthBurst) / (kbps * 1024) * float64(time.Second))
+	if elapsed < want*9/10 {
+		t.Errorf("read %v bytes in %v, want at least %v", totalBytes, elapsed, want)
+	}
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBundle_roundTrip(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("should extract every packed file by its offset, compressed %v", compress), func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "glacier-bundle-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			modTime := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+			contents := make(map[string][]byte)
+			b, err := newBundle(compress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(b.file.Name())
+			// Sizes around the 512 bytes blocks of tar, so the offsets depend on the padding
+			for i, size := range []int{0, 1, 511, 512, 513, 2000} {
+				path := filepath.Join(tmpDir, fmt.Sprintf("note%d.txt", i))
+				contents[path] = bytes.Repeat([]byte{byte('a' + i)}, size)
+				err = ioutil.WriteFile(path, contents[path], 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.Chtimes(path, modTime, modTime)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = b.add(LocalFile{Path: path})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = b.close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(b.files) != len(contents) {
+				t.Fatalf("got %v packed files, want %v", len(b.files), len(contents))
+			}
+			for i, file := range b.files {
+				target := filepath.Join(tmpDir, fmt.Sprintf("restored%d.txt", i))
+				err = ExtractFromBundle(b.file.Name(), b.key, file.BundleOffset, target)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := ioutil.ReadFile(target)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, contents[file.Path]) || file.SizeBytes != int64(len(got)) {
+					t.Errorf("got %v bytes from %v recorded with %v, want %v", len(got), file.Path, file.SizeBytes, len(contents[file.Path]))
+				}
+				info, err := os.Stat(target)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !info.ModTime().Equal(modTime) {
+					t.Errorf("got modification time %v, want %v", info.ModTime(), modTime)
+				}
+			}
+		})
+	}
+}
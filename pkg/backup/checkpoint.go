@@ -0,0 +1,208 @@
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultCheckpointFiles   = 1000
+	defaultCheckpointMinutes = 10
+	// checkpointPollInterval is how often the uploaded files are counted to decide whether to checkpoint
+	checkpointPollInterval = 5 * time.Second
+)
+
+// Checkpoint uploads a copy of the database if it has changed since it was downloaded or uploaded, so an
+// interrupted backup keeps the progress made until then
+func (c *SQLiteChecker) Checkpoint(ctx context.Context) error {
+	if c.cfg.ReadOnly {
+		return nil
+	}
+
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+
+	c.mu.Lock()
+	if c.db == nil || c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	// Every query runs holding the lock, so no transaction is writing to the file while it is copied
+	path, err := copyToTemp(c.cfg.Path)
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error copying database: %w", err)
+	}
+	defer os.Remove(path)
+
+	return c.upload(ctx, path)
+}
+
+// upload puts the database file if it is different from the remote one
+func (c *SQLiteChecker) upload(ctx context.Context, path string) error {
+	sum, _, err := hashFile(path)
+	if err != nil {
+		return fmt.Errorf("error hashing database: %w", err)
+	}
+	if sum == c.syncedSHA256 {
+		return nil
+	}
+	// The database of another run holding the lock is not overwritten
+	if c.lock != nil {
+		err = c.lock.refresh(ctx)
+		if err != nil {
+			return fmt.Errorf("database not uploaded: %w", err)
+		}
+	}
+
+	err = c.repository.PutEditable(ctx, path, c.cfg.Key)
+	if isReplicationError(err) {
+		// The database is in the primary remote, the replicas get it in the next upload
+		fmt.Printf("Error uploading database: %v\n", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error uploading database: %w", err)
+	}
+	c.syncedSHA256 = sum
+	c.dbUploaded = true
+	return nil
+}
+
+// fetch downloads the database, unless the copy kept by the previous run is the same as the remote one
+func (c *SQLiteChecker) fetch(ctx context.Context) error {
+	if c.cacheMatches(ctx) {
+		return nil
+	}
+
+	err := c.repository.Download(ctx, c.cfg.Key, c.cfg.Path)
+	if err != nil {
+		// The copy of the previous run is not used without knowing it is the one of the remote
+		removeErr := os.Remove(c.cfg.Path)
+		if removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+			return fmt.Errorf("%w (error removing cached database: %v)", err, removeErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// cacheMatches returns true if the local database has the size and hash of the remote one. Remotes not providing
+// a hash of the database are always downloaded
+func (c *SQLiteChecker) cacheMatches(ctx context.Context) bool {
+	local, err := os.Stat(c.cfg.Path)
+	if err != nil {
+		return false
+	}
+	info, err := c.repository.Head(ctx, c.cfg.Key)
+	if err != nil || info.Size != local.Size() {
+		return false
+	}
+
+	localSHA256, localMD5, err := hashFile(c.cfg.Path)
+	if err != nil {
+		return false
+	}
+	switch {
+	case info.SHA256 != "":
+		return info.SHA256 == localSHA256
+	case info.MD5 != "":
+		return info.MD5 == localMD5
+	}
+
+	if hasher, ok := c.repository.(Hasher); ok {
+		sum, err := hasher.SHA256(ctx, c.cfg.Key)
+		return err == nil && sum == localSHA256
+	}
+	return false
+}
+
+// checkpoints uploads the database every CheckpointFiles uploaded files or CheckpointMinutes, until the returned
+// function is called
+func (h fileBackuper) checkpoints(ctx context.Context) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	tick := time.NewTicker(checkpointPollInterval)
+
+	go func() {
+		defer close(done)
+		defer tick.Stop()
+		h.checkpointOnTicks(ctx, time.Now(), tick.C)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// checkpointOnTicks checks on every tick whether the database has to be uploaded, until ctx is done
+func (h fileBackuper) checkpointOnTicks(ctx context.Context, start time.Time, ticks <-chan time.Time) {
+	files := h.config.Upload.CheckpointFilesOrDefault()
+	interval := time.Duration(h.config.Upload.CheckpointMinutesOrDefault()) * time.Minute
+	last, lastUploaded := start, h.eChecker.Uploaded()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticks:
+			uploaded := h.eChecker.Uploaded()
+			if uploaded-lastUploaded < files && now.Sub(last) < interval {
+				continue
+			}
+			err := h.eChecker.Checkpoint(ctx)
+			if err != nil && ctx.Err() == nil {
+				fmt.Printf("Error checkpointing database: %v\n", err)
+			}
+			last, lastUploaded = now, uploaded
+		}
+	}
+}
+
+// copyToTemp copies the file to a temporary file in the same folder and returns its path
+func copyToTemp(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".checkpoint-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
+// hashFile returns the hex encoded SHA-256 and MD5 of the content of the file
+func hashFile(path string) (string, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	sha, md := sha256.New(), md5.New()
+	_, err = io.Copy(io.MultiWriter(sha, md), file)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(sha.Sum(nil)), hex.EncodeToString(md.Sum(nil)), nil
+}
@@ -0,0 +1,278 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/mock/gomock"
+)
+
+func TestFileBackuper_checkpointOnTicks(t *testing.T) {
+	start := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	type tick struct {
+		after    time.Duration
+		uploaded int
+		// checkpoint is true if the database must be uploaded on the tick
+		checkpoint bool
+	}
+	tests := []struct {
+		name   string
+		upload UploadConfig
+		ticks  []tick
+	}{
+		{
+			name:   "should checkpoint every given number of uploaded files",
+			upload: UploadConfig{CheckpointFiles: 10, CheckpointMinutes: 60},
+			ticks: []tick{
+				{after: time.Minute, uploaded: 5},
+				{after: 2 * time.Minute, uploaded: 10, checkpoint: true},
+				{after: 3 * time.Minute, uploaded: 19},
+				{after: 4 * time.Minute, uploaded: 20, checkpoint: true},
+			},
+		},
+		{
+			name:   "should checkpoint every given minutes",
+			upload: UploadConfig{CheckpointFiles: 1000, CheckpointMinutes: 10},
+			ticks: []tick{
+				{after: 5 * time.Minute, uploaded: 1},
+				{after: 10 * time.Minute, uploaded: 2, checkpoint: true},
+				{after: 19 * time.Minute, uploaded: 3},
+				{after: 20 * time.Minute, uploaded: 4, checkpoint: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockChecker := NewMockExistentFilesChecker(ctrl)
+			calls := []any{mockChecker.EXPECT().Uploaded().Return(0)}
+			for _, tk := range tt.ticks {
+				calls = append(calls, mockChecker.EXPECT().Uploaded().Return(tk.uploaded))
+				if tk.checkpoint {
+					calls = append(calls, mockChecker.EXPECT().Checkpoint(gomock.Any()).Return(nil))
+				}
+			}
+			gomock.InOrder(calls...)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			ticks := make(chan time.Time)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				fileBackuper{eChecker: mockChecker, config: Config{Upload: tt.upload}}.checkpointOnTicks(ctx, start, ticks)
+			}()
+			for _, tk := range tt.ticks {
+				ticks <- start.Add(tk.after)
+			}
+			cancel()
+			<-done
+		})
+	}
+}
+
+func writeTestDatabase(t *testing.T, content string) string {
+	t.Helper()
+	tmpDir, err := ioutil.TempDir("", "glacier-checkpoint-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	path := filepath.Join(tmpDir, "backup.db")
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSQLiteChecker_upload(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should upload the database only if it has changed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		path := writeTestDatabase(t, "first")
+		mockRepo := NewMockRemoteFilesRepository(ctrl)
+		checker := NewSQLiteChecker(SqliteConfig{Path: path, Key: "backup.db"}, mockRepo)
+
+		mockRepo.EXPECT().PutEditable(gomock.Any(), path, "backup.db").Return(nil).Times(2)
+		err := checker.upload(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checker.upload(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(path, []byte("second"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checker.upload(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !checker.dbUploaded {
+			t.Errorf("the database is not marked as uploaded")
+		}
+	})
+
+	t.Run("should refresh the lock before uploading the database", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		path := writeTestDatabase(t, "first")
+		mockRepo := NewMockRemoteFilesRepository(ctrl)
+		mockWriter := NewMockConditionalWriter(ctrl)
+		checker := NewSQLiteChecker(SqliteConfig{Path: path, Key: "backup.db"}, mockRepo)
+		checker.lock = &remoteLock{repo: mockRepo, writer: mockWriter, key: "backup.db.lock", version: "1"}
+
+		gomock.InOrder(
+			mockWriter.EXPECT().PutIfMatch(gomock.Any(), "backup.db.lock", gomock.Any(), "1").Return("2", nil),
+			mockRepo.EXPECT().PutEditable(gomock.Any(), path, "backup.db").Return(nil),
+		)
+		err := checker.upload(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checker.lock.version != "2" || !checker.lock.lock.ExpiresAt.After(time.Now()) {
+			t.Errorf("the lock has not been refreshed: %+v", checker.lock.lock)
+		}
+	})
+
+	t.Run("should upload the database again after a failed upload", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		path := writeTestDatabase(t, "first")
+		mockRepo := NewMockRemoteFilesRepository(ctrl)
+		checker := NewSQLiteChecker(SqliteConfig{Path: path, Key: "backup.db"}, mockRepo)
+
+		uploadErr := errors.New("connection reset")
+		gomock.InOrder(
+			mockRepo.EXPECT().PutEditable(gomock.Any(), path, "backup.db").Return(uploadErr),
+			mockRepo.EXPECT().PutEditable(gomock.Any(), path, "backup.db").Return(nil),
+		)
+		err := checker.upload(ctx, path)
+		if !errors.Is(err, uploadErr) {
+			t.Errorf("got error %v, want %v", err, uploadErr)
+		}
+		err = checker.upload(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestSQLiteChecker_fetch(t *testing.T) {
+	ctx := context.Background()
+	const content = "cached"
+
+	// newChecker returns a checker of a cached database with content
+	newChecker := func(t *testing.T, repo RemoteFilesRepository) *SQLiteChecker {
+		return NewSQLiteChecker(SqliteConfig{Path: writeTestDatabase(t, content), Key: "backup.db"}, repo)
+	}
+	sha, md, err := hashFile(writeTestDatabase(t, content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should reuse the cached database with the size and hash of the remote one", func(t *testing.T) {
+		for _, info := range []ObjectInfo{
+			{Size: int64(len(content)), SHA256: sha},
+			{Size: int64(len(content)), MD5: md},
+		} {
+			ctrl := gomock.NewController(t)
+			mockRepo := NewMockRemoteFilesRepository(ctrl)
+			checker := newChecker(t, mockRepo)
+
+			mockRepo.EXPECT().Head(gomock.Any(), "backup.db").Return(info, nil)
+			mockRepo.EXPECT().Download(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+			err := checker.fetch(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctrl.Finish()
+		}
+	})
+
+	t.Run("should download the remote database if the cached one is stale", func(t *testing.T) {
+		for _, info := range []ObjectInfo{
+			{Size: int64(len(content)), SHA256: "other"},
+			{Size: int64(len(content)), MD5: "other"},
+			{Size: int64(len(content)) + 1, SHA256: sha},
+			// Without hash the cached database cannot be compared
+			{Size: int64(len(content))},
+		} {
+			ctrl := gomock.NewController(t)
+			mockRepo := NewMockRemoteFilesRepository(ctrl)
+			checker := newChecker(t, mockRepo)
+
+			mockRepo.EXPECT().Head(gomock.Any(), "backup.db").Return(info, nil)
+			mockRepo.EXPECT().Download(gomock.Any(), "backup.db", checker.cfg.Path).
+				DoAndReturn(func(_ context.Context, _ string, path string) error {
+					return ioutil.WriteFile(path, []byte("remote"), 0644)
+				})
+			err := checker.fetch(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			downloaded, err := ioutil.ReadFile(checker.cfg.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(downloaded) != "remote" {
+				t.Errorf("got database %q, want the remote one", downloaded)
+			}
+			ctrl.Finish()
+		}
+	})
+
+	t.Run("should compare the cached database with the hash of the remote", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockRepo := NewMockRemoteFilesRepository(ctrl)
+		mockHasher := NewMockHasher(ctrl)
+		checker := newChecker(t, struct {
+			RemoteFilesRepository
+			Hasher
+		}{mockRepo, mockHasher})
+
+		mockRepo.EXPECT().Head(gomock.Any(), "backup.db").Return(ObjectInfo{Size: int64(len(content))}, nil)
+		mockHasher.EXPECT().SHA256(gomock.Any(), "backup.db").Return(sha, nil)
+		err := checker.fetch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("should remove the stale cached database when the remote one cannot be downloaded", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockRepo := NewMockRemoteFilesRepository(ctrl)
+		checker := newChecker(t, mockRepo)
+
+		downloadErr := errors.New("connection reset")
+		mockRepo.EXPECT().Head(gomock.Any(), "backup.db").Return(ObjectInfo{Size: int64(len(content)), SHA256: "other"}, nil)
+		mockRepo.EXPECT().Download(gomock.Any(), "backup.db", checker.cfg.Path).Return(downloadErr)
+		err := checker.fetch(ctx)
+		if !errors.Is(err, downloadErr) {
+			t.Errorf("got error %v, want %v", err, downloadErr)
+		}
+		if _, err := os.Stat(checker.cfg.Path); !os.IsNotExist(err) {
+			t.Errorf("the stale database has been kept: %v", err)
+		}
+	})
+}
@@ -1,18 +1,149 @@
 package backup
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 const glacierBackupFolder = ".glacier-backup"
 
+const defaultConfigFile = "config.yaml"
+
+const defaultDatabase = "backup.db"
+
 type Config struct {
-	PathsToBackup   []string
-	IgnoredPatterns []string
-	SelectedRemote  string
-	GlacierPath     string
+	PathsToBackup   []string                `yaml:"pathsToBackup"`
+	IgnoredPatterns []string                `yaml:"ignoredPatterns"`
+	SelectedRemote  string                  `yaml:"selectedRemote"`
+	Remotes         map[string]RemoteConfig `yaml:"remotes"`
+	Profiles        map[string]Profile      `yaml:"profiles"`
+	Encryption      EncryptionConfig        `yaml:"encryption"`
+	Packing         PackingConfig           `yaml:"packing"`
+	ChangeDetection ChangeDetection         `yaml:"changeDetection"`
+	Retention       RetentionConfig         `yaml:"retention"`
+	CleanRemote     CleanRemoteConfig       `yaml:"cleanRemote"`
+	Upload          UploadConfig            `yaml:"upload"`
+	// Replicas are the remotes every file is uploaded to besides the selected one
+	Replicas []string `yaml:"replicas"`
+	// DryRun reports the changes instead of applying them to the remote
+	DryRun bool `yaml:"-"`
+	// Profile is the name of the loaded profile, empty when the top level configuration is used
+	Profile string `yaml:"-"`
+	// Database is the key of the SQLite database storing the state of the backup in the remote
+	Database string `yaml:"database"`
+	// DatabaseCopies is the number of timestamped copies of the database kept in the remote
+	DatabaseCopies int    `yaml:"databaseCopies"`
+	GlacierPath    string `yaml:"-"`
+}
+
+// Profile is a named backup with its own paths, remote and database,
+// so the state of unrelated backups is never mixed
+type Profile struct {
+	PathsToBackup   []string `yaml:"pathsToBackup"`
+	IgnoredPatterns []string `yaml:"ignoredPatterns"`
+	SelectedRemote  string   `yaml:"selectedRemote"`
+	// Replicas default to the ones of the top level configuration
+	Replicas []string `yaml:"replicas"`
+	// ChangeDetection defaults to the one of the top level configuration
+	ChangeDetection ChangeDetection `yaml:"changeDetection"`
+	// Retention defaults to the one of the top level configuration
+	Retention *RetentionConfig `yaml:"retention"`
+	// Database defaults to the name of the profile followed by .db
+	Database string `yaml:"database"`
+}
+
+// ChangeDetection is how modified files are detected
+type ChangeDetection string
+
+const (
+	// ChangeDetectionMTime uploads the files modified after their last upload
+	ChangeDetectionMTime ChangeDetection = "mtime"
+	// ChangeDetectionMTimeSize also uploads the files whose size has changed
+	ChangeDetectionMTimeSize ChangeDetection = "mtimeSize"
+	// ChangeDetectionHash uploads the files whose SHA-256 has changed, ignoring their modification time
+	ChangeDetectionHash ChangeDetection = "hash"
+)
+
+func (c ChangeDetection) validate() error {
+	switch c {
+	case ChangeDetectionMTime, ChangeDetectionMTimeSize, ChangeDetectionHash:
+		return nil
+	}
+	return fmt.Errorf("unknown changeDetection '%v', valid values are %v, %v and %v",
+		c, ChangeDetectionMTime, ChangeDetectionMTimeSize, ChangeDetectionHash)
+}
+
+// EncryptionConfig enables the client side encryption of the files before uploading them
+type EncryptionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// KeyFile contains the secret the encryption keys are derived from. If it is empty,
+	// the secret is read from the environment variable GLACIER_BACKUP_ENCRYPTION_PASSPHRASE
+	KeyFile string `yaml:"keyFile"`
+	// ObfuscateKeys stores the files under a keyed hash of their path instead of the path itself
+	ObfuscateKeys bool `yaml:"obfuscateKeys"`
+	// TempDir is where the files are encrypted before uploading them, the folder of the state database by default
+	TempDir string `yaml:"tempDir"`
+}
+
+const (
+	defaultMaxDeletePercent = 20
+	defaultTrashDays        = 30
+)
+
+// CleanRemoteConfig limits the files --cleanRemote deletes at once, so a volume that is not completely
+// mounted does not delete the backup of its files
+type CleanRemoteConfig struct {
+	// MaxDeletePercent is the maximum percentage of the backed up files that can be missing locally
+	MaxDeletePercent int `yaml:"maxDeletePercent"`
+	// TrashDays is how long the files deleted locally stay in the trash before deleting them from the remote
+	TrashDays int `yaml:"trashDays"`
+	// Force deletes the missing files even if they exceed MaxDeletePercent
+	Force bool `yaml:"-"`
+}
+
+func (c CleanRemoteConfig) MaxDeletePercentOrDefault() int {
+	if c.MaxDeletePercent == 0 {
+		return defaultMaxDeletePercent
+	}
+	return c.MaxDeletePercent
+}
+
+func (c CleanRemoteConfig) TrashPeriod() time.Duration {
+	if c.TrashDays == 0 {
+		return defaultTrashDays * 24 * time.Hour
+	}
+	return time.Duration(c.TrashDays) * 24 * time.Hour
+}
+
+type RemoteConfig struct {
+	CustomConfig CustomConfig `yaml:"customConfig"`
+}
+
+// CustomConfig keeps the remote specific configuration undecoded, so each remote
+// decodes it into its own configuration struct
+type CustomConfig struct {
+	node yaml.Node
+}
+
+func (c *CustomConfig) UnmarshalYAML(value *yaml.Node) error {
+	c.node = *value
+	return nil
+}
+
+// Decode stores the configuration in the value pointed by v. It does nothing if the remote is not configured
+func (c CustomConfig) Decode(v any) error {
+	if c.node.Kind == 0 {
+		return nil
+	}
+	return c.node.Decode(v)
 }
 
 const (
@@ -20,39 +151,272 @@ const (
 	ignoredPatternsKey = "GLACIER_BACKUP_IGNORED_PATTERNS"
 )
 
-var requiredVariables = []string{pathsToBackupKey, ignoredPatternsKey}
-
 type ConfigDecoder struct {
+	configPath string
 }
 
-func NewConfigDecoder() *ConfigDecoder {
-	return &ConfigDecoder{}
+// NewConfigDecoder creates a decoder reading the given YAML file. If configPath is empty,
+// the optional file ~/.glacier-backup/config.yaml is used
+func NewConfigDecoder(configPath string) *ConfigDecoder {
+	return &ConfigDecoder{configPath: configPath}
 }
 
-func (cd ConfigDecoder) LoadConfiguration(selectedRemote string) (Config, error) {
-	for _, s := range requiredVariables {
-		if os.Getenv(s) == "" {
-			return Config{}, fmt.Errorf("environment variable %s not set", s)
+// LoadConfiguration reads the configuration file and overrides its values with the
+// GLACIER_BACKUP_* environment variables. If profile is not empty, the paths, patterns, remote and
+// database of the profile are used instead and environment variables are ignored.
+// selectedRemote overrides the configured remote if not empty
+func (cd ConfigDecoder) LoadConfiguration(profile string, selectedRemote string) (Config, error) {
+	cfg, err := cd.readFile()
+	if err != nil {
+		return Config{}, err
+	}
+
+	if profile == "" {
+		if v := os.Getenv(pathsToBackupKey); v != "" {
+			cfg.PathsToBackup = strings.Split(v, ";")
+		}
+		if v := os.Getenv(ignoredPatternsKey); v != "" {
+			cfg.IgnoredPatterns = strings.Split(v, ";")
 		}
 	}
-	pathsToBackup := strings.Split(os.Getenv(pathsToBackupKey), ";")
-	ignoredPatterns := strings.Split(os.Getenv(ignoredPatternsKey), ";")
+
+	err = cfg.validateProfiles(profile)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if profile != "" {
+		cfg, err = cfg.withProfile(profile)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	if selectedRemote != "" {
+		cfg.SelectedRemote = selectedRemote
+	}
+	cfg.Database = cfg.databaseOrDefault()
+	if cfg.ChangeDetection == "" {
+		cfg.ChangeDetection = ChangeDetectionMTime
+	}
+	err = cfg.ChangeDetection.validate()
+	if err != nil {
+		return Config{}, err
+	}
+
+	if len(cfg.PathsToBackup) == 0 {
+		return Config{}, fmt.Errorf("no paths to backup: set pathsToBackup in the configuration file or the environment variable %s", pathsToBackupKey)
+	}
+	if cfg.SelectedRemote == "" {
+		return Config{}, errors.New("no remote selected: set selectedRemote in the configuration file or pass it as argument")
+	}
+	err = cfg.validateReplicas()
+	if err != nil {
+		return Config{}, err
+	}
+	err = cfg.Upload.validate()
+	if err != nil {
+		return Config{}, err
+	}
+	if cfg.DatabaseCopies < 0 {
+		return Config{}, errors.New("databaseCopies must be positive")
+	}
 
 	userHome, err := os.UserHomeDir()
 	if err != nil {
 		return Config{}, err
 	}
+	cfg.GlacierPath = userHome + string(os.PathSeparator) + glacierBackupFolder
+
+	return cfg, nil
+}
 
-	cfg := Config{
-		PathsToBackup:   pathsToBackup,
-		IgnoredPatterns: ignoredPatterns,
-		SelectedRemote:  selectedRemote,
-		GlacierPath:     userHome,
+func (cd ConfigDecoder) readFile() (Config, error) {
+	cfg := Config{}
+
+	path := cd.configPath
+	if path == "" {
+		defaultPath, err := cfg.getApplicationPath(defaultConfigFile)
+		if err != nil {
+			return Config{}, err
+		}
+		path = defaultPath
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && cd.configPath == "" {
+		return cfg, nil
+	}
+	if err != nil {
+		return Config{}, fmt.Errorf("error reading configuration file: %w", err)
+	}
+
+	err = yaml.Unmarshal(content, &cfg)
+	if err != nil {
+		return Config{}, fmt.Errorf("error decoding configuration file %v: %w", path, err)
 	}
 
 	return cfg, nil
 }
 
+func (conf Config) withProfile(name string) (Config, error) {
+	profile, ok := conf.Profiles[name]
+	if !ok {
+		return Config{}, fmt.Errorf("profile '%v' not found in the configuration file", name)
+	}
+
+	conf.Profile = name
+	conf.PathsToBackup = profile.PathsToBackup
+	conf.IgnoredPatterns = profile.IgnoredPatterns
+	if profile.SelectedRemote != "" {
+		conf.SelectedRemote = profile.SelectedRemote
+	}
+	if profile.Replicas != nil {
+		conf.Replicas = profile.Replicas
+	}
+	if profile.ChangeDetection != "" {
+		conf.ChangeDetection = profile.ChangeDetection
+	}
+	if profile.Retention != nil {
+		conf.Retention = *profile.Retention
+	}
+	conf.Database = profile.databaseOrDefault(name)
+
+	return conf, nil
+}
+
+func (p Profile) databaseOrDefault(name string) string {
+	if p.Database != "" {
+		return p.Database
+	}
+	return name + ".db"
+}
+
+// validateProfiles checks that profiles sharing a remote or a replica use different databases and do not backup
+// the same paths. Otherwise, cleaning the remote of a profile would delete the files of the other. The top level
+// configuration is only checked when it is the one being run, as it is often left over when moving to profiles
+func (conf Config) validateProfiles(profile string) error {
+	type backupDefinition struct {
+		name     string
+		paths    []string
+		remotes  []string
+		database string
+	}
+
+	names := make([]string, 0, len(conf.Profiles))
+	for name := range conf.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var definitions []backupDefinition
+	if profile == "" && len(conf.PathsToBackup) != 0 {
+		definitions = append(definitions, backupDefinition{
+			name:     "top level configuration",
+			paths:    conf.PathsToBackup,
+			remotes:  append([]string{conf.SelectedRemote}, conf.Replicas...),
+			database: conf.databaseOrDefault(),
+		})
+	}
+	for _, name := range names {
+		profile := conf.Profiles[name]
+		remote := profile.SelectedRemote
+		if remote == "" {
+			remote = conf.SelectedRemote
+		}
+		replicas := profile.Replicas
+		if replicas == nil {
+			replicas = conf.Replicas
+		}
+		definitions = append(definitions, backupDefinition{
+			name:     "profile '" + name + "'",
+			paths:    profile.PathsToBackup,
+			remotes:  append([]string{remote}, replicas...),
+			database: profile.databaseOrDefault(name),
+		})
+	}
+
+	for i, definition := range definitions {
+		for _, other := range definitions[i+1:] {
+			remote, shared := sharedRemote(definition.remotes, other.remotes)
+			if !shared {
+				continue
+			}
+			if definition.database == other.database {
+				return fmt.Errorf("%v and %v use the same database %v in remote '%v'", definition.name, other.name, other.database, remote)
+			}
+			for _, path := range definition.paths {
+				for _, otherPath := range other.paths {
+					if IsSubPath(path, otherPath) || IsSubPath(otherPath, path) {
+						return fmt.Errorf("%v and %v backup overlapping paths %v and %v in remote '%v'", definition.name, other.name, path, otherPath, remote)
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func sharedRemote(remotes []string, others []string) (string, bool) {
+	for _, remote := range remotes {
+		for _, other := range others {
+			if remote == other {
+				return remote, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (conf Config) validateReplicas() error {
+	seen := map[string]bool{conf.SelectedRemote: true}
+	for _, replica := range conf.Replicas {
+		if replica == conf.SelectedRemote {
+			return fmt.Errorf("the selected remote '%v' cannot be a replica", replica)
+		}
+		if seen[replica] {
+			return fmt.Errorf("replica '%v' is repeated", replica)
+		}
+		seen[replica] = true
+	}
+	return nil
+}
+
+func (conf Config) databaseOrDefault() string {
+	if conf.Database != "" {
+		return conf.Database
+	}
+	return defaultDatabase
+}
+
+func (conf Config) DatabaseCopiesOrDefault() int {
+	if conf.DatabaseCopies == 0 {
+		return defaultDatabaseCopies
+	}
+	return conf.DatabaseCopies
+}
+
+// IsSubPath returns true if path is root or is inside root
+func IsSubPath(root string, path string) bool {
+	root = filepath.Clean(root)
+	path = filepath.Clean(path)
+	if path == root {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(root, string(os.PathSeparator))+string(os.PathSeparator))
+}
+
+// Contains returns true if path is inside one of the paths to backup
+func (conf Config) Contains(path string) bool {
+	for _, root := range conf.PathsToBackup {
+		if IsSubPath(root, path) {
+			return true
+		}
+	}
+	return false
+}
+
 func (conf Config) getApplicationPath(path string) (string, error) {
 	userHome, err := os.UserHomeDir()
 
@@ -64,6 +428,11 @@ func (conf Config) getApplicationPath(path string) (string, error) {
 
 }
 
+// RemoteConfig returns the custom configuration of the given remote
+func (conf Config) RemoteConfig(remote string) CustomConfig {
+	return conf.Remotes[remote].CustomConfig
+}
+
 func (conf Config) IsLocal() bool {
 	return conf.SelectedRemote == "local"
 }
@@ -71,3 +440,15 @@ func (conf Config) IsLocal() bool {
 func (conf Config) IsS3() bool {
 	return conf.SelectedRemote == "s3"
 }
+
+func (conf Config) IsGCS() bool {
+	return conf.SelectedRemote == "gcs"
+}
+
+func (conf Config) IsAzure() bool {
+	return conf.SelectedRemote == "azure"
+}
+
+func (conf Config) IsSFTP() bool {
+	return conf.SelectedRemote == "sftp"
+}
@@ -0,0 +1,350 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes the configuration file in a temporary home folder and returns its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	home, err := ioutil.TempDir("", "glacier-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(home) })
+	t.Setenv("HOME", home)
+	t.Setenv(pathsToBackupKey, "")
+	t.Setenv(ignoredPatternsKey, "")
+
+	path := filepath.Join(home, "config.yaml")
+	err = ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigDecoder_LoadConfiguration(t *testing.T) {
+	const configFile = `
+pathsToBackup: ["/yaml/photos"]
+ignoredPatterns: ["/.git"]
+selectedRemote: s3
+profiles:
+  documents:
+    pathsToBackup: ["/yaml/documents"]
+`
+
+	tests := []struct {
+		name          string
+		env           map[string]string
+		profile       string
+		remote        string
+		wantPaths     []string
+		wantPatterns  []string
+		wantRemote    string
+		wantDatabase  string
+		wantProfile   string
+		wantDetection ChangeDetection
+	}{
+		{
+			name:          "should read the values of the file",
+			wantPaths:     []string{"/yaml/photos"},
+			wantPatterns:  []string{"/.git"},
+			wantRemote:    "s3",
+			wantDatabase:  defaultDatabase,
+			wantDetection: ChangeDetectionMTime,
+		},
+		{
+			name:          "should override the file with the environment variables",
+			env:           map[string]string{pathsToBackupKey: "/env/photos;/env/music", ignoredPatternsKey: "*.tmp"},
+			wantPaths:     []string{"/env/photos", "/env/music"},
+			wantPatterns:  []string{"*.tmp"},
+			wantRemote:    "s3",
+			wantDatabase:  defaultDatabase,
+			wantDetection: ChangeDetectionMTime,
+		},
+		{
+			name:          "should override the selected remote with the argument",
+			env:           map[string]string{pathsToBackupKey: "/env/photos"},
+			remote:        "local",
+			wantPaths:     []string{"/env/photos"},
+			wantPatterns:  []string{"/.git"},
+			wantRemote:    "local",
+			wantDatabase:  defaultDatabase,
+			wantDetection: ChangeDetectionMTime,
+		},
+		{
+			name:          "should ignore the environment variables when a profile is used",
+			env:           map[string]string{pathsToBackupKey: "/env/photos"},
+			profile:       "documents",
+			remote:        "local",
+			wantPaths:     []string{"/yaml/documents"},
+			wantRemote:    "local",
+			wantDatabase:  "documents.db",
+			wantProfile:   "documents",
+			wantDetection: ChangeDetectionMTime,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, configFile)
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, err := NewConfigDecoder(path).LoadConfiguration(tt.profile, tt.remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cfg.PathsToBackup, tt.wantPaths) {
+				t.Errorf("paths %v, want %v", cfg.PathsToBackup, tt.wantPaths)
+			}
+			if !reflect.DeepEqual(cfg.IgnoredPatterns, tt.wantPatterns) {
+				t.Errorf("ignored patterns %v, want %v", cfg.IgnoredPatterns, tt.wantPatterns)
+			}
+			if cfg.SelectedRemote != tt.wantRemote {
+				t.Errorf("remote %v, want %v", cfg.SelectedRemote, tt.wantRemote)
+			}
+			if cfg.Database != tt.wantDatabase {
+				t.Errorf("database %v, want %v", cfg.Database, tt.wantDatabase)
+			}
+			if cfg.Profile != tt.wantProfile {
+				t.Errorf("profile %v, want %v", cfg.Profile, tt.wantProfile)
+			}
+			if cfg.ChangeDetection != tt.wantDetection {
+				t.Errorf("change detection %v, want %v", cfg.ChangeDetection, tt.wantDetection)
+			}
+		})
+	}
+
+	t.Run("should use only the environment variables without the default file", func(t *testing.T) {
+		writeConfig(t, "")
+		t.Setenv(pathsToBackupKey, "/env/photos")
+
+		cfg, err := NewConfigDecoder("").LoadConfiguration("", "local")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cfg.PathsToBackup, []string{"/env/photos"}) || cfg.SelectedRemote != "local" {
+			t.Errorf("unexpected configuration %+v", cfg)
+		}
+		if cfg.GlacierPath != filepath.Join(os.Getenv("HOME"), glacierBackupFolder) {
+			t.Errorf("unexpected glacier path %v", cfg.GlacierPath)
+		}
+	})
+}
+
+func TestConfigDecoder_LoadConfiguration_invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		profile string
+		wantErr string
+	}{
+		{
+			name:    "should fail on invalid YAML",
+			content: "pathsToBackup: [/photos",
+			wantErr: "error decoding configuration file",
+		},
+		{
+			name:    "should fail on values of the wrong type",
+			content: "pathsToBackup: /photos\nselectedRemote: [s3]",
+			wantErr: "error decoding configuration file",
+		},
+		{
+			name:    "should fail without paths to backup",
+			content: "selectedRemote: s3",
+			wantErr: "no paths to backup",
+		},
+		{
+			name:    "should fail without remote",
+			content: "pathsToBackup: [/photos]",
+			wantErr: "no remote selected",
+		},
+		{
+			name:    "should fail on an unknown change detection",
+			content: "pathsToBackup: [/photos]\nselectedRemote: s3\nchangeDetection: ctime",
+			wantErr: "unknown changeDetection 'ctime'",
+		},
+		{
+			name:    "should fail when the selected remote is a replica",
+			content: "pathsToBackup: [/photos]\nselectedRemote: s3\nreplicas: [s3]",
+			wantErr: "the selected remote 's3' cannot be a replica",
+		},
+		{
+			name:    "should fail on negative workers",
+			content: "pathsToBackup: [/photos]\nselectedRemote: s3\nupload:\n  workers: -1",
+			wantErr: "upload.workers must be positive",
+		},
+		{
+			name:    "should fail on negative database copies",
+			content: "pathsToBackup: [/photos]\nselectedRemote: s3\ndatabaseCopies: -1",
+			wantErr: "databaseCopies must be positive",
+		},
+		{
+			name:    "should fail on an unknown profile",
+			content: "pathsToBackup: [/photos]\nselectedRemote: s3",
+			profile: "music",
+			wantErr: "profile 'music' not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, tt.content)
+
+			_, err := NewConfigDecoder(path).LoadConfiguration(tt.profile, "")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("should fail when the given file does not exist", func(t *testing.T) {
+		path := writeConfig(t, "")
+
+		_, err := NewConfigDecoder(path+".missing").LoadConfiguration("", "s3")
+		if err == nil || !strings.Contains(err.Error(), "error reading configuration file") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
+
+func TestConfig_validateProfiles(t *testing.T) {
+	profiles := map[string]Profile{
+		"photos":    {PathsToBackup: []string{"/home/me/Pictures"}},
+		"documents": {PathsToBackup: []string{"/home/me/Documents"}, SelectedRemote: "local"},
+	}
+
+	tests := []struct {
+		name    string
+		conf    Config
+		profile string
+		wantErr string
+	}{
+		{
+			name:    "should accept profiles with different paths and databases",
+			conf:    Config{SelectedRemote: "s3", Profiles: profiles},
+			profile: "photos",
+		},
+		{
+			name:    "should ignore the top level paths when a profile is run",
+			conf:    Config{PathsToBackup: []string{"/home/me"}, SelectedRemote: "s3", Profiles: profiles},
+			profile: "photos",
+		},
+		{
+			name:    "should ignore the top level configuration without paths",
+			conf:    Config{SelectedRemote: "s3", Database: "photos.db", Profiles: profiles},
+			profile: "",
+		},
+		{
+			name:    "should reject top level paths overlapping a profile when the top level is run",
+			conf:    Config{PathsToBackup: []string{"/home/me"}, SelectedRemote: "s3", Profiles: profiles},
+			wantErr: "top level configuration and profile 'photos' backup overlapping paths /home/me and /home/me/Pictures in remote 's3'",
+		},
+		{
+			name: "should reject profiles sharing a database in the same remote",
+			conf: Config{SelectedRemote: "s3", Profiles: map[string]Profile{
+				"photos": {PathsToBackup: []string{"/home/me/Pictures"}, Database: "backup.db"},
+				"music":  {PathsToBackup: []string{"/home/me/Music"}, Database: "backup.db"},
+			}},
+			profile: "photos",
+			wantErr: "profile 'music' and profile 'photos' use the same database backup.db in remote 's3'",
+		},
+		{
+			name: "should reject profiles with overlapping paths sharing a replica",
+			conf: Config{SelectedRemote: "s3", Profiles: map[string]Profile{
+				"photos": {PathsToBackup: []string{"/home/me/Pictures"}, Replicas: []string{"sftp"}},
+				"all":    {PathsToBackup: []string{"/home/me"}, SelectedRemote: "local", Replicas: []string{"sftp"}},
+			}},
+			profile: "photos",
+			wantErr: "profile 'all' and profile 'photos' backup overlapping paths /home/me and /home/me/Pictures in remote 'sftp'",
+		},
+		{
+			name: "should accept profiles with overlapping paths in different remotes",
+			conf: Config{SelectedRemote: "s3", Profiles: map[string]Profile{
+				"photos": {PathsToBackup: []string{"/home/me/Pictures"}},
+				"all":    {PathsToBackup: []string{"/home/me"}, SelectedRemote: "local"},
+			}},
+			profile: "all",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.conf.validateProfiles(tt.profile)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfig_withProfile(t *testing.T) {
+	retention := RetentionConfig{KeepLast: 3}
+	conf := Config{
+		PathsToBackup:   []string{"/home/me"},
+		IgnoredPatterns: []string{"/.git"},
+		SelectedRemote:  "s3",
+		Replicas:        []string{"sftp"},
+		ChangeDetection: ChangeDetectionMTime,
+		Retention:       RetentionConfig{KeepLast: 7},
+		Profiles: map[string]Profile{
+			"photos": {PathsToBackup: []string{"/home/me/Pictures"}},
+			"code": {
+				PathsToBackup:   []string{"/home/me/Code"},
+				IgnoredPatterns: []string{"/node_modules"},
+				SelectedRemote:  "local",
+				Replicas:        []string{},
+				ChangeDetection: ChangeDetectionHash,
+				Retention:       &retention,
+				Database:        "code-backup.db",
+			},
+		},
+	}
+
+	t.Run("should default to the top level remote, replicas, change detection and retention", func(t *testing.T) {
+		cfg, err := conf.withProfile("photos")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Profile != "photos" || cfg.Database != "photos.db" {
+			t.Errorf("unexpected profile %v and database %v", cfg.Profile, cfg.Database)
+		}
+		if !reflect.DeepEqual(cfg.PathsToBackup, []string{"/home/me/Pictures"}) || cfg.IgnoredPatterns != nil {
+			t.Errorf("unexpected paths %v and patterns %v", cfg.PathsToBackup, cfg.IgnoredPatterns)
+		}
+		if cfg.SelectedRemote != "s3" || !reflect.DeepEqual(cfg.Replicas, []string{"sftp"}) {
+			t.Errorf("unexpected remote %v and replicas %v", cfg.SelectedRemote, cfg.Replicas)
+		}
+		if cfg.ChangeDetection != ChangeDetectionMTime || cfg.Retention.KeepLast != 7 {
+			t.Errorf("unexpected change detection %v and retention %+v", cfg.ChangeDetection, cfg.Retention)
+		}
+	})
+
+	t.Run("should use the values of the profile", func(t *testing.T) {
+		cfg, err := conf.withProfile("code")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Database != "code-backup.db" || !reflect.DeepEqual(cfg.IgnoredPatterns, []string{"/node_modules"}) {
+			t.Errorf("unexpected database %v and patterns %v", cfg.Database, cfg.IgnoredPatterns)
+		}
+		// An empty list of replicas disables the top level ones
+		if cfg.SelectedRemote != "local" || len(cfg.Replicas) != 0 {
+			t.Errorf("unexpected remote %v and replicas %v", cfg.SelectedRemote, cfg.Replicas)
+		}
+		if cfg.ChangeDetection != ChangeDetectionHash || cfg.Retention.KeepLast != 3 {
+			t.Errorf("unexpected change detection %v and retention %+v", cfg.ChangeDetection, cfg.Retention)
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
+)
+
+const (
+	defaultDatabaseCopies = 5
+	copiesIndexSuffix     = ".copies"
+)
+
+// databaseCopy is a timestamped copy of the database in the remote, used if the database is corrupted
+type databaseCopy struct {
+	Key       string    `json:"key"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// load fetches the database and checks its integrity. A database that cannot be downloaded or is corrupted is
+// replaced by its newest valid copy. It only starts with an empty database if the remote has never stored one,
+// or if NewDatabase is set
+func (c *SQLiteChecker) load(ctx context.Context) error {
+	c.syncedSHA256 = ""
+	err := c.fetch(ctx)
+	if err == nil {
+		err = checkIntegrity(c.cfg.Path)
+		if err == nil {
+			c.syncedSHA256, _, err = hashFile(c.cfg.Path)
+			return err
+		}
+		err = fmt.Errorf("the database is corrupted: %w", err)
+	}
+
+	copies, copiesErr := c.getCopies(ctx)
+	if isNotFound(err) && isNotFound(copiesErr) {
+		fmt.Printf("No existing database found: %v\n", err)
+		return nil
+	}
+
+	fmt.Printf("Error loading database: %v\n", err)
+	if copiesErr != nil {
+		fmt.Printf("Error reading the copies of the database: %v\n", copiesErr)
+	}
+	for _, dbCopy := range copies {
+		copyErr := c.repository.Download(ctx, dbCopy.Key, c.cfg.Path)
+		if copyErr == nil {
+			copyErr = checkIntegrity(c.cfg.Path)
+		}
+		if copyErr != nil {
+			fmt.Printf("Error loading the copy of the database from %v: %v\n", dbCopy.CreatedAt.Format(defaultDateLayout), copyErr)
+			continue
+		}
+		// syncedSHA256 is empty, so the copy replaces the database in the remote when it is uploaded
+		fmt.Printf("Using the copy of the database from %v\n", dbCopy.CreatedAt.Format(defaultDateLayout))
+		return nil
+	}
+
+	removeErr := os.Remove(c.cfg.Path)
+	if removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+		return fmt.Errorf("error removing database: %w", removeErr)
+	}
+	if c.cfg.NewDatabase {
+		fmt.Println("Starting with an empty database, every file will be uploaded again")
+		return nil
+	}
+	return fmt.Errorf("no valid copy of the database found, run it with --new-database to start with an empty one "+
+		"and upload every file again: %w", err)
+}
+
+// copyDatabase uploads a timestamped copy of the database and deletes the oldest ones beyond the configured number
+func (c *SQLiteChecker) copyDatabase(ctx context.Context, path string) error {
+	copies, err := c.getCopies(ctx)
+	if err != nil && !isNotFound(err) {
+		// The previous copies are left in the remote, but the database can still be copied
+		fmt.Printf("Error reading the copies of the database: %v\n", err)
+	}
+
+	now := time.Now().UTC()
+	dbCopy := databaseCopy{Key: c.cfg.Key + "." + now.Format(snapshotIDLayout), CreatedAt: now}
+	err = c.repository.PutEditable(ctx, path, dbCopy.Key)
+	if isReplicationError(err) {
+		fmt.Printf("Error copying database: %v\n", err)
+	} else if err != nil {
+		return fmt.Errorf("error copying database: %w", err)
+	}
+
+	// A copy made in the same second replaces the previous one
+	copies = slices.DeleteFunc(copies, func(old databaseCopy) bool { return old.Key == dbCopy.Key })
+	copies = append([]databaseCopy{dbCopy}, copies...)
+	var expired []databaseCopy
+	if len(copies) > c.cfg.Copies {
+		expired = copies[c.cfg.Copies:]
+		copies = copies[:c.cfg.Copies]
+	}
+	err = c.putCopies(ctx, copies)
+	if err != nil {
+		return err
+	}
+
+	for _, old := range expired {
+		err := c.repository.Delete(ctx, old.Key)
+		if err != nil {
+			fmt.Printf("Error deleting the copy of the database %v: %v\n", old.Key, err)
+		}
+	}
+	return nil
+}
+
+// getCopies returns the copies of the database, the newest first
+func (c *SQLiteChecker) getCopies(ctx context.Context) ([]databaseCopy, error) {
+	content, err := c.repository.Get(ctx, c.cfg.Key+copiesIndexSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var copies []databaseCopy
+	err = json.Unmarshal([]byte(content), &copies)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %v: %w", c.cfg.Key+copiesIndexSuffix, err)
+	}
+	return copies, nil
+}
+
+func (c *SQLiteChecker) putCopies(ctx context.Context, copies []databaseCopy) error {
+	content, err := json.Marshal(copies)
+	if err != nil {
+		return err
+	}
+	index, err := os.CreateTemp("", "glacier-backup-copies-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(index.Name())
+	_, err = index.Write(content)
+	if closeErr := index.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = c.repository.PutEditable(ctx, index.Name(), c.cfg.Key+copiesIndexSuffix)
+	if isReplicationError(err) {
+		fmt.Printf("Error uploading the copies of the database: %v\n", err)
+	} else if err != nil {
+		return fmt.Errorf("error uploading the copies of the database: %w", err)
+	}
+	return nil
+}
+
+// checkIntegrity returns an error if the file is not a valid SQLite database with the files table
+func checkIntegrity(path string) error {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	err = db.QueryRow("PRAGMA integrity_check").Scan(&result)
+	if err != nil {
+		return err
+	}
+	if result != "ok" {
+		return errors.New(result)
+	}
+
+	var tables int
+	err = db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'files'").Scan(&tables)
+	if err != nil {
+		return err
+	}
+	if tables == 0 {
+		return errors.New("the files table does not exist")
+	}
+	return nil
+}
+
+// isNotFound returns true if the object does not exist. The local remote returns the errors of the file system
+func isNotFound(err error) bool {
+	var notFound FileNotFoundError
+	return errors.As(err, &notFound) || errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,236 @@
+package backup_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+// copyEntry is an entry of the index of the copies of the database
+type copyEntry struct {
+	Key       string    `json:"key"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func newCopiesTestChecker(dir string, repo backup.RemoteFilesRepository, copies int, newDatabase bool) *backup.SQLiteChecker {
+	return backup.NewSQLiteChecker(backup.SqliteConfig{
+		Path:        filepath.Join(dir, "backup.db"),
+		Key:         "backup.db",
+		Copies:      copies,
+		NewDatabase: newDatabase,
+	}, repo)
+}
+
+// addFiles opens the database stored in the remote, adds the files and uploads it
+func addFiles(t *testing.T, dir string, repo backup.RemoteFilesRepository, paths ...string) {
+	t.Helper()
+	ctx := context.Background()
+	checker := newCopiesTestChecker(dir, repo, 5, false)
+	err := checker.Open(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		checker.Add(backup.FileRecord{Path: path, UploadedAt: time.Now().UTC(), SizeBytes: 1})
+	}
+	err = checker.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func copyFile(t *testing.T, src string, dst string) {
+	t.Helper()
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(dst, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeIndex(t *testing.T, remotePath string, entries []copyEntry) {
+	t.Helper()
+	content, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(remotePath, "backup.db.copies"), content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readIndex(t *testing.T, remotePath string) []copyEntry {
+	t.Helper()
+	content, err := ioutil.ReadFile(filepath.Join(remotePath, "backup.db.copies"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []copyEntry
+	err = json.Unmarshal(content, &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func corrupt(t *testing.T, path string) {
+	t.Helper()
+	err := ioutil.WriteFile(path, []byte(strings.Repeat("not a database ", 100)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func filePaths(files map[string]backup.FileRecord) []string {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestSQLiteChecker_Open_copies(t *testing.T) {
+	ctx := context.Background()
+	day := func(d int) time.Time { return time.Date(2024, time.January, d, 0, 0, 0, 0, time.UTC) }
+	entry := func(d int) copyEntry {
+		return copyEntry{Key: "backup.db." + day(d).Format("20060102T150405Z"), CreatedAt: day(d)}
+	}
+
+	// setup stores a database with /a copied on the 1st, and one with /a and /b copied on the 2nd
+	setup := func(t *testing.T) (string, string, backup.RemoteFilesRepository) {
+		tmpDir, err := ioutil.TempDir("", "glacier-copies-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(tmpDir) })
+		remotePath := filepath.Join(tmpDir, "remote")
+		repo := newLocalRepository(t, remotePath)
+
+		addFiles(t, filepath.Join(tmpDir, "run"), repo, "/a")
+		copyFile(t, filepath.Join(remotePath, "backup.db"), filepath.Join(remotePath, entry(1).Key))
+		addFiles(t, filepath.Join(tmpDir, "run"), repo, "/b")
+		copyFile(t, filepath.Join(remotePath, "backup.db"), filepath.Join(remotePath, entry(2).Key))
+		return tmpDir, remotePath, repo
+	}
+
+	t.Run("should use the newest valid copy of a corrupted database", func(t *testing.T) {
+		tmpDir, remotePath, repo := setup(t)
+		corrupt(t, filepath.Join(remotePath, "backup.db"))
+		// The copy of the 4th is missing and the one of the 3rd is corrupted too
+		corrupt(t, filepath.Join(remotePath, entry(3).Key))
+		writeIndex(t, remotePath, []copyEntry{entry(4), entry(3), entry(2), entry(1)})
+
+		checker := newCopiesTestChecker(filepath.Join(tmpDir, "restored"), repo, 5, false)
+		err := checker.Open(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paths := filePaths(checker.GetFiles()); !reflect.DeepEqual(paths, []string{"/a", "/b"}) {
+			t.Errorf("got files %v, want the ones of the copy of the 2nd", paths)
+		}
+		err = checker.Close(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The copy replaces the corrupted database in the remote
+		checker = newCopiesTestChecker(filepath.Join(tmpDir, "next"), repo, 5, false)
+		err = checker.Open(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer checker.Close(ctx)
+		if paths := filePaths(checker.GetFiles()); !reflect.DeepEqual(paths, []string{"/a", "/b"}) {
+			t.Errorf("got files %v after uploading the copy", paths)
+		}
+	})
+
+	t.Run("should not start with an empty database when every copy is corrupted", func(t *testing.T) {
+		tmpDir, remotePath, repo := setup(t)
+		corrupt(t, filepath.Join(remotePath, "backup.db"))
+		corrupt(t, filepath.Join(remotePath, entry(1).Key))
+		corrupt(t, filepath.Join(remotePath, entry(2).Key))
+		writeIndex(t, remotePath, []copyEntry{entry(2), entry(1)})
+
+		checker := newCopiesTestChecker(filepath.Join(tmpDir, "restored"), repo, 5, false)
+		err := checker.Open(ctx)
+		if err == nil || !strings.Contains(err.Error(), "--new-database") {
+			t.Fatalf("got error %v, want no valid copy", err)
+		}
+		if _, err := os.Stat(filepath.Join(tmpDir, "restored", "backup.db")); !os.IsNotExist(err) {
+			t.Errorf("the corrupted database has been kept: %v", err)
+		}
+
+		checker = newCopiesTestChecker(filepath.Join(tmpDir, "restored"), repo, 5, true)
+		err = checker.Open(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer checker.Close(ctx)
+		if files := checker.GetFiles(); len(files) != 0 {
+			t.Errorf("unexpected files %v in the new database", filePaths(files))
+		}
+	})
+
+	t.Run("should start with an empty database if the remote has never stored one", func(t *testing.T) {
+		tmpDir, err := ioutil.TempDir("", "glacier-copies-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		checker := newCopiesTestChecker(filepath.Join(tmpDir, "run"), newLocalRepository(t, filepath.Join(tmpDir, "remote")), 5, false)
+		err = checker.Open(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer checker.Close(ctx)
+		if files := checker.GetFiles(); len(files) != 0 {
+			t.Errorf("unexpected files %v", filePaths(files))
+		}
+	})
+
+	t.Run("should keep the given number of copies and delete the older ones", func(t *testing.T) {
+		tmpDir, remotePath, repo := setup(t)
+		writeIndex(t, remotePath, []copyEntry{entry(2), entry(1)})
+
+		checker := newCopiesTestChecker(filepath.Join(tmpDir, "run"), repo, 2, false)
+		err := checker.Open(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checker.Add(backup.FileRecord{Path: "/c", UploadedAt: time.Now().UTC(), SizeBytes: 1})
+		err = checker.Close(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		index := readIndex(t, remotePath)
+		if len(index) != 2 || index[1] != entry(2) || !strings.HasPrefix(index[0].Key, "backup.db.") || index[0] == entry(2) {
+			t.Fatalf("unexpected copies %+v", index)
+		}
+		if _, err := os.Stat(filepath.Join(remotePath, index[0].Key)); err != nil {
+			t.Errorf("the new copy has not been uploaded: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(remotePath, entry(2).Key)); err != nil {
+			t.Errorf("the copy of the 2nd has been deleted: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(remotePath, entry(1).Key)); !os.IsNotExist(err) {
+			t.Errorf("the expired copy of the 1st has not been deleted: %v", err)
+		}
+	})
+}
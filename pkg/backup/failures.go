@@ -0,0 +1,212 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+const defaultRetries = 3
+
+// The delays between the retries are variables so the tests do not wait
+var (
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 30 * time.Second
+)
+
+// Failure is a file that could not be uploaded, it is retried first in the next backup
+type Failure struct {
+	Path  string
+	Error string
+	// Attempts is the number of uploads that failed, across all the runs
+	Attempts int
+	FailedAt time.Time
+}
+
+// retry calls upload until it succeeds, fails with a permanent error or has been retried the given times.
+// It returns the number of attempts
+func retry(ctx context.Context, retries int, name string, upload func() error) (int, error) {
+	attempts := 0
+	for {
+		attempts++
+		err := upload()
+		if err == nil || attempts > retries || !isTransient(ctx, err) {
+			return attempts, err
+		}
+
+		delay := retryDelay(attempts)
+		fmt.Printf("Error uploading %v, retrying in %v: %v\n", name, delay.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return attempts, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryDelay doubles the delay after each attempt, with a random jitter so the workers do not retry at once
+func retryDelay(attempts int) time.Duration {
+	delay := retryMaxDelay
+	if attempts < 16 {
+		delay = min(retryBaseDelay<<(attempts-1), retryMaxDelay)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// throttlingCodes are the error codes of the S3 compatible stores asking to slow down the requests
+var throttlingCodes = map[string]bool{
+	"Throttling":           true,
+	"ThrottlingException":  true,
+	"SlowDown":             true,
+	"RequestLimitExceeded": true,
+	"TooManyRequests":      true,
+	"RequestTimeout":       true,
+	"InternalError":        true,
+	"ServiceUnavailable":   true,
+}
+
+// isTransient returns true for the errors that uploading again may fix: the ones the SDKs mark as retryable,
+// throttling, server errors and network errors. Any other error, like a denied access, a missing bucket or an
+// invalid storage class, fails at once. The file already in the primary remote is not uploaded again either
+func isTransient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || isReplicationError(err) {
+		return false
+	}
+
+	var retryable interface{ RetryableError() bool }
+	if errors.As(err, &retryable) {
+		return retryable.RetryableError()
+	}
+	var coded interface{ ErrorCode() string }
+	if errors.As(err, &coded) && throttlingCodes[coded.ErrorCode()] {
+		return true
+	}
+	// S3 (smithy) and GCS (googleapi) responses
+	var response interface{ HTTPStatusCode() int }
+	if errors.As(err, &response) {
+		return isTransientStatus(response.HTTPStatusCode())
+	}
+	var apiResponse interface{ HTTPCode() int }
+	if errors.As(err, &apiResponse) {
+		return isTransientStatus(apiResponse.HTTPCode())
+	}
+	return isNetworkError(err)
+}
+
+func isTransientStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusRequestTimeout || status >= 500
+}
+
+// isNetworkError returns true if the request did not reach the remote or the connection was lost
+func isNetworkError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	var connErr interface{ ConnectionError() bool }
+	if errors.As(err, &connErr) && connErr.ConnectionError() {
+		return true
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
+
+// AddFailure records that the file could not be uploaded after the given attempts
+func (c *SQLiteChecker) AddFailure(path string, uploadErr error, attempts int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.db.Exec(`
+		INSERT INTO failures (path, error, attempts, failed_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET error = excluded.error, attempts = attempts + excluded.attempts, failed_at = excluded.failed_at
+	`, path, uploadErr.Error(), attempts, time.Now().UTC().Format(defaultDateLayout))
+	if err != nil {
+		fmt.Printf("Error adding failure to database: %v\n", err)
+	}
+}
+
+// Requeue forgets the last upload of the file, its versions are kept
+func (c *SQLiteChecker) Requeue(path string, reason error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.inTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM files WHERE path = ?", path)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM bundle_files WHERE path = ?", path)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM replicas WHERE path = ?", path)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO failures (path, error, attempts, failed_at) VALUES (?, ?, 0, ?)
+			ON CONFLICT (path) DO UPDATE SET error = excluded.error, failed_at = excluded.failed_at
+		`, path, reason.Error(), time.Now().UTC().Format(defaultDateLayout))
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Error requeuing file: %v\n", err)
+	}
+}
+
+func (c *SQLiteChecker) RemoveFailure(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.db.Exec("DELETE FROM failures WHERE path = ?", path)
+	if err != nil {
+		fmt.Printf("Error removing failure from database: %v\n", err)
+	}
+}
+
+// GetFailures returns the files that could not be uploaded, sorted by path
+func (c *SQLiteChecker) GetFailures() []Failure {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var failures []Failure
+	rows, err := c.db.Query("SELECT path, error, attempts, failed_at FROM failures ORDER BY path")
+	if err != nil {
+		fmt.Printf("Error getting failures: %v\n", err)
+		return failures
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var failure Failure
+		var timeStr string
+		err := rows.Scan(&failure.Path, &failure.Error, &failure.Attempts, &timeStr)
+		if err != nil {
+			fmt.Printf("Error scanning row: %v\n", err)
+			continue
+		}
+		failure.FailedAt, err = c.parseTime(timeStr)
+		if err != nil {
+			fmt.Printf("Error parsing time: %v\n", err)
+			continue
+		}
+		failures = append(failures, failure)
+	}
+
+	return failures
+}
@@ -0,0 +1,255 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"go.uber.org/mock/gomock"
+)
+
+// s3Error returns an error like the ones of the S3 client for the given response
+func s3Error(status int, code string) error {
+	return &smithy.OperationError{
+		ServiceID:     "S3",
+		OperationName: "PutObject",
+		Err: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+			Err:      &smithy.GenericAPIError{Code: code, Message: code},
+		},
+	}
+}
+
+// retryableError is an error the SDKs mark as retryable or not
+type retryableError bool
+
+func (e retryableError) Error() string        { return fmt.Sprintf("retryable %v", bool(e)) }
+func (e retryableError) RetryableError() bool { return bool(e) }
+
+// noRetryDelay makes the retries of the test immediate
+func noRetryDelay(t *testing.T) {
+	base, max := retryBaseDelay, retryMaxDelay
+	retryBaseDelay, retryMaxDelay = time.Millisecond, time.Millisecond
+	t.Cleanup(func() {
+		retryBaseDelay, retryMaxDelay = base, max
+	})
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "should retry the errors marked as retryable", err: fmt.Errorf("put: %w", retryableError(true)), want: true},
+		{name: "should not retry the errors marked as not retryable", err: retryableError(false), want: false},
+		{name: "should retry the throttling", err: s3Error(http.StatusServiceUnavailable, "SlowDown"), want: true},
+		{name: "should retry the throttling codes of any status", err: s3Error(http.StatusBadRequest, "RequestLimitExceeded"), want: true},
+		{name: "should retry the server errors", err: s3Error(http.StatusInternalServerError, "InternalError"), want: true},
+		{name: "should retry too many requests", err: s3Error(http.StatusTooManyRequests, "Unknown"), want: true},
+		{name: "should not retry a denied access", err: s3Error(http.StatusForbidden, "AccessDenied"), want: false},
+		{name: "should not retry a missing bucket", err: s3Error(http.StatusNotFound, "NoSuchBucket"), want: false},
+		{name: "should not retry an invalid storage class", err: s3Error(http.StatusBadRequest, "InvalidStorageClass"), want: false},
+		{name: "should not retry an invalid KMS key", err: s3Error(http.StatusBadRequest, "KMS.NotFoundException"), want: false},
+		{name: "should retry a reset connection", err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, want: true},
+		{name: "should retry a refused connection", err: fmt.Errorf("dial: %w", syscall.ECONNREFUSED), want: true},
+		{name: "should retry a truncated response", err: fmt.Errorf("read body: %w", io.ErrUnexpectedEOF), want: true},
+		{name: "should retry a temporary DNS failure", err: &net.DNSError{Err: "timeout", Name: "s3.test", IsTimeout: true}, want: true},
+		{name: "should not retry an unknown host", err: &net.DNSError{Err: "no such host", Name: "s3.test", IsNotFound: true}, want: false},
+		{name: "should not retry a missing local file", err: &fs.PathError{Op: "open", Path: "/photos/a.jpg", Err: fs.ErrNotExist}, want: false},
+		{name: "should not retry an unreadable local file", err: &fs.PathError{Op: "open", Path: "/photos/a.jpg", Err: fs.ErrPermission}, want: false},
+		{name: "should not retry an unknown error", err: errors.New("invalid configuration"), want: false},
+		{name: "should not retry a replication error", err: &ReplicationError{Failed: map[string]error{"b2": io.ErrUnexpectedEOF}}, want: false},
+		{name: "should not retry a canceled run", err: fmt.Errorf("put: %w", context.Canceled), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := isTransient(context.Background(), tt.err)
+			if got != tt.want {
+				t.Errorf("isTransient(%v): got %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("should not retry when the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if isTransient(ctx, syscall.ECONNRESET) {
+			t.Errorf("transient with a canceled context")
+		}
+	})
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts := 1; attempts <= 20; attempts++ {
+		max := retryMaxDelay
+		if attempts < 10 {
+			max = min(retryBaseDelay<<(attempts-1), retryMaxDelay)
+		}
+		for i := 0; i < 20; i++ {
+			delay := retryDelay(attempts)
+			if delay < max/2 || delay > max {
+				t.Fatalf("delay %v after %v attempts, want between %v and %v", delay, attempts, max/2, max)
+			}
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	noRetryDelay(t)
+	transient := s3Error(http.StatusServiceUnavailable, "SlowDown")
+
+	t.Run("should not retry a successful upload", func(t *testing.T) {
+		attempts, err := retry(context.Background(), 3, "a.jpg", func() error { return nil })
+		if err != nil || attempts != 1 {
+			t.Errorf("got %v attempts and error %v, want 1 and no error", attempts, err)
+		}
+	})
+
+	t.Run("should retry the transient errors until the upload succeeds", func(t *testing.T) {
+		calls := 0
+		attempts, err := retry(context.Background(), 3, "a.jpg", func() error {
+			calls++
+			if calls < 3 {
+				return transient
+			}
+			return nil
+		})
+		if err != nil || attempts != 3 {
+			t.Errorf("got %v attempts and error %v, want 3 and no error", attempts, err)
+		}
+	})
+
+	t.Run("should stop after the given retries", func(t *testing.T) {
+		attempts, err := retry(context.Background(), 3, "a.jpg", func() error { return transient })
+		if !errors.Is(err, transient) || attempts != 4 {
+			t.Errorf("got %v attempts and error %v, want 4 and %v", attempts, err, transient)
+		}
+	})
+
+	t.Run("should fail at once with a permanent error", func(t *testing.T) {
+		denied := s3Error(http.StatusForbidden, "AccessDenied")
+		attempts, err := retry(context.Background(), 3, "a.jpg", func() error { return denied })
+		if !errors.Is(err, denied) || attempts != 1 {
+			t.Errorf("got %v attempts and error %v, want 1 and %v", attempts, err, denied)
+		}
+	})
+
+	t.Run("should stop waiting when the context is canceled", func(t *testing.T) {
+		retryBaseDelay, retryMaxDelay = time.Hour, time.Hour
+		defer func() { retryBaseDelay, retryMaxDelay = time.Millisecond, time.Millisecond }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		attempts, err := retry(ctx, 3, "a.jpg", func() error { return transient })
+		if !errors.Is(err, transient) || attempts != 1 {
+			t.Errorf("got %v attempts and error %v, want 1 and %v", attempts, err, transient)
+		}
+	})
+}
+
+func TestWorker_run_failures(t *testing.T) {
+	noRetryDelay(t)
+	tmpDir, err := ioutil.TempDir("", "glacier-failures-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "a.jpg")
+	err = ioutil.WriteFile(path, []byte("photo"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := LocalFile{Path: path, ModTime: time.Now(), SizeBytes: 5}
+
+	// upload runs a worker with the file and returns the errors it sent
+	upload := func(repo RemoteFilesRepository, checker ExistentFilesChecker) []error {
+		var wg sync.WaitGroup
+		paths := make(chan LocalFile, 1)
+		errChan := make(chan error, 10)
+		paths <- file
+		close(paths)
+		newWorker(&wg, repo, checker, nil, ChangeDetectionMTime, 2, "", nil).run(context.Background(), paths, errChan)
+		wg.Wait()
+		close(errChan)
+
+		var errs []error
+		for err := range errChan {
+			errs = append(errs, err)
+		}
+		return errs
+	}
+
+	t.Run("should record the failure without adding the file", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		denied := s3Error(http.StatusForbidden, "AccessDenied")
+		mockRepo := NewMockRemoteFilesRepository(ctrl)
+		mockChecker := NewMockExistentFilesChecker(ctrl)
+		mockChecker.EXPECT().Exists(gomock.Any()).Return(false)
+		mockRepo.EXPECT().PutGlacier(gomock.Any(), path, path).Return(denied).Times(1)
+		mockChecker.EXPECT().AddFailure(path, gomock.Any(), 1)
+		mockChecker.EXPECT().Add(gomock.Any()).Times(0)
+
+		errs := upload(mockRepo, mockChecker)
+		if len(errs) != 1 || !errors.Is(errs[0], denied) {
+			t.Errorf("unexpected errors %v", errs)
+		}
+	})
+
+	t.Run("should record the failure after retrying the transient errors", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		throttled := s3Error(http.StatusServiceUnavailable, "SlowDown")
+		mockRepo := NewMockRemoteFilesRepository(ctrl)
+		mockChecker := NewMockExistentFilesChecker(ctrl)
+		mockChecker.EXPECT().Exists(gomock.Any()).Return(false)
+		mockRepo.EXPECT().PutGlacier(gomock.Any(), path, path).Return(throttled).Times(3)
+		mockChecker.EXPECT().AddFailure(path, gomock.Any(), 3)
+		mockChecker.EXPECT().Add(gomock.Any()).Times(0)
+
+		errs := upload(mockRepo, mockChecker)
+		if len(errs) != 1 || !errors.Is(errs[0], throttled) {
+			t.Errorf("unexpected errors %v", errs)
+		}
+	})
+
+	t.Run("should add the file uploaded after a transient error", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockRepo := NewMockRemoteFilesRepository(ctrl)
+		mockChecker := NewMockExistentFilesChecker(ctrl)
+		mockChecker.EXPECT().Exists(gomock.Any()).Return(false)
+		gomock.InOrder(
+			mockRepo.EXPECT().PutGlacier(gomock.Any(), path, path).Return(syscall.ECONNRESET),
+			mockRepo.EXPECT().PutGlacier(gomock.Any(), path, path).Return(nil),
+		)
+		mockChecker.EXPECT().Add(gomock.Any()).Do(func(record FileRecord) {
+			if record.Path != path || record.RemoteKey != path || record.SHA256 == "" {
+				t.Errorf("unexpected record %+v", record)
+			}
+		})
+
+		errs := upload(mockRepo, mockChecker)
+		if len(errs) != 0 {
+			t.Errorf("unexpected errors %v", errs)
+		}
+	})
+}
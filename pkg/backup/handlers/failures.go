@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+type failuresLister struct {
+	checker backup.ExistentFilesChecker
+}
+
+// NewFailuresLister reports the files that could not be uploaded, which the next backup retries first
+func NewFailuresLister(checker backup.ExistentFilesChecker) backup.Application {
+	return failuresLister{checker: checker}
+}
+
+func (l failuresLister) Run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := l.checker.Open(ctx)
+	if err != nil {
+		fmt.Printf("Error opening: %v\n", err.Error())
+		return
+	}
+	defer func() {
+		e := l.checker.Close(ctx)
+		if e != nil {
+			fmt.Println(e.Error())
+		}
+	}()
+
+	failures := l.checker.GetFailures()
+	for _, failure := range failures {
+		fmt.Printf("%v  attempts: %d  last failure: %v\n    %v\n", failure.Path, failure.Attempts,
+			failure.FailedAt.Format("2006-01-02 15:04"), failure.Error)
+	}
+	fmt.Printf("Failed files: %d\n", len(failures))
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"go.uber.org/mock/gomock"
+)
+
+func TestFailuresLister_Run(t *testing.T) {
+	t.Run("should list the files that could not be uploaded", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+
+		lister := NewFailuresLister(mockChecker)
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetFailures().Return([]backup.Failure{{
+			Path:     "/photos/beach.jpg",
+			Error:    "connection reset by peer",
+			Attempts: 4,
+			FailedAt: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		}})
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		lister.Run()
+	})
+
+	t.Run("should not panic if open fails", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+
+		lister := NewFailuresLister(mockChecker)
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(fmt.Errorf("open error"))
+
+		lister.Run()
+	})
+}
@@ -39,7 +39,7 @@ func (h handler) Run() {
 	for {
 		select {
 		case t := <-tick.C:
-			fmt.Printf("Processing. Time: %v\n", t.Format("2006-02-01 15:04"))
+			fmt.Printf("Processing. Time: %v\n", t.Format("2006-01-02 15:04"))
 			fmt.Printf(processingFormat, h.checker.Uploaded(), h.checker.Ignored())
 		case <-shutdown:
 			fmt.Println("Stopping program")
@@ -55,7 +55,7 @@ func (h handler) Run() {
 			return
 		case err := <-errChan:
 			if err != nil {
-				fmt.Printf("Error processing files: %v", err)
+				fmt.Printf("Error processing files: %v\n", err)
 			}
 		}
 	}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+type PruneConfig struct {
+	Retention backup.RetentionConfig
+	// Force deletes the objects younger than the minimum storage duration, paying the early deletion charge
+	Force bool
+	// DryRun reports the objects that would be deleted without deleting them
+	DryRun bool
+}
+
+type pruner struct {
+	checker backup.ExistentFilesChecker
+	repo    backup.RemoteFilesRepository
+	cfg     PruneConfig
+	now     time.Time
+}
+
+func NewPruner(checker backup.ExistentFilesChecker, repo backup.RemoteFilesRepository, cfg PruneConfig) backup.Application {
+	return pruner{checker: checker, repo: repo, cfg: cfg, now: time.Now()}
+}
+
+// pruneStats counts the deleted objects and the ones skipped because of the minimum storage duration
+type pruneStats struct {
+	versions      int
+	versionsBytes int64
+	bundles       int
+	skipped       int
+	// charged is the early deletion charge of the deleted objects, skippedCharge the one of the skipped objects
+	charged       float64
+	skippedCharge float64
+}
+
+func (p pruner) Run() {
+	if !p.cfg.Retention.Enabled() {
+		fmt.Println("No retention rules configured: set keepLast, keepDaily or keepMonthly in retention")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := p.checker.Open(ctx)
+	if err != nil {
+		fmt.Printf("Error opening: %v\n", err.Error())
+		return
+	}
+	defer func() {
+		e := p.checker.Close(ctx)
+		if e != nil {
+			fmt.Println(e.Error())
+		}
+	}()
+
+	snapshots := p.checker.Snapshots()
+	kept := p.cfg.Retention.KeptSnapshots(snapshots)
+
+	stats := pruneStats{}
+	removed := make(map[string]int)
+	for _, version := range backup.PrunableVersions(p.checker.GetAllVersions(), kept) {
+		// Packed versions are deleted with their bundle once it does not contain any other version
+		if version.BundleKey == "" {
+			if !p.deleteObject(ctx, version.Key(), version.SizeBytes, version.UploadedAt, &stats) {
+				continue
+			}
+		}
+		p.checker.RemoveVersion(version.Path, version.SnapshotID)
+		removed[version.SnapshotID]++
+		stats.versions++
+		stats.versionsBytes += version.SizeBytes
+	}
+
+	for _, key := range p.checker.OrphanBundles() {
+		createdAt, ok := backup.BundleCreatedAt(key)
+		if !ok {
+			fmt.Printf("Skipping bundle with unknown creation time: %v\n", key)
+			continue
+		}
+		info, err := p.repo.Head(ctx, key)
+		if err != nil {
+			fmt.Printf("Error getting bundle %v: %v\n", key, err)
+			continue
+		}
+		if !p.deleteObject(ctx, key, info.Size, createdAt, &stats) {
+			continue
+		}
+		p.checker.RemoveBundle(key)
+		stats.bundles++
+	}
+
+	for _, snapshot := range snapshots {
+		if !kept[snapshot.ID] && removed[snapshot.ID] == snapshot.Files {
+			p.checker.RemoveSnapshot(snapshot.ID)
+		}
+	}
+
+	if p.cfg.DryRun {
+		fmt.Println("Dry run, nothing has been deleted")
+	}
+	fmt.Printf("Kept snapshots: %d of %d\n", len(kept), len(snapshots))
+	fmt.Printf("Pruned versions: %d (%d MB)\n", stats.versions, stats.versionsBytes/1000_000)
+	fmt.Printf("Deleted bundles: %d\n", stats.bundles)
+	if stats.charged > 0 {
+		fmt.Printf("Estimated early deletion charge: $%.2f\n", stats.charged)
+	}
+	if stats.skipped > 0 {
+		fmt.Printf("Skipped objects younger than the minimum storage duration: %d. Deleting them with --force would cost $%.2f\n",
+			stats.skipped, stats.skippedCharge)
+	}
+}
+
+// deleteObject deletes the object unless it is younger than the minimum storage duration and pruning is not forced.
+// It returns true if the object has been deleted
+func (p pruner) deleteObject(ctx context.Context, key string, sizeBytes int64, uploadedAt time.Time, stats *pruneStats) bool {
+	policy, _ := p.repo.(backup.StoragePolicy)
+	remainingDays := p.remainingStorageDays(policy, uploadedAt)
+	charge := 0.0
+	if remainingDays > 0 {
+		// Deleting before the minimum is charged as the storage of the remaining days
+		charge = float64(sizeBytes) / (1024 * 1024 * 1024) * policy.PricePerGBMonth() * remainingDays / 30
+		if !p.cfg.Force {
+			stats.skipped++
+			stats.skippedCharge += charge
+			return false
+		}
+	}
+
+	if p.cfg.DryRun {
+		fmt.Printf("Would delete: %v (%d bytes)\n", key, sizeBytes)
+	} else {
+		err := p.repo.Delete(ctx, key)
+		if err != nil {
+			fmt.Printf("Error deleting %v: %v\n", key, err.Error())
+			return false
+		}
+	}
+	stats.charged += charge
+	return true
+}
+
+// remainingStorageDays returns the days left until the object reaches the minimum storage duration of the repository
+func (p pruner) remainingStorageDays(policy backup.StoragePolicy, uploadedAt time.Time) float64 {
+	if policy == nil {
+		return 0
+	}
+	return float64(policy.MinStorageDays()) - p.now.Sub(uploadedAt).Hours()/24
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"go.uber.org/mock/gomock"
+)
+
+// deepArchiveRepository is a repository billing a minimum storage duration
+type deepArchiveRepository struct {
+	*backup.MockRemoteFilesRepository
+}
+
+func (r deepArchiveRepository) MinStorageDays() int {
+	return 180
+}
+
+func (r deepArchiveRepository) PricePerGBMonth() float64 {
+	return 0.00099
+}
+
+func TestPruner_Run(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2025, 1, d, 12, 0, 0, 0, time.UTC)
+	}
+	snapshots := []backup.Snapshot{
+		{ID: "20250101T120000Z", CreatedAt: day(1), Files: 3},
+		{ID: "20250102T120000Z", CreatedAt: day(2), Files: 0},
+		{ID: "20250103T120000Z", CreatedAt: day(3), Files: 1},
+		{ID: "20250104T120000Z", CreatedAt: day(4), Files: 1},
+	}
+
+	t.Run("should delete the versions not visible in the kept snapshots", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		bundleKey := "bundles/20250101T120000Z-0123456789abcdef.tar"
+		pruner := NewPruner(mockChecker, mockRepo, PruneConfig{Retention: backup.RetentionConfig{KeepLast: 1}})
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().Snapshots().Return(snapshots)
+		mockChecker.EXPECT().GetAllVersions().Return([]backup.FileRecord{
+			{Path: "/a", SnapshotID: "20250101T120000Z", RemoteKey: "/a@20250101T120000Z", UploadedAt: day(1)},
+			{Path: "/a", SnapshotID: "20250104T120000Z", RemoteKey: "/a@20250104T120000Z", UploadedAt: day(4)},
+			{Path: "/b", SnapshotID: "20250101T120000Z", RemoteKey: "/b@20250101T120000Z", UploadedAt: day(1)},
+			{Path: "/c", SnapshotID: "20250101T120000Z", BundleKey: bundleKey, UploadedAt: day(1)},
+			{Path: "/c", SnapshotID: "20250103T120000Z", RemoteKey: "/c@20250103T120000Z", UploadedAt: day(3)},
+		})
+
+		mockRepo.EXPECT().Delete(gomock.Any(), "/a@20250101T120000Z").Return(nil)
+		mockChecker.EXPECT().RemoveVersion("/a", "20250101T120000Z")
+		mockChecker.EXPECT().RemoveVersion("/c", "20250101T120000Z")
+
+		mockChecker.EXPECT().OrphanBundles().Return([]string{bundleKey})
+		mockRepo.EXPECT().Head(gomock.Any(), bundleKey).Return(backup.ObjectInfo{Size: 1024}, nil)
+		mockRepo.EXPECT().Delete(gomock.Any(), bundleKey).Return(nil)
+		mockChecker.EXPECT().RemoveBundle(bundleKey)
+
+		mockChecker.EXPECT().RemoveSnapshot("20250102T120000Z")
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		pruner.Run()
+	})
+
+	t.Run("should skip objects younger than the minimum storage duration unless forced", func(t *testing.T) {
+		for _, force := range []bool{false, true} {
+			ctrl := gomock.NewController(t)
+
+			mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+			mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+			pruner := NewPruner(mockChecker, deepArchiveRepository{mockRepo}, PruneConfig{
+				Retention: backup.RetentionConfig{KeepDaily: 1},
+				Force:     force,
+			})
+
+			recent := time.Now().Add(-24 * time.Hour)
+			mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+			mockChecker.EXPECT().Snapshots().Return(snapshots)
+			mockChecker.EXPECT().GetAllVersions().Return([]backup.FileRecord{
+				{Path: "/a", SnapshotID: "20250101T120000Z", RemoteKey: "/a@20250101T120000Z", UploadedAt: recent, SizeBytes: 1 << 30},
+				{Path: "/a", SnapshotID: "20250104T120000Z", RemoteKey: "/a@20250104T120000Z", UploadedAt: recent},
+			})
+			if force {
+				mockRepo.EXPECT().Delete(gomock.Any(), "/a@20250101T120000Z").Return(nil)
+				mockChecker.EXPECT().RemoveVersion("/a", "20250101T120000Z")
+			}
+			mockChecker.EXPECT().OrphanBundles().Return(nil)
+			mockChecker.EXPECT().RemoveSnapshot("20250102T120000Z")
+			mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+			pruner.Run()
+			ctrl.Finish()
+		}
+	})
+
+	t.Run("should do nothing without retention rules", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		pruner := NewPruner(mockChecker, mockRepo, PruneConfig{})
+
+		pruner.Run()
+	})
+
+	t.Run("should not panic if open fails", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		pruner := NewPruner(mockChecker, mockRepo, PruneConfig{Retention: backup.RetentionConfig{KeepLast: 1}})
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(fmt.Errorf("open error"))
+
+		pruner.Run()
+	})
+}
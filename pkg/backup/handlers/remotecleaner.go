@@ -2,8 +2,11 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"time"
 
 	"github.com/closmarfer/glacier-backup/pkg/backup"
 )
@@ -11,17 +14,24 @@ import (
 type remoteCleaner struct {
 	repo    backup.RemoteFilesRepository
 	checker backup.ExistentFilesChecker
+	cfg     backup.Config
 }
 
-func NewRemoteCleaner(checker backup.ExistentFilesChecker, repo backup.RemoteFilesRepository) backup.Application {
-	return remoteCleaner{checker: checker, repo: repo}
+func NewRemoteCleaner(checker backup.ExistentFilesChecker, repo backup.RemoteFilesRepository, cfg backup.Config) backup.Application {
+	return remoteCleaner{checker: checker, repo: repo, cfg: cfg}
 }
 
 func (c remoteCleaner) Run() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	err := c.checker.Open(ctx)
+	err := c.checkRoots()
+	if err != nil {
+		fmt.Printf("Not cleaning the remote: %v\n", err.Error())
+		return
+	}
+
+	err = c.checker.Open(ctx)
 	if err != nil {
 		fmt.Printf("Error opening: %v\n", err.Error())
 		return
@@ -29,23 +39,156 @@ func (c remoteCleaner) Run() {
 	defer func() {
 		e := c.checker.Close(ctx)
 		if e != nil {
-			fmt.Println(err.Error())
+			fmt.Println(e.Error())
 		}
 	}()
-	deletedFiles := 0
-	for path := range c.checker.GetFiles() {
+
+	// Missing files are moved to the trash, and deleted from the remote once they have been in it for the trash period
+	now := time.Now()
+	trash := c.checker.GetTrash()
+	kept := c.checker.GetKept()
+	tracked := 0
+	var missing, expired []backup.FileRecord
+	for path, file := range c.checker.GetFiles() {
+		// Files outside the configured paths may belong to another profile using the same remote
+		if !c.cfg.Contains(path) {
+			fmt.Printf("Skipping file outside the paths to backup: %v\n", path)
+			continue
+		}
+		tracked++
+		deletedAt, trashed := trash[path]
 		_, err := os.Stat(path)
 		if err == nil {
+			if trashed {
+				fmt.Printf("Removing from trash file found locally: %v\n", path)
+			}
+			if trashed || kept[path] {
+				c.checker.Untrash(path)
+			}
 			continue
 		}
-		err = c.repo.Delete(ctx, path)
-		if err != nil {
-			fmt.Printf("Error deleting file: %v\n", err.Error())
+		// Only files that certainly do not exist are deleted, a permission error does not mean the file is gone
+		if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("Skipping file that cannot be read: %v\n", err.Error())
+			continue
+		}
+		// Files taken out of the trash with --untrash are kept until they are restored
+		if kept[path] {
+			continue
+		}
+		if !trashed {
+			missing = append(missing, file)
+		} else if now.Sub(deletedAt) >= c.cfg.CleanRemote.TrashPeriod() {
+			expired = append(expired, file)
+		}
+	}
+
+	maxPercent := c.cfg.CleanRemote.MaxDeletePercentOrDefault()
+	if !c.cfg.CleanRemote.Force && len(missing)*100 > tracked*maxPercent {
+		fmt.Printf("Not cleaning the remote: %d of %d files are missing locally, more than the maximum of %d%%. "+
+			"Check that the paths to backup are mounted and run it again with --force to delete them\n",
+			len(missing), tracked, maxPercent)
+		return
+	}
+
+	for _, file := range missing {
+		if c.cfg.DryRun {
+			fmt.Printf("Would move to trash: %v\n", file.Path)
+		}
+		c.checker.Trash(file.Path, now)
+	}
+
+	// In a dry run the database changes are discarded, so they are still applied to find the orphan bundles
+	deletedFiles := 0
+	deletedBytes := int64(0)
+	for _, file := range expired {
+		size, ok := c.deleteVersions(ctx, file)
+		if !ok {
 			continue
 		}
-		c.checker.Remove(path)
+		c.checker.Remove(file.Path)
 		deletedFiles++
+		deletedBytes += size
 	}
 
+	deletedBundles := 0
+	for _, key := range c.checker.OrphanBundles() {
+		if c.cfg.DryRun {
+			info, err := c.repo.Head(ctx, key)
+			if err != nil {
+				fmt.Printf("Error getting bundle %v: %v\n", key, err.Error())
+			}
+			fmt.Printf("Would delete bundle: %v (%d bytes)\n", key, info.Size)
+			deletedBytes += info.Size
+		} else {
+			err = c.repo.Delete(ctx, key)
+			if err != nil {
+				fmt.Printf("Error deleting bundle: %v\n", err.Error())
+				continue
+			}
+		}
+		c.checker.RemoveBundle(key)
+		deletedBundles++
+	}
+
+	if c.cfg.DryRun {
+		fmt.Printf("Dry run, nothing has been deleted. Files to move to trash: %d, files to delete: %d, bundles to delete: %d (%d bytes)\n",
+			len(missing), deletedFiles, deletedBundles, deletedBytes)
+		return
+	}
+	fmt.Printf("Moved to trash: %d, they will be deleted from the remote after %v days\n",
+		len(missing), c.cfg.CleanRemote.TrashPeriod().Hours()/24)
 	fmt.Printf("Deleted files from remote repository: %d\n", deletedFiles)
+	fmt.Printf("Deleted bundles from remote repository: %d\n", deletedBundles)
+}
+
+// deleteVersions deletes every uploaded version of a deleted file. Packed versions are deleted with their
+// bundle once it does not contain any other file. It returns the size of the deleted versions
+func (c remoteCleaner) deleteVersions(ctx context.Context, file backup.FileRecord) (int64, bool) {
+	versions := c.checker.GetVersions(file.Path)
+	if len(versions) == 0 {
+		versions = []backup.FileRecord{file}
+	}
+
+	size := int64(0)
+	deleted := make(map[string]bool)
+	for _, version := range versions {
+		if version.BundleKey != "" || deleted[version.Key()] {
+			continue
+		}
+		deleted[version.Key()] = true
+		size += version.SizeBytes
+		if c.cfg.DryRun {
+			fmt.Printf("Would delete: %v (%d bytes)\n", version.Key(), version.SizeBytes)
+			continue
+		}
+		err := c.repo.Delete(ctx, version.Key())
+		if err != nil {
+			fmt.Printf("Error deleting file: %v\n", err.Error())
+			return 0, false
+		}
+	}
+	return size, true
+}
+
+// checkRoots fails if a path to backup does not exist or is empty. An unmounted volume would look like all its
+// files had been deleted
+func (c remoteCleaner) checkRoots() error {
+	for _, root := range c.cfg.PathsToBackup {
+		info, err := os.Stat(root)
+		if err != nil {
+			return fmt.Errorf("path to backup %v cannot be read: %w", root, err)
+		}
+		if !info.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			return fmt.Errorf("path to backup %v cannot be read: %w", root, err)
+		}
+		if len(entries) == 0 {
+			return fmt.Errorf("path to backup %v is empty, check that it is mounted", root)
+		}
+	}
+	return nil
 }
@@ -12,22 +12,45 @@ import (
 	"go.uber.org/mock/gomock"
 )
 
+// cleanAll allows deleting every backed up file
+var cleanAll = backup.CleanRemoteConfig{MaxDeletePercent: 100}
+
+// expiredTrash is the deletion time of the files in the trash for longer than the default trash period
+var expiredTrash = time.Now().Add(-31 * 24 * time.Hour)
+
+// newCleanerRoot creates a path to backup containing a file, so it does not look unmounted
+func newCleanerRoot(t *testing.T) string {
+	tmpDir, err := ioutil.TempDir("", "glacier-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(tmpDir)
+	})
+
+	err = ioutil.WriteFile(filepath.Join(tmpDir, "exists.txt"), []byte("content"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tmpDir
+}
+
 func TestRemoteCleaner_Run(t *testing.T) {
-	t.Run("should clean files that do not exist locally", func(t *testing.T) {
+	t.Run("should move files that do not exist locally to the trash", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 
 		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
 		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
 
-		cleaner := NewRemoteCleaner(mockChecker, mockRepo)
-
 		tmpDir, err := ioutil.TempDir("", "glacier-test")
 		if err != nil {
 			t.Fatal(err)
 		}
 		defer os.RemoveAll(tmpDir)
 
+		cleaner := NewRemoteCleaner(mockChecker, mockRepo, backup.Config{PathsToBackup: []string{tmpDir}, CleanRemote: cleanAll})
+
 		existingFile := filepath.Join(tmpDir, "exists.txt")
 		err = ioutil.WriteFile(existingFile, []byte("content"), 0644)
 		if err != nil {
@@ -36,22 +59,327 @@ func TestRemoteCleaner_Run(t *testing.T) {
 
 		missingFilePath := filepath.Join(tmpDir, "missing.txt")
 
-		filesMap := map[string]time.Time{
-			existingFile:    time.Now(),
-			missingFilePath: time.Now(),
+		filesMap := map[string]backup.FileRecord{
+			existingFile:    {Path: existingFile, UploadedAt: time.Now()},
+			missingFilePath: {Path: missingFilePath, UploadedAt: time.Now()},
+		}
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetTrash().Return(nil)
+		mockChecker.EXPECT().GetKept().Return(nil)
+		mockChecker.EXPECT().GetFiles().Return(filesMap)
+		mockChecker.EXPECT().Trash(missingFilePath, gomock.Any())
+		mockChecker.EXPECT().OrphanBundles().Return(nil)
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		cleaner.Run()
+	})
+
+	t.Run("should delete every version of the files in the trash for the trash period", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		tmpDir := newCleanerRoot(t)
+
+		cleaner := NewRemoteCleaner(mockChecker, mockRepo, backup.Config{PathsToBackup: []string{tmpDir}, CleanRemote: cleanAll})
+
+		missingFilePath := filepath.Join(tmpDir, "missing.txt")
+		firstKey := backup.VersionKey(missingFilePath, "20250101T000000Z")
+		lastKey := backup.VersionKey(missingFilePath, "20250201T000000Z")
+
+		filesMap := map[string]backup.FileRecord{
+			missingFilePath: {Path: missingFilePath, RemoteKey: lastKey},
+		}
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetTrash().Return(map[string]time.Time{missingFilePath: expiredTrash})
+		mockChecker.EXPECT().GetKept().Return(nil)
+		mockChecker.EXPECT().GetFiles().Return(filesMap)
+		mockChecker.EXPECT().GetVersions(missingFilePath).Return([]backup.FileRecord{
+			{Path: missingFilePath, RemoteKey: firstKey, SnapshotID: "20250101T000000Z"},
+			{Path: missingFilePath, BundleKey: "bundles/20250115T000000Z-0123456789abcdef.tar", SnapshotID: "20250115T000000Z"},
+			{Path: missingFilePath, RemoteKey: lastKey, SnapshotID: "20250201T000000Z"},
+		})
+		mockRepo.EXPECT().Delete(gomock.Any(), firstKey).Return(nil)
+		mockRepo.EXPECT().Delete(gomock.Any(), lastKey).Return(nil)
+		mockChecker.EXPECT().Remove(missingFilePath)
+		mockChecker.EXPECT().OrphanBundles().Return(nil)
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		cleaner.Run()
+	})
+
+	t.Run("should keep the files in the trash until the trash period ends", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		tmpDir := newCleanerRoot(t)
+
+		cleaner := NewRemoteCleaner(mockChecker, mockRepo, backup.Config{PathsToBackup: []string{tmpDir}, CleanRemote: cleanAll})
+
+		missingFilePath := filepath.Join(tmpDir, "missing.txt")
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetTrash().Return(map[string]time.Time{missingFilePath: time.Now().Add(-24 * time.Hour)})
+		mockChecker.EXPECT().GetKept().Return(nil)
+		mockChecker.EXPECT().GetFiles().Return(map[string]backup.FileRecord{
+			missingFilePath: {Path: missingFilePath},
+		})
+		mockChecker.EXPECT().OrphanBundles().Return(nil)
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		cleaner.Run()
+	})
+
+	t.Run("should take out of the trash the files found locally", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		tmpDir := newCleanerRoot(t)
+
+		cleaner := NewRemoteCleaner(mockChecker, mockRepo, backup.Config{PathsToBackup: []string{tmpDir}, CleanRemote: cleanAll})
+
+		existingFile := filepath.Join(tmpDir, "exists.txt")
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetTrash().Return(map[string]time.Time{existingFile: expiredTrash})
+		mockChecker.EXPECT().GetKept().Return(nil)
+		mockChecker.EXPECT().GetFiles().Return(map[string]backup.FileRecord{
+			existingFile: {Path: existingFile},
+		})
+		mockChecker.EXPECT().Untrash(existingFile)
+		mockChecker.EXPECT().OrphanBundles().Return(nil)
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		cleaner.Run()
+	})
+
+	t.Run("should not move to the trash the files kept with --untrash until they are found locally", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		tmpDir := newCleanerRoot(t)
+
+		cleaner := NewRemoteCleaner(mockChecker, mockRepo, backup.Config{PathsToBackup: []string{tmpDir}, CleanRemote: cleanAll})
+
+		existingFile := filepath.Join(tmpDir, "exists.txt")
+		missingFilePath := filepath.Join(tmpDir, "missing.txt")
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetTrash().Return(nil)
+		mockChecker.EXPECT().GetKept().Return(map[string]bool{existingFile: true, missingFilePath: true})
+		mockChecker.EXPECT().GetFiles().Return(map[string]backup.FileRecord{
+			existingFile:    {Path: existingFile},
+			missingFilePath: {Path: missingFilePath},
+		})
+		// The restored file is no longer kept, so it is moved to the trash if it is deleted again
+		mockChecker.EXPECT().Untrash(existingFile)
+		mockChecker.EXPECT().OrphanBundles().Return(nil)
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		cleaner.Run()
+	})
+
+	t.Run("should keep the file in the database if a version cannot be deleted", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		tmpDir := newCleanerRoot(t)
+
+		cleaner := NewRemoteCleaner(mockChecker, mockRepo, backup.Config{PathsToBackup: []string{tmpDir}, CleanRemote: cleanAll})
+
+		missingFilePath := filepath.Join(tmpDir, "missing.jpg")
+		key := backup.VersionKey(missingFilePath, "20250101T000000Z")
+
+		filesMap := map[string]backup.FileRecord{
+			missingFilePath: {Path: missingFilePath, RemoteKey: key},
+		}
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetTrash().Return(map[string]time.Time{missingFilePath: expiredTrash})
+		mockChecker.EXPECT().GetKept().Return(nil)
+		mockChecker.EXPECT().GetFiles().Return(filesMap)
+		mockChecker.EXPECT().GetVersions(missingFilePath).Return([]backup.FileRecord{filesMap[missingFilePath]})
+		mockRepo.EXPECT().Delete(gomock.Any(), key).Return(fmt.Errorf("delete error"))
+		mockChecker.EXPECT().OrphanBundles().Return(nil)
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		cleaner.Run()
+	})
+
+	t.Run("should delete bundles once they do not contain any existing file", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		tmpDir := newCleanerRoot(t)
+
+		cleaner := NewRemoteCleaner(mockChecker, mockRepo, backup.Config{PathsToBackup: []string{tmpDir}, CleanRemote: cleanAll})
+
+		missingFilePath := filepath.Join(tmpDir, "missing.txt")
+		bundleKey := "bundles/20250101T000000Z-0123456789abcdef.tar"
+
+		filesMap := map[string]backup.FileRecord{
+			missingFilePath: {Path: missingFilePath, BundleKey: bundleKey, BundleOffset: 1024},
 		}
 
 		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetTrash().Return(map[string]time.Time{missingFilePath: expiredTrash})
+		mockChecker.EXPECT().GetKept().Return(nil)
 		mockChecker.EXPECT().GetFiles().Return(filesMap)
+		mockChecker.EXPECT().GetVersions(missingFilePath).Return([]backup.FileRecord{filesMap[missingFilePath]})
+		mockChecker.EXPECT().Remove(missingFilePath)
+		mockChecker.EXPECT().OrphanBundles().Return([]string{bundleKey})
+		mockRepo.EXPECT().Delete(gomock.Any(), bundleKey).Return(nil)
+		mockChecker.EXPECT().RemoveBundle(bundleKey)
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
 
-		mockRepo.EXPECT().Delete(gomock.Any(), missingFilePath).Return(nil)
+		cleaner.Run()
+	})
 
+	t.Run("should not delete anything in a dry run", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		tmpDir := newCleanerRoot(t)
+
+		cleaner := NewRemoteCleaner(mockChecker, mockRepo, backup.Config{
+			PathsToBackup: []string{tmpDir},
+			DryRun:        true,
+			CleanRemote:   cleanAll,
+		})
+
+		missingFilePath := filepath.Join(tmpDir, "missing.jpg")
+		packedFilePath := filepath.Join(tmpDir, "missing.txt")
+		newMissingFilePath := filepath.Join(tmpDir, "new.txt")
+		bundleKey := "bundles/20250101T000000Z-0123456789abcdef.tar"
+
+		filesMap := map[string]backup.FileRecord{
+			missingFilePath:    {Path: missingFilePath, SizeBytes: 2048},
+			packedFilePath:     {Path: packedFilePath, SizeBytes: 10, BundleKey: bundleKey},
+			newMissingFilePath: {Path: newMissingFilePath, SizeBytes: 10},
+		}
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetTrash().Return(map[string]time.Time{missingFilePath: expiredTrash, packedFilePath: expiredTrash})
+		mockChecker.EXPECT().GetKept().Return(nil)
+		mockChecker.EXPECT().GetFiles().Return(filesMap)
+		mockChecker.EXPECT().Trash(newMissingFilePath, gomock.Any())
+		mockChecker.EXPECT().GetVersions(missingFilePath).Return(nil)
+		mockChecker.EXPECT().GetVersions(packedFilePath).Return(nil)
 		mockChecker.EXPECT().Remove(missingFilePath)
+		mockChecker.EXPECT().Remove(packedFilePath)
+		mockChecker.EXPECT().OrphanBundles().Return([]string{bundleKey})
+		mockRepo.EXPECT().Head(gomock.Any(), bundleKey).Return(backup.ObjectInfo{Size: 10240}, nil)
+		mockChecker.EXPECT().RemoveBundle(bundleKey)
 		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
 
 		cleaner.Run()
 	})
 
+	t.Run("should not delete files outside the paths to backup", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		tmpDir := newCleanerRoot(t)
+
+		cleaner := NewRemoteCleaner(mockChecker, mockRepo, backup.Config{PathsToBackup: []string{tmpDir}})
+
+		filesMap := map[string]backup.FileRecord{
+			tmpDir + "-archive/missing.jpg": {Path: tmpDir + "-archive/missing.jpg", UploadedAt: time.Now()},
+			"/documents/missing.pdf":        {Path: "/documents/missing.pdf", UploadedAt: time.Now()},
+		}
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetTrash().Return(nil)
+		mockChecker.EXPECT().GetKept().Return(nil)
+		mockChecker.EXPECT().GetFiles().Return(filesMap)
+		mockChecker.EXPECT().OrphanBundles().Return(nil)
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		cleaner.Run()
+	})
+
+	t.Run("should not clean if a path to backup is empty or does not exist", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		emptyDir, err := ioutil.TempDir("", "glacier-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(emptyDir)
+
+		for _, root := range []string{emptyDir, filepath.Join(emptyDir, "unmounted")} {
+			cleaner := NewRemoteCleaner(mockChecker, mockRepo, backup.Config{
+				PathsToBackup: []string{newCleanerRoot(t), root},
+				CleanRemote:   cleanAll,
+			})
+
+			cleaner.Run()
+		}
+	})
+
+	t.Run("should not clean if too many files are missing unless forced", func(t *testing.T) {
+		for _, force := range []bool{false, true} {
+			ctrl := gomock.NewController(t)
+
+			mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+			mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+			tmpDir := newCleanerRoot(t)
+			existingFile := filepath.Join(tmpDir, "exists.txt")
+			missingFilePath := filepath.Join(tmpDir, "missing.txt")
+
+			cleaner := NewRemoteCleaner(mockChecker, mockRepo, backup.Config{
+				PathsToBackup: []string{tmpDir},
+				CleanRemote:   backup.CleanRemoteConfig{MaxDeletePercent: 40, Force: force},
+			})
+
+			mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+			mockChecker.EXPECT().GetTrash().Return(nil)
+			mockChecker.EXPECT().GetKept().Return(nil)
+			mockChecker.EXPECT().GetFiles().Return(map[string]backup.FileRecord{
+				existingFile:    {Path: existingFile},
+				missingFilePath: {Path: missingFilePath},
+			})
+			if force {
+				mockChecker.EXPECT().Trash(missingFilePath, gomock.Any())
+				mockChecker.EXPECT().OrphanBundles().Return(nil)
+			}
+			mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+			cleaner.Run()
+			ctrl.Finish()
+		}
+	})
+
 	t.Run("should not panic if open fails", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
@@ -59,7 +387,7 @@ func TestRemoteCleaner_Run(t *testing.T) {
 		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
 		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
 
-		cleaner := NewRemoteCleaner(mockChecker, mockRepo)
+		cleaner := NewRemoteCleaner(mockChecker, mockRepo, backup.Config{PathsToBackup: []string{newCleanerRoot(t)}})
 
 		mockChecker.EXPECT().Open(gomock.Any()).Return(fmt.Errorf("open error"))
 
@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+type ReplicateConfig struct {
+	// DatabaseKey is the key of the state database, copied once every object recorded in it has been copied
+	DatabaseKey string
+	// Overwrite replaces a different state database already in the destination
+	Overwrite bool
+	// Days is how long the restored copy of an archived object remains available in the source remote
+	Days         int
+	PollInterval time.Duration
+}
+
+// replicator copies the objects recorded in the state database of a remote to another remote
+type replicator struct {
+	ctx     context.Context
+	checker backup.ExistentFilesChecker
+	from    backup.RemoteFilesRepository
+	to      backup.RemoteFilesRepository
+	cfg     ReplicateConfig
+}
+
+// NewReplicator returns the replicate action. It stops when ctx is canceled
+func NewReplicator(ctx context.Context, checker backup.ExistentFilesChecker, from backup.RemoteFilesRepository, to backup.RemoteFilesRepository, cfg ReplicateConfig) backup.Application {
+	if cfg.Days == 0 {
+		cfg.Days = defaultRestoreDays
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = defaultRestorePollInterval
+	}
+	return replicator{ctx: ctx, checker: checker, from: from, to: to, cfg: cfg}
+}
+
+// replicateStats counts the copied objects, the ones already in the destination and the ones that failed
+type replicateStats struct {
+	copied  int
+	skipped int
+	failed  int
+}
+
+func (r replicator) Run() {
+	ctx := r.ctx
+	err := r.checker.Open(ctx)
+	if err != nil {
+		fmt.Printf("Error opening: %v\n", err.Error())
+		return
+	}
+	defer func() {
+		e := r.checker.Close(context.Background())
+		if e != nil {
+			fmt.Println(e.Error())
+		}
+	}()
+
+	pending := r.keys()
+	fmt.Printf("Objects to copy: %d\n", len(pending))
+
+	stats := replicateStats{}
+	for {
+		pending = r.process(ctx, pending, &stats)
+		if ctx.Err() != nil {
+			fmt.Println("Stopping program, run --replicate again to copy the remaining objects")
+			return
+		}
+		if len(pending) == 0 {
+			break
+		}
+
+		fmt.Printf("Copied: %d, waiting for %d archived objects. Next check: %v\n",
+			stats.copied, len(pending), time.Now().Add(r.cfg.PollInterval).Format("2006-01-02 15:04"))
+
+		select {
+		case <-ctx.Done():
+			fmt.Println("Stopping program, restore requests already issued will continue")
+			return
+		case <-time.After(r.cfg.PollInterval):
+		}
+	}
+
+	fmt.Printf("Copied objects: %d, already in the destination: %d\n", stats.copied, stats.skipped)
+	if stats.failed > 0 {
+		fmt.Printf("Objects not copied: %d, the database has not been copied. Run --replicate again\n", stats.failed)
+		return
+	}
+
+	err = r.copyDatabase(ctx)
+	if err != nil {
+		fmt.Printf("Error copying database: %v\n", err)
+		return
+	}
+	fmt.Println("Database copied")
+}
+
+// keys returns the objects of every version of the backed up files, including the bundles
+func (r replicator) keys() []string {
+	unique := make(map[string]bool)
+	for _, version := range r.checker.GetAllVersions() {
+		unique[version.Key()] = true
+	}
+	for _, file := range r.checker.GetFiles() {
+		unique[file.Key()] = true
+	}
+
+	keys := make([]string, 0, len(unique))
+	for key := range unique {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// process copies the available objects missing in the destination and requests the restore of the archived
+// ones. It returns the objects that are not available yet
+func (r replicator) process(ctx context.Context, keys []string, stats *replicateStats) []string {
+	var pending []string
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		info, err := r.from.Head(ctx, key)
+		if err != nil {
+			fmt.Printf("Error getting file %v: %v\n", key, err)
+			stats.failed++
+			continue
+		}
+
+		copied, err := r.copied(ctx, key, info)
+		if err != nil {
+			fmt.Printf("Error getting file %v from the destination: %v\n", key, err)
+			stats.failed++
+			continue
+		}
+		if copied {
+			stats.skipped++
+			continue
+		}
+
+		if info.Available {
+			err = r.copy(ctx, key, info)
+			if err != nil {
+				fmt.Printf("Error copying file %v: %v\n", key, err)
+				stats.failed++
+				continue
+			}
+			stats.copied++
+			continue
+		}
+
+		if !info.Restoring {
+			err = r.from.Restore(ctx, key, r.cfg.Days)
+			if err != nil {
+				fmt.Printf("Error requesting restore of file %v: %v\n", key, err)
+				stats.failed++
+				continue
+			}
+		}
+		pending = append(pending, key)
+	}
+
+	return pending
+}
+
+// copied returns true if the destination already has the object, so an interrupted replication can be resumed.
+// The hashes are compared when both remotes provide them
+func (r replicator) copied(ctx context.Context, key string, info backup.ObjectInfo) (bool, error) {
+	existing, err := r.to.Head(ctx, key)
+	var notFound backup.FileNotFoundError
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if existing.SHA256 != "" && info.SHA256 != "" && existing.SHA256 != info.SHA256 {
+		return false, nil
+	}
+	return existing.Size == info.Size, nil
+}
+
+func (r replicator) copy(ctx context.Context, key string, info backup.ObjectInfo) error {
+	path, err := download(ctx, r.from, key)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	// The repositories store the modification time of the uploaded file
+	if !info.ModTime.IsZero() {
+		err = os.Chtimes(path, info.ModTime, info.ModTime)
+		if err != nil {
+			return err
+		}
+	}
+	return r.to.PutGlacier(ctx, path, key)
+}
+
+// copyDatabase uploads the state database holding the lock of the destination one, so a backup using it is not
+// overwritten. A different database already in the destination is only replaced with Overwrite
+func (r replicator) copyDatabase(ctx context.Context) error {
+	path, err := download(ctx, r.from, r.cfg.DatabaseKey)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	release, err := backup.LockDatabase(ctx, r.to, r.cfg.DatabaseKey)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := release(ctx)
+		if e != nil {
+			fmt.Printf("Error releasing the lock of the database: %v\n", e)
+		}
+	}()
+
+	existing, err := download(ctx, r.to, r.cfg.DatabaseKey)
+	var notFound backup.FileNotFoundError
+	switch {
+	case errors.As(err, &notFound):
+	case err != nil:
+		return fmt.Errorf("error getting the database of the destination: %w", err)
+	default:
+		defer os.Remove(existing)
+		same, err := sameContent(path, existing)
+		if err != nil {
+			return err
+		}
+		if same {
+			return nil
+		}
+		if !r.cfg.Overwrite {
+			return fmt.Errorf("the destination has another database, run --replicate with --force to replace it")
+		}
+	}
+
+	return r.to.PutEditable(ctx, path, r.cfg.DatabaseKey)
+}
+
+// download copies the object from the remote into a temporary file and returns its path
+func download(ctx context.Context, repo backup.RemoteFilesRepository, key string) (string, error) {
+	tmp, err := os.CreateTemp("", "glacier-backup-replicate-*")
+	if err != nil {
+		return "", err
+	}
+	_ = tmp.Close()
+
+	err = repo.Download(ctx, key, tmp.Name())
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// sameContent returns true if both files have the same SHA-256
+func sameContent(path string, other string) (bool, error) {
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return false, err
+	}
+	otherSum, err := fileSHA256(other)
+	if err != nil {
+		return false, err
+	}
+	return sum == otherSum, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
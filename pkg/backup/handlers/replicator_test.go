@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"go.uber.org/mock/gomock"
+)
+
+func TestReplicator_Run(t *testing.T) {
+	bundleKey := "bundles/20250101T000000Z-0123456789abcdef.tar"
+	modTime := time.Date(2020, 8, 1, 10, 0, 0, 0, time.UTC)
+
+	// expectDatabase expects the replication of a database without objects to copy
+	expectDatabase := func(ctrl *gomock.Controller, from *backup.MockRemoteFilesRepository) *backup.MockExistentFilesChecker {
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetAllVersions().Return(nil)
+		mockChecker.EXPECT().GetFiles().Return(map[string]backup.FileRecord{})
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+		from.EXPECT().Download(gomock.Any(), "backup.db", gomock.Any()).DoAndReturn(func(_ context.Context, _ string, path string) error {
+			return ioutil.WriteFile(path, []byte("database"), 0644)
+		})
+		return mockChecker
+	}
+
+	writeContent := func(content string) func(context.Context, string, string) error {
+		return func(_ context.Context, _ string, path string) error {
+			return ioutil.WriteFile(path, []byte(content), 0644)
+		}
+	}
+
+	t.Run("should copy every object missing in the destination and then the database", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockFrom := backup.NewMockRemoteFilesRepository(ctrl)
+		mockTo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetAllVersions().Return([]backup.FileRecord{
+			{Path: "/photos/beach.jpg", SnapshotID: "20250101T000000Z", RemoteKey: "/photos/beach.jpg@20250101T000000Z"},
+			{Path: "/photos/beach.jpg", SnapshotID: "20250102T000000Z", RemoteKey: "/photos/beach.jpg@20250102T000000Z"},
+			{Path: "/notes/a.txt", SnapshotID: "20250101T000000Z", BundleKey: bundleKey},
+			{Path: "/notes/b.txt", SnapshotID: "20250101T000000Z", BundleKey: bundleKey},
+		})
+		mockChecker.EXPECT().GetFiles().Return(map[string]backup.FileRecord{
+			"/photos/beach.jpg": {Path: "/photos/beach.jpg", RemoteKey: "/photos/beach.jpg@20250102T000000Z"},
+			"/notes/a.txt":      {Path: "/notes/a.txt", BundleKey: bundleKey},
+			"/notes/b.txt":      {Path: "/notes/b.txt", BundleKey: bundleKey},
+		})
+
+		// The first version was copied by a previous run
+		mockFrom.EXPECT().Head(gomock.Any(), "/photos/beach.jpg@20250101T000000Z").Return(backup.ObjectInfo{Size: 5, Available: true}, nil)
+		mockTo.EXPECT().Head(gomock.Any(), "/photos/beach.jpg@20250101T000000Z").Return(backup.ObjectInfo{Size: 5, Available: true}, nil)
+
+		mockFrom.EXPECT().Head(gomock.Any(), "/photos/beach.jpg@20250102T000000Z").Return(backup.ObjectInfo{Size: 7, ModTime: modTime, Available: true}, nil)
+		mockTo.EXPECT().Head(gomock.Any(), "/photos/beach.jpg@20250102T000000Z").Return(backup.ObjectInfo{}, backup.NewFileNotFoundError("/photos/beach.jpg@20250102T000000Z"))
+		mockFrom.EXPECT().Download(gomock.Any(), "/photos/beach.jpg@20250102T000000Z", gomock.Any()).DoAndReturn(writeContent("content"))
+		mockTo.EXPECT().
+			PutGlacier(gomock.Any(), gomock.Any(), "/photos/beach.jpg@20250102T000000Z").
+			DoAndReturn(func(_ context.Context, localPath string, _ string) error {
+				info, err := os.Stat(localPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !info.ModTime().Equal(modTime) {
+					t.Errorf("expected modification time %v, got %v", modTime, info.ModTime())
+				}
+				return nil
+			})
+
+		mockFrom.EXPECT().Head(gomock.Any(), bundleKey).Return(backup.ObjectInfo{Size: 20, Available: true}, nil)
+		mockTo.EXPECT().Head(gomock.Any(), bundleKey).Return(backup.ObjectInfo{}, backup.NewFileNotFoundError(bundleKey))
+		mockFrom.EXPECT().Download(gomock.Any(), bundleKey, gomock.Any()).DoAndReturn(writeContent("bundle"))
+		mockTo.EXPECT().PutGlacier(gomock.Any(), gomock.Any(), bundleKey).Return(nil)
+
+		mockFrom.EXPECT().Download(gomock.Any(), "backup.db", gomock.Any()).DoAndReturn(writeContent("database"))
+		mockTo.EXPECT().Download(gomock.Any(), "backup.db", gomock.Any()).Return(backup.NewFileNotFoundError("backup.db"))
+		mockTo.EXPECT().PutEditable(gomock.Any(), gomock.Any(), "backup.db").Return(nil)
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		NewReplicator(context.Background(), mockChecker, mockFrom, mockTo, ReplicateConfig{DatabaseKey: "backup.db"}).Run()
+	})
+
+	t.Run("should request restore of archived objects and copy them once available", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockFrom := backup.NewMockRemoteFilesRepository(ctrl)
+		mockTo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		key := "/photos/beach.jpg@20250101T000000Z"
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetAllVersions().Return([]backup.FileRecord{{Path: "/photos/beach.jpg", RemoteKey: key}})
+		mockChecker.EXPECT().GetFiles().Return(map[string]backup.FileRecord{})
+
+		gomock.InOrder(
+			mockFrom.EXPECT().Head(gomock.Any(), key).Return(backup.ObjectInfo{Size: 7}, nil),
+			mockFrom.EXPECT().Restore(gomock.Any(), key, 3).Return(nil),
+			mockFrom.EXPECT().Head(gomock.Any(), key).Return(backup.ObjectInfo{Size: 7, Restoring: true}, nil),
+			mockFrom.EXPECT().Head(gomock.Any(), key).Return(backup.ObjectInfo{Size: 7, Available: true}, nil),
+			mockFrom.EXPECT().Download(gomock.Any(), key, gomock.Any()).DoAndReturn(writeContent("content")),
+		)
+		mockTo.EXPECT().Head(gomock.Any(), key).Return(backup.ObjectInfo{}, backup.NewFileNotFoundError(key)).Times(3)
+		mockTo.EXPECT().PutGlacier(gomock.Any(), gomock.Any(), key).Return(nil)
+
+		mockFrom.EXPECT().Download(gomock.Any(), "backup.db", gomock.Any()).DoAndReturn(writeContent("database"))
+		mockTo.EXPECT().Download(gomock.Any(), "backup.db", gomock.Any()).Return(backup.NewFileNotFoundError("backup.db"))
+		mockTo.EXPECT().PutEditable(gomock.Any(), gomock.Any(), "backup.db").Return(nil)
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		NewReplicator(context.Background(), mockChecker, mockFrom, mockTo, ReplicateConfig{
+			DatabaseKey:  "backup.db",
+			Days:         3,
+			PollInterval: time.Millisecond,
+		}).Run()
+	})
+
+	t.Run("should not copy the database if an object could not be copied", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockFrom := backup.NewMockRemoteFilesRepository(ctrl)
+		mockTo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		key := "/photos/beach.jpg@20250101T000000Z"
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetAllVersions().Return([]backup.FileRecord{{Path: "/photos/beach.jpg", RemoteKey: key}})
+		mockChecker.EXPECT().GetFiles().Return(map[string]backup.FileRecord{})
+
+		mockFrom.EXPECT().Head(gomock.Any(), key).Return(backup.ObjectInfo{Size: 7, Available: true}, nil)
+		mockTo.EXPECT().Head(gomock.Any(), key).Return(backup.ObjectInfo{}, backup.NewFileNotFoundError(key))
+		mockFrom.EXPECT().Download(gomock.Any(), key, gomock.Any()).DoAndReturn(writeContent("content"))
+		mockTo.EXPECT().PutGlacier(gomock.Any(), gomock.Any(), key).Return(errors.New("connection reset"))
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		NewReplicator(context.Background(), mockChecker, mockFrom, mockTo, ReplicateConfig{DatabaseKey: "backup.db"}).Run()
+	})
+	t.Run("should copy again the objects with another hash", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockFrom := backup.NewMockRemoteFilesRepository(ctrl)
+		mockTo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		copiedKey := "/photos/beach.jpg@20250101T000000Z"
+		modifiedKey := "/photos/beach.jpg@20250102T000000Z"
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetAllVersions().Return([]backup.FileRecord{
+			{Path: "/photos/beach.jpg", RemoteKey: copiedKey},
+			{Path: "/photos/beach.jpg", RemoteKey: modifiedKey},
+		})
+		mockChecker.EXPECT().GetFiles().Return(map[string]backup.FileRecord{})
+
+		// Only one of the remotes provides the hash of the copied object
+		mockFrom.EXPECT().Head(gomock.Any(), copiedKey).Return(backup.ObjectInfo{Size: 7, SHA256: "0123", Available: true}, nil)
+		mockTo.EXPECT().Head(gomock.Any(), copiedKey).Return(backup.ObjectInfo{Size: 7}, nil)
+
+		mockFrom.EXPECT().Head(gomock.Any(), modifiedKey).Return(backup.ObjectInfo{Size: 7, SHA256: "0123", Available: true}, nil)
+		mockTo.EXPECT().Head(gomock.Any(), modifiedKey).Return(backup.ObjectInfo{Size: 7, SHA256: "4567"}, nil)
+		mockFrom.EXPECT().Download(gomock.Any(), modifiedKey, gomock.Any()).DoAndReturn(writeContent("content"))
+		mockTo.EXPECT().PutGlacier(gomock.Any(), gomock.Any(), modifiedKey).Return(nil)
+
+		mockFrom.EXPECT().Download(gomock.Any(), "backup.db", gomock.Any()).DoAndReturn(writeContent("database"))
+		mockTo.EXPECT().Download(gomock.Any(), "backup.db", gomock.Any()).Return(backup.NewFileNotFoundError("backup.db"))
+		mockTo.EXPECT().PutEditable(gomock.Any(), gomock.Any(), "backup.db").Return(nil)
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		NewReplicator(context.Background(), mockChecker, mockFrom, mockTo, ReplicateConfig{DatabaseKey: "backup.db"}).Run()
+	})
+
+	t.Run("should skip the database if the destination already has it", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockFrom := backup.NewMockRemoteFilesRepository(ctrl)
+		mockTo := backup.NewMockRemoteFilesRepository(ctrl)
+		mockChecker := expectDatabase(ctrl, mockFrom)
+
+		mockTo.EXPECT().Download(gomock.Any(), "backup.db", gomock.Any()).DoAndReturn(writeContent("database"))
+		mockTo.EXPECT().PutEditable(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+		NewReplicator(context.Background(), mockChecker, mockFrom, mockTo, ReplicateConfig{DatabaseKey: "backup.db"}).Run()
+	})
+
+	t.Run("should replace another database of the destination only with overwrite", func(t *testing.T) {
+		for _, overwrite := range []bool{false, true} {
+			ctrl := gomock.NewController(t)
+
+			mockFrom := backup.NewMockRemoteFilesRepository(ctrl)
+			mockTo := backup.NewMockRemoteFilesRepository(ctrl)
+			mockChecker := expectDatabase(ctrl, mockFrom)
+
+			mockTo.EXPECT().Download(gomock.Any(), "backup.db", gomock.Any()).DoAndReturn(writeContent("other database"))
+			times := 0
+			if overwrite {
+				times = 1
+			}
+			mockTo.EXPECT().PutEditable(gomock.Any(), gomock.Any(), "backup.db").Return(nil).Times(times)
+
+			NewReplicator(context.Background(), mockChecker, mockFrom, mockTo, ReplicateConfig{
+				DatabaseKey: "backup.db",
+				Overwrite:   overwrite,
+			}).Run()
+			ctrl.Finish()
+		}
+	})
+
+	t.Run("should not copy the database while the destination one is locked", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockFrom := backup.NewMockRemoteFilesRepository(ctrl)
+		mockTo := lockingRepository{backup.NewMockRemoteFilesRepository(ctrl), backup.NewMockConditionalWriter(ctrl)}
+		mockChecker := expectDatabase(ctrl, mockFrom)
+
+		held, err := json.Marshal(backup.Lock{Hostname: "nas", ExpiresAt: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mockTo.MockConditionalWriter.EXPECT().PutIfMatch(gomock.Any(), "backup.db.lock", gomock.Any(), "").Return("", backup.ErrObjectModified)
+		mockTo.MockConditionalWriter.EXPECT().GetVersioned(gomock.Any(), "backup.db.lock").Return(held, "1", nil)
+		mockTo.MockRemoteFilesRepository.EXPECT().PutEditable(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+		NewReplicator(context.Background(), mockChecker, mockFrom, mockTo, ReplicateConfig{DatabaseKey: "backup.db"}).Run()
+	})
+}
+
+// lockingRepository is a repository supporting conditional writes, like s3
+type lockingRepository struct {
+	*backup.MockRemoteFilesRepository
+	*backup.MockConditionalWriter
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+const (
+	defaultRestoreDays         = 7
+	defaultRestorePollInterval = 15 * time.Minute
+)
+
+type RestoreConfig struct {
+	// Prefix selects the backed up paths to restore
+	Prefix string
+	// TargetPath is the folder where restored files are written keeping their original path
+	TargetPath string
+	// At restores the files as they were at that time instead of their last version
+	At time.Time
+	// Days is how long the restored copy of an archived object remains available
+	Days         int
+	PollInterval time.Duration
+}
+
+type restorer struct {
+	ctx     context.Context
+	checker backup.ExistentFilesChecker
+	repo    backup.RemoteFilesRepository
+	cfg     RestoreConfig
+}
+
+// NewRestorer returns the restore action. It stops when ctx is canceled
+func NewRestorer(ctx context.Context, checker backup.ExistentFilesChecker, repo backup.RemoteFilesRepository, cfg RestoreConfig) backup.Application {
+	if cfg.Days == 0 {
+		cfg.Days = defaultRestoreDays
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = defaultRestorePollInterval
+	}
+	return restorer{ctx: ctx, checker: checker, repo: repo, cfg: cfg}
+}
+
+func (r restorer) Run() {
+	ctx := r.ctx
+	err := r.checker.Open(ctx)
+	if err != nil {
+		fmt.Printf("Error opening: %v\n", err.Error())
+		return
+	}
+	defer func() {
+		e := r.checker.Close(context.Background())
+		if e != nil {
+			fmt.Println(e.Error())
+		}
+	}()
+
+	// Packed files are restored together with the other requested files of their bundle
+	filesByKey := make(map[string][]backup.FileRecord)
+	total := 0
+	for path, file := range r.files() {
+		if strings.HasPrefix(path, r.cfg.Prefix) {
+			filesByKey[file.Key()] = append(filesByKey[file.Key()], file)
+			total++
+		}
+	}
+
+	var pending []remoteObject
+	for key, files := range filesByKey {
+		pending = append(pending, remoteObject{key: key, files: files})
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].key < pending[j].key
+	})
+
+	fmt.Printf("Files to restore: %d\n", total)
+
+	restored := 0
+	for {
+		pending, restored = r.process(ctx, pending, restored)
+		if len(pending) == 0 {
+			break
+		}
+
+		fmt.Printf("Restored: %d, waiting for %d archived objects. Next check: %v\n",
+			restored, len(pending), time.Now().Add(r.cfg.PollInterval).Format("2006-01-02 15:04"))
+
+		select {
+		case <-ctx.Done():
+			fmt.Println("Stopping program, restore requests already issued will continue")
+			return
+		case <-time.After(r.cfg.PollInterval):
+		}
+	}
+
+	fmt.Printf("Restored files: %d\n", restored)
+}
+
+// files returns the last version of the backed up files, or their version at the requested time
+func (r restorer) files() map[string]backup.FileRecord {
+	if r.cfg.At.IsZero() {
+		return r.checker.GetFiles()
+	}
+	return r.checker.GetFilesAt(r.cfg.At)
+}
+
+// remoteObject is a file uploaded alone or a bundle, with the files to restore from it
+type remoteObject struct {
+	key   string
+	files []backup.FileRecord
+}
+
+// process downloads the available objects and requests the restore of the archived ones.
+// It returns the objects that are not available yet
+func (r restorer) process(ctx context.Context, objects []remoteObject, restored int) ([]remoteObject, int) {
+	var pending []remoteObject
+	for _, object := range objects {
+		if ctx.Err() != nil {
+			return nil, restored
+		}
+
+		info, err := r.repo.Head(ctx, object.key)
+		if err != nil {
+			fmt.Printf("Error getting file %v: %v\n", object.key, err)
+			continue
+		}
+
+		if info.Available {
+			restored += r.download(ctx, object, info)
+			continue
+		}
+
+		if !info.Restoring {
+			err = r.repo.Restore(ctx, object.key, r.cfg.Days)
+			if err != nil {
+				fmt.Printf("Error requesting restore of file %v: %v\n", object.key, err)
+				continue
+			}
+		}
+		pending = append(pending, object)
+	}
+
+	return pending, restored
+}
+
+// download writes the files of the object in the target folder and returns how many were restored
+func (r restorer) download(ctx context.Context, object remoteObject, info backup.ObjectInfo) int {
+	if object.files[0].BundleKey == "" {
+		err := r.downloadFile(ctx, object.files[0], info)
+		if err != nil {
+			fmt.Printf("Error restoring file %v: %v\n", object.files[0].Path, err)
+			return 0
+		}
+		return 1
+	}
+
+	bundle, err := os.CreateTemp("", "glacier-backup-restore-*")
+	if err != nil {
+		fmt.Printf("Error restoring bundle %v: %v\n", object.key, err)
+		return 0
+	}
+	_ = bundle.Close()
+	defer os.Remove(bundle.Name())
+
+	err = r.repo.Download(ctx, object.key, bundle.Name())
+	if err != nil {
+		fmt.Printf("Error restoring bundle %v: %v\n", object.key, err)
+		return 0
+	}
+
+	restored := 0
+	for _, file := range object.files {
+		target, err := r.prepareTarget(file)
+		if err == nil {
+			err = backup.ExtractFromBundle(bundle.Name(), object.key, file.BundleOffset, target)
+		}
+		if err != nil {
+			fmt.Printf("Error restoring file %v: %v\n", file.Path, err)
+			continue
+		}
+		restored++
+	}
+	return restored
+}
+
+func (r restorer) downloadFile(ctx context.Context, file backup.FileRecord, info backup.ObjectInfo) error {
+	target, err := r.prepareTarget(file)
+	if err != nil {
+		return err
+	}
+
+	err = r.repo.Download(ctx, file.Key(), target)
+	if err != nil {
+		return err
+	}
+
+	if info.ModTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(target, info.ModTime, info.ModTime)
+}
+
+// prepareTarget creates the folder of the restored file and returns its path
+func (r restorer) prepareTarget(file backup.FileRecord) (string, error) {
+	target := filepath.Join(r.cfg.TargetPath, strings.TrimPrefix(file.Path, filepath.VolumeName(file.Path)))
+	return target, os.MkdirAll(filepath.Dir(target), os.ModePerm)
+}
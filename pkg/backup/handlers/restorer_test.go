@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"go.uber.org/mock/gomock"
+)
+
+func TestRestorer_Run(t *testing.T) {
+	t.Run("should request restore of archived files and download them once available", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		tmpDir, err := ioutil.TempDir("", "glacier-restore-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		restoredPath := "/photos/2020/beach.jpg"
+		modTime := time.Date(2020, 8, 1, 10, 0, 0, 0, time.UTC)
+
+		restorer := NewRestorer(context.Background(), mockChecker, mockRepo, RestoreConfig{
+			Prefix:       "/photos",
+			TargetPath:   tmpDir,
+			Days:         3,
+			PollInterval: time.Millisecond,
+		})
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetFiles().Return(map[string]backup.FileRecord{
+			restoredPath:        {Path: restoredPath, UploadedAt: time.Now()},
+			"/documents/cv.pdf": {Path: "/documents/cv.pdf", UploadedAt: time.Now()},
+		})
+
+		gomock.InOrder(
+			mockRepo.EXPECT().Head(gomock.Any(), restoredPath).Return(backup.ObjectInfo{}, nil),
+			mockRepo.EXPECT().Restore(gomock.Any(), restoredPath, 3).Return(nil),
+			mockRepo.EXPECT().Head(gomock.Any(), restoredPath).Return(backup.ObjectInfo{Restoring: true}, nil),
+			mockRepo.EXPECT().Head(gomock.Any(), restoredPath).Return(backup.ObjectInfo{Available: true, ModTime: modTime}, nil),
+		)
+
+		target := filepath.Join(tmpDir, restoredPath)
+		mockRepo.EXPECT().
+			Download(gomock.Any(), restoredPath, target).
+			DoAndReturn(func(_ context.Context, _ string, path string) error {
+				return ioutil.WriteFile(path, []byte("content"), 0644)
+			})
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		restorer.Run()
+
+		info, err := os.Stat(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("expected modification time %v, got %v", modTime, info.ModTime())
+		}
+	})
+
+	t.Run("should extract packed files from their bundle", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		tmpDir, err := ioutil.TempDir("", "glacier-restore-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		bundleKey := "bundles/20250101T000000Z-0123456789abcdef.tar"
+		modTime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+		files := map[string]string{
+			"/notes/a.txt": "first note",
+			"/notes/b.txt": "second note",
+		}
+
+		bundlePath := filepath.Join(tmpDir, "bundle.tar")
+		bundle, err := os.Create(bundlePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw := tar.NewWriter(bundle)
+		err = tw.WriteHeader(&tar.Header{Name: "/notes/a.txt", Size: int64(len(files["/notes/a.txt"])), Mode: 0644, ModTime: modTime})
+		if err == nil {
+			_, err = tw.Write([]byte(files["/notes/a.txt"]))
+		}
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: "/notes/b.txt", Size: int64(len(files["/notes/b.txt"])), Mode: 0644, ModTime: modTime})
+		}
+		if err == nil {
+			_, err = tw.Write([]byte(files["/notes/b.txt"]))
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = bundle.Close()
+
+		targetPath := filepath.Join(tmpDir, "restored")
+		restorer := NewRestorer(context.Background(), mockChecker, mockRepo, RestoreConfig{Prefix: "/notes", TargetPath: targetPath})
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetFiles().Return(map[string]backup.FileRecord{
+			"/notes/a.txt": {Path: "/notes/a.txt", BundleKey: bundleKey, BundleOffset: 0},
+			"/notes/b.txt": {Path: "/notes/b.txt", BundleKey: bundleKey, BundleOffset: 1024},
+		})
+		mockRepo.EXPECT().Head(gomock.Any(), bundleKey).Return(backup.ObjectInfo{Available: true}, nil)
+		mockRepo.EXPECT().
+			Download(gomock.Any(), bundleKey, gomock.Any()).
+			DoAndReturn(func(_ context.Context, _ string, path string) error {
+				content, err := ioutil.ReadFile(bundlePath)
+				if err != nil {
+					return err
+				}
+				return ioutil.WriteFile(path, content, 0644)
+			})
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		restorer.Run()
+
+		for path, expected := range files {
+			target := filepath.Join(targetPath, path)
+			content, err := ioutil.ReadFile(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != expected {
+				t.Errorf("expected content %q, got %q", expected, content)
+			}
+			info, err := os.Stat(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.ModTime().Equal(modTime) {
+				t.Errorf("expected modification time %v, got %v", modTime, info.ModTime())
+			}
+		}
+	})
+
+	t.Run("should restore the versions of the files at the given time", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		tmpDir, err := ioutil.TempDir("", "glacier-restore-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		restoredPath := "/documents/cv.pdf"
+		versionKey := backup.VersionKey(restoredPath, "20250101T000000Z")
+		at := time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC)
+
+		restorer := NewRestorer(context.Background(), mockChecker, mockRepo, RestoreConfig{Prefix: "/documents", TargetPath: tmpDir, At: at})
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetFilesAt(at).Return(map[string]backup.FileRecord{
+			restoredPath: {Path: restoredPath, RemoteKey: versionKey, SnapshotID: "20250101T000000Z"},
+		})
+		mockRepo.EXPECT().Head(gomock.Any(), versionKey).Return(backup.ObjectInfo{Available: true}, nil)
+		mockRepo.EXPECT().
+			Download(gomock.Any(), versionKey, filepath.Join(tmpDir, restoredPath)).
+			DoAndReturn(func(_ context.Context, _ string, path string) error {
+				return ioutil.WriteFile(path, []byte("old content"), 0644)
+			})
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		restorer.Run()
+	})
+
+	t.Run("should not panic if open fails", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		restorer := NewRestorer(context.Background(), mockChecker, mockRepo, RestoreConfig{Prefix: "/", TargetPath: "/tmp"})
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(fmt.Errorf("open error"))
+
+		restorer.Run()
+	})
+}
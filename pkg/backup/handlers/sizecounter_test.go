@@ -39,9 +39,9 @@ func TestSizeCounter_Run(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		filesMap := map[string]time.Time{
-			file1: time.Now(),
-			file2: time.Now(),
+		filesMap := map[string]backup.FileRecord{
+			file1: {Path: file1, UploadedAt: time.Now()},
+			file2: {Path: file2, UploadedAt: time.Now()},
 		}
 
 		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
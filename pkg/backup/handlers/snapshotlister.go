@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+type snapshotLister struct {
+	checker backup.ExistentFilesChecker
+}
+
+func NewSnapshotLister(checker backup.ExistentFilesChecker) backup.Application {
+	return snapshotLister{checker: checker}
+}
+
+func (s snapshotLister) Run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := s.checker.Open(ctx)
+	if err != nil {
+		fmt.Printf("Error opening: %v\n", err.Error())
+		return
+	}
+	defer func() {
+		e := s.checker.Close(ctx)
+		if e != nil {
+			fmt.Println(e.Error())
+		}
+	}()
+
+	snapshots := s.checker.Snapshots()
+	for _, snapshot := range snapshots {
+		fmt.Printf("%v  %v  files: %d  size: %d MB\n",
+			snapshot.ID, snapshot.CreatedAt.Format("2006-01-02 15:04:05"), snapshot.Files, snapshot.SizeBytes/1000_000)
+	}
+	fmt.Printf("Snapshots: %d\n", len(snapshots))
+}
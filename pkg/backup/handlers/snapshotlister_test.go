@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"go.uber.org/mock/gomock"
+)
+
+func TestSnapshotLister_Run(t *testing.T) {
+	t.Run("should list the snapshots", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+
+		lister := NewSnapshotLister(mockChecker)
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().Snapshots().Return([]backup.Snapshot{
+			{ID: "20250101T000000Z", CreatedAt: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), Files: 10, SizeBytes: 2000_000},
+			{ID: "20250201T000000Z", CreatedAt: time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC), Files: 1, SizeBytes: 1000},
+		})
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		lister.Run()
+	})
+
+	t.Run("should not panic if open fails", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+
+		lister := NewSnapshotLister(mockChecker)
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(fmt.Errorf("open error"))
+
+		lister.Run()
+	})
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+type trashLister struct {
+	checker backup.ExistentFilesChecker
+	cfg     backup.Config
+}
+
+func NewTrashLister(checker backup.ExistentFilesChecker, cfg backup.Config) backup.Application {
+	return trashLister{checker: checker, cfg: cfg}
+}
+
+func (l trashLister) Run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := l.checker.Open(ctx)
+	if err != nil {
+		fmt.Printf("Error opening: %v\n", err.Error())
+		return
+	}
+	defer func() {
+		e := l.checker.Close(ctx)
+		if e != nil {
+			fmt.Println(e.Error())
+		}
+	}()
+
+	trash := l.checker.GetTrash()
+	paths := make([]string, 0, len(trash))
+	for path := range trash {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		deletedAt := trash[path]
+		fmt.Printf("%v  deleted: %v  purge after: %v\n", path,
+			deletedAt.Format("2006-01-02 15:04"), deletedAt.Add(l.cfg.CleanRemote.TrashPeriod()).Format("2006-01-02 15:04"))
+	}
+	fmt.Printf("Files in trash: %d\n", len(trash))
+}
+
+type untrasher struct {
+	checker backup.ExistentFilesChecker
+	prefix  string
+}
+
+// NewUntrasher takes out of the trash the files whose path starts with prefix, so their remote objects are kept
+// even if they are still missing locally
+func NewUntrasher(checker backup.ExistentFilesChecker, prefix string) backup.Application {
+	return untrasher{checker: checker, prefix: prefix}
+}
+
+func (u untrasher) Run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := u.checker.Open(ctx)
+	if err != nil {
+		fmt.Printf("Error opening: %v\n", err.Error())
+		return
+	}
+	defer func() {
+		e := u.checker.Close(ctx)
+		if e != nil {
+			fmt.Println(e.Error())
+		}
+	}()
+
+	untrashed := 0
+	for path := range u.checker.GetTrash() {
+		if !strings.HasPrefix(path, u.prefix) {
+			continue
+		}
+		u.checker.Keep(path)
+		untrashed++
+	}
+	fmt.Printf("Files removed from trash: %d. Restore them with --restore, they are not moved to the trash again "+
+		"while they are missing locally\n", untrashed)
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"go.uber.org/mock/gomock"
+)
+
+func TestTrashLister_Run(t *testing.T) {
+	t.Run("should list the files in the trash", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+
+		lister := NewTrashLister(mockChecker, backup.Config{})
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetTrash().Return(map[string]time.Time{
+			"/photos/beach.jpg": time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		})
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		lister.Run()
+	})
+
+	t.Run("should not panic if open fails", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+
+		lister := NewTrashLister(mockChecker, backup.Config{})
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(fmt.Errorf("open error"))
+
+		lister.Run()
+	})
+}
+
+func TestUntrasher_Run(t *testing.T) {
+	t.Run("should take out of the trash the files with the prefix", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+
+		untrasher := NewUntrasher(mockChecker, "/photos/")
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetTrash().Return(map[string]time.Time{
+			"/photos/beach.jpg":    time.Now(),
+			"/photos/2020/ski.jpg": time.Now(),
+			"/documents/cv.pdf":    time.Now(),
+		})
+		mockChecker.EXPECT().Keep("/photos/beach.jpg")
+		mockChecker.EXPECT().Keep("/photos/2020/ski.jpg")
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		untrasher.Run()
+	})
+
+	t.Run("should not panic if open fails", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+
+		untrasher := NewUntrasher(mockChecker, "/")
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(fmt.Errorf("open error"))
+
+		untrasher.Run()
+	})
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+type VerifyConfig struct {
+	// Requeue forgets the upload of the files whose object is wrong, so the next backup uploads them again
+	Requeue bool
+}
+
+type verifier struct {
+	ctx     context.Context
+	checker backup.ExistentFilesChecker
+	repo    backup.RemoteFilesRepository
+	cfg     VerifyConfig
+}
+
+// NewVerifier checks that the objects of the backed up files exist in the remote with the uploaded size and hash.
+// It stops when ctx is canceled
+func NewVerifier(ctx context.Context, checker backup.ExistentFilesChecker, repo backup.RemoteFilesRepository, cfg VerifyConfig) backup.Application {
+	return verifier{ctx: ctx, checker: checker, repo: repo, cfg: cfg}
+}
+
+// verifyProblem is why the object of a file does not match it
+type verifyProblem struct {
+	kind   string
+	detail string
+}
+
+func (p verifyProblem) Error() string {
+	return p.kind + ": " + p.detail
+}
+
+const (
+	problemMissing    = "missing"
+	problemTruncated  = "truncated"
+	problemMismatched = "mismatched"
+)
+
+type verifiedBundle struct {
+	checked bool
+	err     error
+}
+
+type verifyStats struct {
+	files     int
+	checksums int
+	problems  map[string]int
+	errors    int
+	requeued  int
+}
+
+func (v verifier) Run() {
+	ctx := v.ctx
+	err := v.checker.Open(ctx)
+	if err != nil {
+		fmt.Printf("Error opening: %v\n", err.Error())
+		return
+	}
+	defer func() {
+		e := v.checker.Close(context.Background())
+		if e != nil {
+			fmt.Println(e.Error())
+		}
+	}()
+
+	files := v.checker.GetFiles()
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	stats := verifyStats{problems: make(map[string]int)}
+	bundles := v.checker.GetBundles()
+	// The bundles are checked once for all their files
+	verifiedBundles := make(map[string]verifiedBundle)
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			fmt.Println("Stopping program")
+			return
+		}
+
+		file := files[path]
+		var checked bool
+		if file.BundleKey != "" {
+			verified, ok := verifiedBundles[file.BundleKey]
+			if !ok {
+				verified.checked, verified.err = v.verifyBundle(ctx, file.BundleKey, bundles[file.BundleKey])
+				verifiedBundles[file.BundleKey] = verified
+			}
+			checked, err = verified.checked, verified.err
+		} else {
+			checked, err = v.verifyFile(ctx, file)
+		}
+
+		stats.files++
+		if checked {
+			stats.checksums++
+		}
+		v.report(file, err, &stats)
+	}
+
+	fmt.Printf("Verified files: %d, verified with a hash: %d\n", stats.files, stats.checksums)
+	fmt.Printf("Missing: %d, truncated: %d, mismatched: %d, errors: %d\n", stats.problems[problemMissing],
+		stats.problems[problemTruncated], stats.problems[problemMismatched], stats.errors)
+	if v.cfg.Requeue {
+		fmt.Printf("Files requeued for upload: %d\n", stats.requeued)
+	}
+}
+
+func (v verifier) report(file backup.FileRecord, err error, stats *verifyStats) {
+	if err == nil {
+		return
+	}
+
+	var problem verifyProblem
+	if !errors.As(err, &problem) {
+		fmt.Printf("Error verifying %v: %v\n", file.Path, err)
+		stats.errors++
+		return
+	}
+	fmt.Printf("File %v is %v: %v\n", file.Path, problem.kind, problem.detail)
+	stats.problems[problem.kind]++
+
+	if !v.cfg.Requeue {
+		return
+	}
+	_, err = os.Stat(file.Path)
+	if err != nil {
+		fmt.Printf("Not requeued, %v cannot be read: %v\n", file.Path, err)
+		return
+	}
+	v.checker.Requeue(file.Path, fmt.Errorf("verify: %w", problem))
+	stats.requeued++
+}
+
+// verifyBundle compares the bundle with the size and hash it was uploaded with. Bundles uploaded before storing
+// them are only checked to exist. It returns true if the hash could be compared
+func (v verifier) verifyBundle(ctx context.Context, key string, bundle backup.BundleRecord) (bool, error) {
+	var checked bool
+	var err error
+	if bundle.SizeBytes == 0 {
+		_, err = v.repo.Head(ctx, key)
+		var notFound backup.FileNotFoundError
+		if errors.As(err, &notFound) {
+			err = verifyProblem{kind: problemMissing, detail: "object not found"}
+		}
+	} else {
+		_, checked, err = v.verifyObject(ctx, key, bundle.SizeBytes, bundle.SHA256)
+	}
+
+	var problem verifyProblem
+	if errors.As(err, &problem) {
+		problem.detail = "bundle " + key + ", " + problem.detail
+		return checked, problem
+	}
+	return checked, err
+}
+
+// verifyFile compares the object with the size and hash of the uploaded file. It returns true if the hash could be
+// compared
+func (v verifier) verifyFile(ctx context.Context, file backup.FileRecord) (bool, error) {
+	info, checked, err := v.verifyObject(ctx, file.Key(), file.SizeBytes, file.SHA256)
+	if err != nil || checked || file.SHA256 == "" {
+		return checked, err
+	}
+
+	if info.MD5 != "" {
+		return v.compareLocalMD5(file, info.MD5)
+	}
+	return false, nil
+}
+
+// verifyObject compares the object with the given size and hash, if the remote or the object provide its hash.
+// It returns the object and true if the hash could be compared
+func (v verifier) verifyObject(ctx context.Context, key string, size int64, sum string) (backup.ObjectInfo, bool, error) {
+	info, err := v.repo.Head(ctx, key)
+	var notFound backup.FileNotFoundError
+	if errors.As(err, &notFound) {
+		return info, false, verifyProblem{kind: problemMissing, detail: "object not found"}
+	}
+	if err != nil {
+		return info, false, err
+	}
+
+	if info.Size < size {
+		return info, false, verifyProblem{kind: problemTruncated, detail: fmt.Sprintf("%d of %d bytes", info.Size, size)}
+	}
+	if info.Size > size {
+		return info, false, verifyProblem{kind: problemMismatched, detail: fmt.Sprintf("%d bytes instead of %d", info.Size, size)}
+	}
+
+	// Files uploaded before storing hashes can only be compared by size
+	if sum == "" {
+		return info, false, nil
+	}
+
+	if info.SHA256 != "" {
+		return info, true, compareHash("SHA-256", info.SHA256, sum)
+	}
+
+	if hasher, ok := v.repo.(backup.Hasher); ok {
+		remote, err := hasher.SHA256(ctx, key)
+		if err != nil {
+			return info, false, err
+		}
+		return info, true, compareHash("SHA-256", remote, sum)
+	}
+	return info, false, nil
+}
+
+// compareLocalMD5 compares the MD5 of the object with the one of the local file, if the file has not been modified
+// since it was uploaded
+func (v verifier) compareLocalMD5(file backup.FileRecord, remoteMD5 string) (bool, error) {
+	local, err := os.Open(file.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer local.Close()
+
+	sha, md := sha256.New(), md5.New()
+	_, err = io.Copy(io.MultiWriter(sha, md), local)
+	if err != nil {
+		return false, err
+	}
+	if hex.EncodeToString(sha.Sum(nil)) != file.SHA256 {
+		return false, nil
+	}
+	return true, compareHash("MD5", remoteMD5, hex.EncodeToString(md.Sum(nil)))
+}
+
+func compareHash(name string, remote string, expected string) error {
+	if remote == expected {
+		return nil
+	}
+	return verifyProblem{kind: problemMismatched, detail: name + " " + remote + " instead of " + expected}
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"go.uber.org/mock/gomock"
+)
+
+// hashingRepository is a repository able to hash its objects, like the local one
+type hashingRepository struct {
+	*backup.MockRemoteFilesRepository
+	*backup.MockHasher
+}
+
+func TestVerifier_Run(t *testing.T) {
+	content := []byte("content")
+	sha := sha256.Sum256(content)
+	contentSHA256 := hex.EncodeToString(sha[:])
+	md := md5.Sum(content)
+	contentMD5 := hex.EncodeToString(md[:])
+
+	t.Run("should report missing, truncated and mismatched objects without requeuing them", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		bundleKey := "bundles/20250101T000000Z-0123456789abcdef.tar"
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetFiles().Return(map[string]backup.FileRecord{
+			"/photos/ok.jpg":        {Path: "/photos/ok.jpg", SizeBytes: 7, SHA256: contentSHA256},
+			"/photos/missing.jpg":   {Path: "/photos/missing.jpg", SizeBytes: 7},
+			"/photos/truncated.jpg": {Path: "/photos/truncated.jpg", SizeBytes: 7},
+			"/photos/modified.jpg":  {Path: "/photos/modified.jpg", SizeBytes: 7, SHA256: contentSHA256},
+			"/notes/a.txt":          {Path: "/notes/a.txt", SizeBytes: 1, BundleKey: bundleKey},
+			"/notes/b.txt":          {Path: "/notes/b.txt", SizeBytes: 1, BundleKey: bundleKey},
+		})
+		mockChecker.EXPECT().GetBundles().Return(map[string]backup.BundleRecord{
+			bundleKey: {Key: bundleKey, SizeBytes: 2048, SHA256: contentSHA256},
+		})
+
+		mockRepo.EXPECT().Head(gomock.Any(), "/photos/ok.jpg").Return(backup.ObjectInfo{Size: 7, SHA256: contentSHA256}, nil)
+		mockRepo.EXPECT().Head(gomock.Any(), "/photos/missing.jpg").Return(backup.ObjectInfo{}, backup.NewFileNotFoundError("/photos/missing.jpg"))
+		mockRepo.EXPECT().Head(gomock.Any(), "/photos/truncated.jpg").Return(backup.ObjectInfo{Size: 3}, nil)
+		mockRepo.EXPECT().Head(gomock.Any(), "/photos/modified.jpg").Return(backup.ObjectInfo{Size: 7, SHA256: "0123"}, nil)
+		// The bundle is only checked once
+		mockRepo.EXPECT().Head(gomock.Any(), bundleKey).Return(backup.ObjectInfo{Size: 2048, SHA256: contentSHA256}, nil)
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		NewVerifier(context.Background(), mockChecker, mockRepo, VerifyConfig{}).Run()
+	})
+
+	t.Run("should requeue the files of a missing bundle that exist locally", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		tmpDir, err := ioutil.TempDir("", "glacier-verify-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		existing := filepath.Join(tmpDir, "a.txt")
+		err = ioutil.WriteFile(existing, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted := filepath.Join(tmpDir, "b.txt")
+
+		bundleKey := "bundles/20250101T000000Z-0123456789abcdef.tar"
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetFiles().Return(map[string]backup.FileRecord{
+			existing: {Path: existing, SizeBytes: 7, BundleKey: bundleKey},
+			deleted:  {Path: deleted, SizeBytes: 7, BundleKey: bundleKey},
+		})
+		// Bundles uploaded before storing their size and hash are only checked to exist
+		mockChecker.EXPECT().GetBundles().Return(map[string]backup.BundleRecord{bundleKey: {Key: bundleKey}})
+		mockRepo.EXPECT().Head(gomock.Any(), bundleKey).Return(backup.ObjectInfo{}, backup.NewFileNotFoundError(bundleKey))
+		mockChecker.EXPECT().Requeue(existing, gomock.Any())
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		NewVerifier(context.Background(), mockChecker, mockRepo, VerifyConfig{Requeue: true}).Run()
+	})
+
+	t.Run("should hash the objects of repositories able to do it", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := hashingRepository{backup.NewMockRemoteFilesRepository(ctrl), backup.NewMockHasher(ctrl)}
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetFiles().Return(map[string]backup.FileRecord{
+			"/photos/beach.jpg": {Path: "/photos/beach.jpg", RemoteKey: "/photos/beach.jpg@20250101T000000Z", SizeBytes: 7, SHA256: contentSHA256},
+		})
+		mockChecker.EXPECT().GetBundles().Return(map[string]backup.BundleRecord{})
+		mockRepo.MockRemoteFilesRepository.EXPECT().Head(gomock.Any(), "/photos/beach.jpg@20250101T000000Z").Return(backup.ObjectInfo{Size: 7}, nil)
+		mockRepo.MockHasher.EXPECT().SHA256(gomock.Any(), "/photos/beach.jpg@20250101T000000Z").Return("", errors.New("permission denied"))
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		// Errors are reported but never requeued
+		NewVerifier(context.Background(), mockChecker, mockRepo, VerifyConfig{Requeue: true}).Run()
+	})
+
+	t.Run("should compare the MD5 of the object with the one of the unmodified local file", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := backup.NewMockRemoteFilesRepository(ctrl)
+
+		tmpDir, err := ioutil.TempDir("", "glacier-verify-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		path := filepath.Join(tmpDir, "beach.jpg")
+		err = ioutil.WriteFile(path, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetFiles().Return(map[string]backup.FileRecord{
+			path: {Path: path, SizeBytes: 7, SHA256: contentSHA256},
+		})
+		mockChecker.EXPECT().GetBundles().Return(map[string]backup.BundleRecord{})
+		mockRepo.EXPECT().Head(gomock.Any(), path).Return(backup.ObjectInfo{Size: 7, MD5: "0123"}, nil)
+		mockChecker.EXPECT().Requeue(path, gomock.Any()).Do(func(_ string, reason error) {
+			if reason.Error() != "verify: mismatched: MD5 0123 instead of "+contentMD5 {
+				t.Errorf("unexpected reason %v", reason)
+			}
+		})
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		NewVerifier(context.Background(), mockChecker, mockRepo, VerifyConfig{Requeue: true}).Run()
+	})
+
+	t.Run("should compare the bundles with the size and hash they were uploaded with", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockChecker := backup.NewMockExistentFilesChecker(ctrl)
+		mockRepo := hashingRepository{backup.NewMockRemoteFilesRepository(ctrl), backup.NewMockHasher(ctrl)}
+
+		tmpDir, err := ioutil.TempDir("", "glacier-verify-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		paths := make(map[string]string)
+		for _, name := range []string{"ok.txt", "truncated.txt", "modified.txt"} {
+			paths[name] = filepath.Join(tmpDir, name)
+			err = ioutil.WriteFile(paths[name], content, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		okKey := "bundles/20250101T000000Z-0000000000000001.tar"
+		truncatedKey := "bundles/20250101T000000Z-0000000000000002.tar"
+		modifiedKey := "bundles/20250101T000000Z-0000000000000003.tar.zst"
+		mockChecker.EXPECT().Open(gomock.Any()).Return(nil)
+		mockChecker.EXPECT().GetFiles().Return(map[string]backup.FileRecord{
+			paths["ok.txt"]:        {Path: paths["ok.txt"], SizeBytes: 7, BundleKey: okKey},
+			paths["truncated.txt"]: {Path: paths["truncated.txt"], SizeBytes: 7, BundleKey: truncatedKey},
+			paths["modified.txt"]:  {Path: paths["modified.txt"], SizeBytes: 7, BundleKey: modifiedKey},
+		})
+		mockChecker.EXPECT().GetBundles().Return(map[string]backup.BundleRecord{
+			okKey:        {Key: okKey, SizeBytes: 2048, SHA256: contentSHA256},
+			truncatedKey: {Key: truncatedKey, SizeBytes: 2048, SHA256: contentSHA256},
+			modifiedKey:  {Key: modifiedKey, SizeBytes: 512, SHA256: contentSHA256},
+		})
+
+		mockRepo.MockRemoteFilesRepository.EXPECT().Head(gomock.Any(), okKey).Return(backup.ObjectInfo{Size: 2048}, nil)
+		mockRepo.MockHasher.EXPECT().SHA256(gomock.Any(), okKey).Return(contentSHA256, nil)
+		mockRepo.MockRemoteFilesRepository.EXPECT().Head(gomock.Any(), truncatedKey).Return(backup.ObjectInfo{Size: 1024}, nil)
+		mockRepo.MockRemoteFilesRepository.EXPECT().Head(gomock.Any(), modifiedKey).Return(backup.ObjectInfo{Size: 512}, nil)
+		mockRepo.MockHasher.EXPECT().SHA256(gomock.Any(), modifiedKey).Return("0123", nil)
+
+		mockChecker.EXPECT().Requeue(paths["truncated.txt"], gomock.Any()).Do(func(_ string, reason error) {
+			if reason.Error() != "verify: truncated: bundle "+truncatedKey+", 1024 of 2048 bytes" {
+				t.Errorf("unexpected reason %v", reason)
+			}
+		})
+		mockChecker.EXPECT().Requeue(paths["modified.txt"], gomock.Any()).Do(func(_ string, reason error) {
+			if reason.Error() != "verify: mismatched: bundle "+modifiedKey+", SHA-256 0123 instead of "+contentSHA256 {
+				t.Errorf("unexpected reason %v", reason)
+			}
+		})
+		mockChecker.EXPECT().Close(gomock.Any()).Return(nil)
+
+		NewVerifier(context.Background(), mockChecker, mockRepo, VerifyConfig{Requeue: true}).Run()
+	})
+}
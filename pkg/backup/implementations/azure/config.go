@@ -0,0 +1,83 @@
+package azure
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+type Config struct {
+	Container string `yaml:"container"`
+	// ConnectionString takes precedence over the account name and key
+	ConnectionString string `yaml:"connectionString"`
+	AccountName      string `yaml:"accountName"`
+	AccountKey       string `yaml:"accountKey"`
+	// Endpoint replaces the service URL https://<accountName>.blob.core.windows.net/,
+	// e.g. http://127.0.0.1:10000/devstoreaccount1 to use Azurite
+	Endpoint string `yaml:"endpoint"`
+	// RehydratePriority of the archived blobs being restored, Standard (default) or High
+	RehydratePriority string `yaml:"rehydratePriority"`
+}
+
+const (
+	containerKey         = "GLACIER_BACKUP_AZURE_CONTAINER"
+	connectionStringKey  = "GLACIER_BACKUP_AZURE_CONNECTION_STRING"
+	accountNameKey       = "GLACIER_BACKUP_AZURE_ACCOUNT_NAME"
+	accountKeyKey        = "GLACIER_BACKUP_AZURE_ACCOUNT_KEY"
+	endpointKey          = "GLACIER_BACKUP_AZURE_ENDPOINT"
+	rehydratePriorityKey = "GLACIER_BACKUP_AZURE_REHYDRATE_PRIORITY"
+)
+
+const (
+	rehydratePriorityStandard = "Standard"
+	rehydratePriorityHigh     = "High"
+)
+
+// NewConfig decodes the customConfig block of the azure remote. Environment variables override its values
+func NewConfig(customConfig backup.CustomConfig) (Config, error) {
+	cfg := Config{}
+	err := customConfig.Decode(&cfg)
+	if err != nil {
+		return Config{}, fmt.Errorf("error decoding azure configuration: %w", err)
+	}
+
+	overrides := map[string]*string{
+		containerKey:         &cfg.Container,
+		connectionStringKey:  &cfg.ConnectionString,
+		accountNameKey:       &cfg.AccountName,
+		accountKeyKey:        &cfg.AccountKey,
+		endpointKey:          &cfg.Endpoint,
+		rehydratePriorityKey: &cfg.RehydratePriority,
+	}
+	for key, value := range overrides {
+		if v := os.Getenv(key); v != "" {
+			*value = v
+		}
+	}
+
+	if cfg.Container == "" {
+		return Config{}, fmt.Errorf("container or environment variable %s must be set", containerKey)
+	}
+	if cfg.ConnectionString == "" && (cfg.AccountName == "" || cfg.AccountKey == "") {
+		return Config{}, fmt.Errorf("connectionString or accountName and accountKey must be set")
+	}
+
+	switch cfg.RehydratePriority {
+	case "":
+		cfg.RehydratePriority = rehydratePriorityStandard
+	case rehydratePriorityStandard, rehydratePriorityHigh:
+	default:
+		return Config{}, fmt.Errorf("invalid rehydratePriority '%v', use %v or %v", cfg.RehydratePriority, rehydratePriorityStandard, rehydratePriorityHigh)
+	}
+
+	return cfg, nil
+}
+
+// ServiceURL returns the endpoint of the Blob service of the account
+func (c Config) ServiceURL() string {
+	if c.Endpoint != "" {
+		return c.Endpoint
+	}
+	return fmt.Sprintf("https://%s.blob.core.windows.net/", c.AccountName)
+}
@@ -0,0 +1,252 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+// minStreamBlockSize is the default block size of UploadStream, each block is kept in memory
+const minStreamBlockSize = 1024 * 1024
+
+const (
+	archiveMinStorageDays  = 180
+	archivePricePerGBMonth = 0.00099
+)
+
+// rehydratedPrefix is where the copies of the archived blobs are rehydrated, so the blobs stay in the Archive tier
+const rehydratedPrefix = ".rehydrated/"
+
+// repository stores the files in an Azure Blob Storage container. Archived blobs are restored by rehydrating
+// a copy of them to the Cool tier, deleted once it is downloaded
+type repository struct {
+	config Config
+	client *container.Client
+}
+
+func NewRepository(config Config, client *container.Client) backup.RemoteFilesRepository {
+	return repository{config: config, client: client}
+}
+
+// MinStorageDays is the minimum storage duration billed for blobs in the Archive tier
+func (repo repository) MinStorageDays() int {
+	return archiveMinStorageDays
+}
+
+// PricePerGBMonth is the Archive tier price in the cheapest regions, used to estimate early deletion charges
+func (repo repository) PricePerGBMonth() float64 {
+	return archivePricePerGBMonth
+}
+
+func (repo repository) PutGlacier(ctx context.Context, localPath string, remotePath string) error {
+	return repo.put(ctx, localPath, remotePath, blob.AccessTierArchive)
+}
+
+func (repo repository) PutEditable(ctx context.Context, localPath string, remotePath string) error {
+	return repo.put(ctx, localPath, remotePath, blob.AccessTierHot)
+}
+
+func (repo repository) put(ctx context.Context, localPath string, remotePath string, tier blob.AccessTier) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("error reading file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading file info: %w", err)
+	}
+
+	mtime := strconv.FormatInt(info.ModTime().Unix(), 10)
+	client := repo.client.NewBlockBlobClient(backup.ObjectKey(remotePath))
+	if backup.BandwidthLimited(ctx) {
+		// UploadFile reads the blocks of the file directly, so a limited upload is streamed instead
+		_, err = client.UploadStream(ctx, backup.LimitReader(ctx, file), &blockblob.UploadStreamOptions{
+			BlockSize:  streamBlockSize(info.Size()),
+			AccessTier: &tier,
+			Metadata:   map[string]*string{backup.ModTimeMetadataKey: &mtime},
+		})
+	} else {
+		_, err = client.UploadFile(ctx, file, &blockblob.UploadFileOptions{
+			AccessTier: &tier,
+			Metadata:   map[string]*string{backup.ModTimeMetadataKey: &mtime},
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("error uploading %v: %w", remotePath, err)
+	}
+	return nil
+}
+
+// streamBlockSize returns the smallest block size allowing to stream the file within the maximum number of blocks
+func streamBlockSize(size int64) int64 {
+	blockSize := int64(minStreamBlockSize)
+	for blockSize*blockblob.MaxBlocks < size {
+		blockSize *= 2
+	}
+	return blockSize
+}
+
+func (repo repository) Delete(ctx context.Context, remotePath string) error {
+	_, err := repo.blob(remotePath).Delete(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (repo repository) Get(ctx context.Context, remotePath string) (string, error) {
+	response, err := repo.blob(remotePath).DownloadStream(ctx, nil)
+	if err != nil {
+		return "", repo.downloadError(remotePath, err)
+	}
+	body := response.NewRetryReader(ctx, nil)
+	defer body.Close()
+
+	buff := new(bytes.Buffer)
+	_, err = buff.ReadFrom(body)
+	if err != nil {
+		return "", fmt.Errorf("error downloading %v: %w", remotePath, err)
+	}
+	return buff.String(), nil
+}
+
+// Download gets the blob, or its rehydrated copy if it is archived. The copy is deleted once it is downloaded
+func (repo repository) Download(ctx context.Context, key string, path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = repo.blob(key).DownloadFile(ctx, file, nil)
+	rehydrated := bloberror.HasCode(err, bloberror.BlobArchived)
+	if rehydrated {
+		_, err = repo.rehydrated(key).DownloadFile(ctx, file, nil)
+	}
+	if err != nil {
+		_ = file.Close()
+		return repo.downloadError(key, err)
+	}
+
+	err = file.Close()
+	if err != nil || !rehydrated {
+		return err
+	}
+	_, err = repo.rehydrated(key).Delete(ctx, nil)
+	if err != nil {
+		fmt.Printf("Error deleting the rehydrated copy of %v: %v\n", key, err)
+	}
+	return nil
+}
+
+func (repo repository) Head(ctx context.Context, remotePath string) (backup.ObjectInfo, error) {
+	props, err := repo.blob(remotePath).GetProperties(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return backup.ObjectInfo{}, backup.NewFileNotFoundError(remotePath)
+	}
+	if err != nil {
+		return backup.ObjectInfo{}, err
+	}
+
+	info := backup.ObjectInfo{
+		Available: true,
+		// Only set when the blob is uploaded in a single request
+		MD5: hex.EncodeToString(props.ContentMD5),
+	}
+	if props.ContentLength != nil {
+		info.Size = *props.ContentLength
+	}
+	if props.LastModified != nil {
+		info.ModTime = props.LastModified.UTC()
+	}
+
+	// The SDK returns the metadata keys canonicalized as HTTP headers
+	for key, value := range props.Metadata {
+		if strings.EqualFold(key, backup.ModTimeMetadataKey) && value != nil {
+			seconds, err := strconv.ParseInt(*value, 10, 64)
+			if err == nil {
+				info.ModTime = time.Unix(seconds, 0).UTC()
+			}
+		}
+	}
+
+	if isArchived(props.AccessTier) {
+		info.Available, info.Restoring, err = repo.rehydration(ctx, remotePath)
+		if err != nil {
+			return backup.ObjectInfo{}, err
+		}
+	}
+
+	return info, nil
+}
+
+// rehydration returns whether the rehydrated copy of the blob is available or being rehydrated
+func (repo repository) rehydration(ctx context.Context, remotePath string) (bool, bool, error) {
+	props, err := repo.rehydrated(remotePath).GetProperties(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, fmt.Errorf("error getting the rehydrated copy of %v: %w", remotePath, err)
+	}
+	if props.CopyStatus != nil && *props.CopyStatus != blob.CopyStatusTypeSuccess {
+		// A failed copy is requested again
+		return false, *props.CopyStatus == blob.CopyStatusTypePending, nil
+	}
+	// The archive status is only present while the copy is being rehydrated
+	if isArchived(props.AccessTier) || props.ArchiveStatus != nil {
+		return false, true, nil
+	}
+	return true, false, nil
+}
+
+// Restore rehydrates a copy of the archived blob to the Cool tier, and the blob stays in the Archive tier. Azure
+// does not expire the copy, so days is ignored: the copy is deleted when it is downloaded, and it is billed as a
+// Cool blob until then
+func (repo repository) Restore(ctx context.Context, remotePath string, days int) error {
+	priority := blob.RehydratePriority(repo.config.RehydratePriority)
+	tier := blob.AccessTierCool
+	_, err := repo.rehydrated(remotePath).StartCopyFromURL(ctx, repo.blob(remotePath).URL(), &blob.StartCopyFromURLOptions{
+		Tier:              &tier,
+		RehydratePriority: &priority,
+	})
+	if bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.CannotVerifyCopySource) {
+		return backup.NewFileNotFoundError(remotePath)
+	}
+	if err != nil {
+		return fmt.Errorf("error rehydrating %v: %w", remotePath, err)
+	}
+	return nil
+}
+
+func isArchived(tier *string) bool {
+	return tier != nil && *tier == string(blob.AccessTierArchive)
+}
+
+func (repo repository) downloadError(remotePath string, err error) error {
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return backup.NewFileNotFoundError(remotePath)
+	}
+	return fmt.Errorf("error downloading %v: %w", remotePath, err)
+}
+
+func (repo repository) blob(remotePath string) *blob.Client {
+	return repo.client.NewBlobClient(backup.ObjectKey(remotePath))
+}
+
+// rehydrated returns the client of the rehydrated copy of the blob
+func (repo repository) rehydrated(remotePath string) *blob.Client {
+	return repo.client.NewBlobClient(rehydratedPrefix + backup.ObjectKey(remotePath))
+}
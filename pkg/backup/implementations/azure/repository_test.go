@@ -0,0 +1,274 @@
+package azure
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+// The well-known development account of Azurite. GLACIER_BACKUP_AZURITE_ENDPOINT replaces the default endpoint
+const (
+	azuriteEndpointKey = "GLACIER_BACKUP_AZURITE_ENDPOINT"
+	azuriteEndpoint    = "http://127.0.0.1:10000/devstoreaccount1"
+	azuriteAccountName = "devstoreaccount1"
+	azuriteAccountKey  = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// newAzuriteRepository creates a repository using a new container of Azurite, deleted after the test.
+// The test is skipped if Azurite is not running
+func newAzuriteRepository(t *testing.T) (backup.RemoteFilesRepository, *container.Client) {
+	t.Helper()
+	endpoint := azuriteEndpoint
+	if v := os.Getenv(azuriteEndpointKey); v != "" {
+		endpoint = v
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, time.Second)
+	if err != nil {
+		t.Skipf("Azurite is not available at %v: %v", endpoint, err)
+	}
+	_ = conn.Close()
+
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		Container:         "glacier-backup-test-" + hex.EncodeToString(suffix),
+		AccountName:       azuriteAccountName,
+		AccountKey:        azuriteAccountKey,
+		Endpoint:          endpoint,
+		RehydratePriority: rehydratePriorityStandard,
+	}
+
+	// The same client the service provider creates from the account name and key
+	credential, err := container.NewSharedKeyCredential(cfg.AccountName, cfg.AccountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := container.NewClientWithSharedKeyCredential(strings.TrimSuffix(cfg.ServiceURL(), "/")+"/"+cfg.Container, credential, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	_, err = client.Create(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, _ = client.Delete(context.Background(), nil)
+	})
+
+	return NewRepository(cfg, client), client
+}
+
+func TestRepository(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "glacier-azure-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := []byte("content of the photo")
+	localPath := filepath.Join(tmpDir, "beach.jpg")
+	err = ioutil.WriteFile(localPath, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = os.Chtimes(localPath, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum(content)
+
+	t.Run("should upload the files to the archive tier and rehydrate a copy of them to the cool tier", func(t *testing.T) {
+		repo, client := newAzuriteRepository(t)
+
+		err := repo.PutGlacier(ctx, localPath, "/photos/beach.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		props, err := client.NewBlobClient("photos/beach.jpg").GetProperties(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if props.AccessTier == nil || *props.AccessTier != string(blob.AccessTierArchive) {
+			t.Errorf("unexpected access tier %v", props.AccessTier)
+		}
+
+		info, err := repo.Head(ctx, "/photos/beach.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(len(content)) || !info.ModTime.Equal(modTime) {
+			t.Errorf("unexpected size %d and modification time %v", info.Size, info.ModTime)
+		}
+		if info.MD5 != "" && info.MD5 != hex.EncodeToString(sum[:]) {
+			t.Errorf("unexpected MD5 %v", info.MD5)
+		}
+		if info.Available || info.Restoring {
+			t.Errorf("archived blob is available %v or restoring %v", info.Available, info.Restoring)
+		}
+
+		err = repo.Restore(ctx, "/photos/beach.jpg", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Azure keeps the copy in the archive tier while it is rehydrated, Azurite changes the tier at once
+		info, err = repo.Head(ctx, "/photos/beach.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.Available && !info.Restoring {
+			t.Errorf("rehydrated blob is neither available nor restoring: %+v", info)
+		}
+		props, err = client.NewBlobClient(".rehydrated/photos/beach.jpg").GetProperties(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Available && (props.AccessTier == nil || *props.AccessTier != string(blob.AccessTierCool)) {
+			t.Errorf("unexpected access tier %v of the copy", props.AccessTier)
+		}
+		if !info.Available {
+			return
+		}
+
+		downloaded := filepath.Join(tmpDir, "downloaded.jpg")
+		err = repo.Download(ctx, "/photos/beach.jpg", downloaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(downloaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(content) {
+			t.Errorf("downloaded %q", got)
+		}
+
+		// The blob stays archived and the copy is deleted
+		props, err = client.NewBlobClient("photos/beach.jpg").GetProperties(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if props.AccessTier == nil || *props.AccessTier != string(blob.AccessTierArchive) {
+			t.Errorf("unexpected access tier %v after the restore", props.AccessTier)
+		}
+		_, err = client.NewBlobClient(".rehydrated/photos/beach.jpg").GetProperties(ctx, nil)
+		if err == nil {
+			t.Errorf("the rehydrated copy has not been deleted")
+		}
+	})
+
+	t.Run("should upload the editable files to the hot tier", func(t *testing.T) {
+		repo, client := newAzuriteRepository(t)
+
+		err := repo.PutEditable(ctx, localPath, "backup.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		props, err := client.NewBlobClient("backup.db").GetProperties(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if props.AccessTier == nil || *props.AccessTier != string(blob.AccessTierHot) {
+			t.Errorf("unexpected access tier %v", props.AccessTier)
+		}
+
+		info, err := repo.Head(ctx, "backup.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.Available {
+			t.Errorf("hot blob is not available: %+v", info)
+		}
+		got, err := repo.Get(ctx, "backup.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(content) {
+			t.Errorf("Get returned %q", got)
+		}
+	})
+
+	t.Run("should stream the upload when the bandwidth is limited", func(t *testing.T) {
+		repo, _ := newAzuriteRepository(t)
+
+		limiter := backup.NewBandwidthLimiter(backup.UploadConfig{BandwidthKBps: 1024})
+		err := repo.PutEditable(backup.WithBandwidthLimiter(ctx, limiter), localPath, "backup.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := repo.Head(ctx, "backup.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(len(content)) || !info.ModTime.Equal(modTime) {
+			t.Errorf("unexpected object %+v", info)
+		}
+	})
+
+	t.Run("should report the missing blobs as not found", func(t *testing.T) {
+		repo, _ := newAzuriteRepository(t)
+
+		var notFound backup.FileNotFoundError
+		_, err := repo.Head(ctx, "/photos/missing.jpg")
+		if !errors.As(err, &notFound) {
+			t.Errorf("Head returned %v", err)
+		}
+		_, err = repo.Get(ctx, "/photos/missing.jpg")
+		if !errors.As(err, &notFound) {
+			t.Errorf("Get returned %v", err)
+		}
+		err = repo.Restore(ctx, "/photos/missing.jpg", 1)
+		if !errors.As(err, &notFound) {
+			t.Errorf("Restore returned %v", err)
+		}
+		err = repo.Delete(ctx, "/photos/missing.jpg")
+		if err != nil {
+			t.Errorf("Delete returned %v", err)
+		}
+	})
+}
+
+func TestStreamBlockSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int64
+	}{
+		{size: 0, want: minStreamBlockSize},
+		{size: minStreamBlockSize * blockblob.MaxBlocks, want: minStreamBlockSize},
+		{size: minStreamBlockSize*blockblob.MaxBlocks + 1, want: 2 * minStreamBlockSize},
+		{size: 5 * minStreamBlockSize * blockblob.MaxBlocks, want: 8 * minStreamBlockSize},
+	}
+	for _, tt := range tests {
+		if got := streamBlockSize(tt.size); got != tt.want {
+			t.Errorf("block size of %d bytes is %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package composite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+// Remote is a named repository the files are replicated to
+type Remote struct {
+	Name       string
+	Repository backup.RemoteFilesRepository
+}
+
+// repository uploads the files to the primary remote and to every replica. The state database is stored
+// in all of them too, so any of them can restore the backup
+type repository struct {
+	primary  backup.RemoteFilesRepository
+	replicas []Remote
+}
+
+func NewRepository(primary backup.RemoteFilesRepository, replicas []Remote) backup.RemoteFilesRepository {
+	return repository{primary: primary, replicas: replicas}
+}
+
+func (r repository) Replicas() []string {
+	names := make([]string, 0, len(r.replicas))
+	for _, replica := range r.replicas {
+		names = append(names, replica.Name)
+	}
+	return names
+}
+
+// RemoteKey uses the keys of the primary remote. The replicas share its encryption configuration, so they map
+// the paths to the same keys
+func (r repository) RemoteKey(path string) string {
+	if mapper, ok := r.primary.(backup.KeyMapper); ok {
+		return mapper.RemoteKey(path)
+	}
+	return path
+}
+
+func (r repository) MinStorageDays() int {
+	if policy, ok := r.primary.(backup.StoragePolicy); ok {
+		return policy.MinStorageDays()
+	}
+	return 0
+}
+
+func (r repository) PricePerGBMonth() float64 {
+	if policy, ok := r.primary.(backup.StoragePolicy); ok {
+		return policy.PricePerGBMonth()
+	}
+	return 0
+}
+
+func (r repository) PutGlacier(ctx context.Context, localPath string, remotePath string) error {
+	err := r.primary.PutGlacier(ctx, localPath, remotePath)
+	if err != nil {
+		return err
+	}
+	return r.PutReplicas(ctx, localPath, remotePath, r.Replicas())
+}
+
+// PutGlacierChecksum returns the checksum of the primary remote, or an empty one if it does not validate the uploads
+func (r repository) PutGlacierChecksum(ctx context.Context, localPath string, remotePath string) (string, error) {
+	putter, ok := r.primary.(backup.ChecksumPutter)
+	if !ok {
+		return "", r.PutGlacier(ctx, localPath, remotePath)
+	}
+	sum, err := putter.PutGlacierChecksum(ctx, localPath, remotePath)
+	if err != nil {
+		return "", err
+	}
+	return sum, r.PutReplicas(ctx, localPath, remotePath, r.Replicas())
+}
+
+// GetVersioned reads the lock objects of the primary remote, the replicas are not locked
+func (r repository) GetVersioned(ctx context.Context, key string) ([]byte, string, error) {
+	writer, ok := r.primary.(backup.ConditionalWriter)
+	if !ok {
+		return nil, "", errors.ErrUnsupported
+	}
+	return writer.GetVersioned(ctx, key)
+}
+
+func (r repository) PutIfMatch(ctx context.Context, key string, content []byte, version string) (string, error) {
+	writer, ok := r.primary.(backup.ConditionalWriter)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	return writer.PutIfMatch(ctx, key, content, version)
+}
+
+func (r repository) PutEditable(ctx context.Context, localPath string, remotePath string) error {
+	err := r.primary.PutEditable(ctx, localPath, remotePath)
+	if err != nil {
+		return err
+	}
+	return r.each(r.Replicas(), func(repo backup.RemoteFilesRepository) error {
+		return repo.PutEditable(ctx, localPath, remotePath)
+	})
+}
+
+func (r repository) PutReplicas(ctx context.Context, localPath string, remotePath string, replicas []string) error {
+	return r.each(replicas, func(repo backup.RemoteFilesRepository) error {
+		return repo.PutGlacier(ctx, localPath, remotePath)
+	})
+}
+
+// each calls fn with the given replicas and returns a *backup.ReplicationError with the ones that failed
+func (r repository) each(names []string, fn func(repo backup.RemoteFilesRepository) error) error {
+	failed := make(map[string]error)
+	for _, name := range names {
+		replica, ok := r.replica(name)
+		if !ok {
+			failed[name] = fmt.Errorf("unknown replica")
+			continue
+		}
+		err := fn(replica.Repository)
+		if err != nil {
+			failed[name] = err
+		}
+	}
+	if len(failed) > 0 {
+		return &backup.ReplicationError{Failed: failed}
+	}
+	return nil
+}
+
+// Close closes the primary remote and the replicas keeping a connection open
+func (r repository) Close() error {
+	var errs []error
+	for _, repo := range append([]backup.RemoteFilesRepository{r.primary}, r.repositories()...) {
+		if closer, ok := repo.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r repository) repositories() []backup.RemoteFilesRepository {
+	repos := make([]backup.RemoteFilesRepository, 0, len(r.replicas))
+	for _, replica := range r.replicas {
+		repos = append(repos, replica.Repository)
+	}
+	return repos
+}
+
+func (r repository) replica(name string) (Remote, bool) {
+	for _, replica := range r.replicas {
+		if replica.Name == name {
+			return replica, true
+		}
+	}
+	return Remote{}, false
+}
+
+// Delete removes the object from every remote. The replicas may lack the objects they could not receive, and
+// the primary remote the bundles only uploaded to the replicas
+func (r repository) Delete(ctx context.Context, remotePath string) error {
+	var errs []error
+	err := r.primary.Delete(ctx, remotePath)
+	if err != nil && !isNotFound(err) {
+		errs = append(errs, err)
+	}
+	for _, replica := range r.replicas {
+		err := replica.Repository.Delete(ctx, remotePath)
+		if err != nil && !isNotFound(err) {
+			errs = append(errs, fmt.Errorf("error deleting from replica '%v': %w", replica.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Get reads the object from the primary remote, or from a replica if it fails
+func (r repository) Get(ctx context.Context, remotePath string) (string, error) {
+	var content string
+	err := r.first(ctx, remotePath, func(repo backup.RemoteFilesRepository) error {
+		var err error
+		content, err = repo.Get(ctx, remotePath)
+		return err
+	})
+	return content, err
+}
+
+// Download copies the object from the primary remote, or from a replica if it fails, e.g. because the
+// object is archived in the primary remote
+func (r repository) Download(ctx context.Context, key string, path string) error {
+	return r.first(ctx, key, func(repo backup.RemoteFilesRepository) error {
+		return repo.Download(ctx, key, path)
+	})
+}
+
+// Head returns the object of the first remote where it is available, or the one of the primary remote
+// if it must be restored
+func (r repository) Head(ctx context.Context, remotePath string) (backup.ObjectInfo, error) {
+	primaryInfo, primaryErr := r.primary.Head(ctx, remotePath)
+	if primaryErr == nil && primaryInfo.Available {
+		return primaryInfo, nil
+	}
+
+	for _, replica := range r.replicas {
+		info, err := replica.Repository.Head(ctx, remotePath)
+		if err == nil && info.Available {
+			return info, nil
+		}
+	}
+	return primaryInfo, primaryErr
+}
+
+func (r repository) Restore(ctx context.Context, remotePath string, days int) error {
+	return r.primary.Restore(ctx, remotePath, days)
+}
+
+// first calls fn with the primary remote and then with the replicas where the object is available until it
+// succeeds. It returns the error of the primary remote if all of them fail
+func (r repository) first(ctx context.Context, key string, fn func(repo backup.RemoteFilesRepository) error) error {
+	primaryErr := fn(r.primary)
+	if primaryErr == nil {
+		return nil
+	}
+
+	for _, replica := range r.replicas {
+		info, err := replica.Repository.Head(ctx, key)
+		if err != nil || !info.Available {
+			continue
+		}
+		err = fn(replica.Repository)
+		if err == nil {
+			return nil
+		}
+	}
+	return primaryErr
+}
+
+func isNotFound(err error) bool {
+	var notFound backup.FileNotFoundError
+	return errors.As(err, &notFound) || errors.Is(err, fs.ErrNotExist)
+}
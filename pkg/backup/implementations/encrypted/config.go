@@ -0,0 +1,42 @@
+package encrypted
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+type Config struct {
+	// Secret is the key file contents or passphrase the encryption keys are derived from
+	Secret        []byte
+	ObfuscateKeys bool
+	// TempDir is where the encrypted copies of the files are written while they are uploaded
+	TempDir string
+}
+
+const (
+	passphraseKey = "GLACIER_BACKUP_ENCRYPTION_PASSPHRASE"
+)
+
+func NewConfig(cfg backup.EncryptionConfig) (Config, error) {
+	secret := []byte(os.Getenv(passphraseKey))
+	if cfg.KeyFile != "" {
+		content, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return Config{}, fmt.Errorf("error reading encryption key file: %w", err)
+		}
+		secret = bytes.TrimSpace(content)
+	}
+
+	if len(secret) == 0 {
+		return Config{}, fmt.Errorf("keyFile or environment variable %s must be set to encrypt files", passphraseKey)
+	}
+
+	return Config{
+		Secret:        secret,
+		ObfuscateKeys: cfg.ObfuscateKeys,
+		TempDir:       cfg.TempDir,
+	}, nil
+}
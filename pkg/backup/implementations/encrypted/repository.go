@@ -0,0 +1,264 @@
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"golang.org/x/crypto/scrypt"
+)
+
+// keySalt is constant so the same secret always derives the same keys and obfuscated paths
+const keySalt = "glacier-backup"
+
+// obfuscatedKeysPrefix groups the files stored with an obfuscated key
+const obfuscatedKeysPrefix = "data/"
+
+// repository encrypts the files before putting them in the wrapped repository and decrypts them after downloading
+type repository struct {
+	inner         backup.RemoteFilesRepository
+	contentKey    []byte
+	nameKey       []byte
+	obfuscateKeys bool
+	tempDir       string
+}
+
+func NewRepository(cfg Config, inner backup.RemoteFilesRepository) (backup.RemoteFilesRepository, error) {
+	masterKey, err := scrypt.Key(cfg.Secret, []byte(keySalt), 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving encryption key: %w", err)
+	}
+
+	return repository{
+		inner:         inner,
+		contentKey:    deriveKey(masterKey, []byte("content")),
+		nameKey:       deriveKey(masterKey, []byte("keys")),
+		obfuscateKeys: cfg.ObfuscateKeys,
+		tempDir:       cfg.TempDir,
+	}, nil
+}
+
+// RemoteKey returns a keyed hash of the path when keys are obfuscated, so the remote does not reveal the local folders
+func (r repository) RemoteKey(path string) string {
+	if !r.obfuscateKeys {
+		return path
+	}
+	return obfuscatedKeysPrefix + hex.EncodeToString(deriveKey(r.nameKey, []byte(path)))
+}
+
+func (r repository) PutGlacier(ctx context.Context, localPath string, remotePath string) error {
+	encryptedPath, err := r.encrypt(localPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(encryptedPath)
+
+	return r.inner.PutGlacier(ctx, encryptedPath, remotePath)
+}
+
+func (r repository) PutEditable(ctx context.Context, localPath string, remotePath string) error {
+	encryptedPath, err := r.encrypt(localPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(encryptedPath)
+
+	return r.inner.PutEditable(ctx, encryptedPath, remotePath)
+}
+
+func (r repository) Delete(ctx context.Context, remotePath string) error {
+	return r.inner.Delete(ctx, remotePath)
+}
+
+func (r repository) Get(ctx context.Context, remotePath string) (string, error) {
+	content, err := r.inner.Get(ctx, remotePath)
+	if err != nil {
+		return "", err
+	}
+
+	plain, err := newReader(bytes.NewReader([]byte(content)), r.contentKey)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting %v: %w", remotePath, err)
+	}
+
+	buff := new(bytes.Buffer)
+	_, err = buff.ReadFrom(plain)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting %v: %w", remotePath, err)
+	}
+	return buff.String(), nil
+}
+
+func (r repository) Download(ctx context.Context, key string, path string) error {
+	encrypted, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.enc")
+	if err != nil {
+		return err
+	}
+	_ = encrypted.Close()
+	defer os.Remove(encrypted.Name())
+
+	err = r.inner.Download(ctx, key, encrypted.Name())
+	if err != nil {
+		return err
+	}
+
+	err = r.decrypt(encrypted.Name(), path)
+	if err != nil {
+		return fmt.Errorf("error decrypting %v: %w", key, err)
+	}
+	return nil
+}
+
+// Head returns the size of the decrypted content. The hashes of the remote are the ones of the encrypted content,
+// so they are not returned
+func (r repository) Head(ctx context.Context, remotePath string) (backup.ObjectInfo, error) {
+	info, err := r.inner.Head(ctx, remotePath)
+	if err != nil {
+		return info, err
+	}
+	info.Size = plainSize(info.Size)
+	info.SHA256 = ""
+	info.MD5 = ""
+	return info, nil
+}
+
+// GetVersioned decrypts the content of the object, the version is the one of the encrypted object
+func (r repository) GetVersioned(ctx context.Context, key string) ([]byte, string, error) {
+	writer, ok := r.inner.(backup.ConditionalWriter)
+	if !ok {
+		return nil, "", errors.ErrUnsupported
+	}
+	content, version, err := writer.GetVersioned(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	plain, err := newReader(bytes.NewReader(content), r.contentKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("error decrypting %v: %w", key, err)
+	}
+	content, err = io.ReadAll(plain)
+	if err != nil {
+		return nil, "", fmt.Errorf("error decrypting %v: %w", key, err)
+	}
+	return content, version, nil
+}
+
+func (r repository) PutIfMatch(ctx context.Context, key string, content []byte, version string) (string, error) {
+	writer, ok := r.inner.(backup.ConditionalWriter)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	buff := new(bytes.Buffer)
+	err := r.encryptTo(buff, bytes.NewReader(content))
+	if err != nil {
+		return "", fmt.Errorf("error encrypting %v: %w", key, err)
+	}
+	return writer.PutIfMatch(ctx, key, buff.Bytes(), version)
+}
+
+func (r repository) Restore(ctx context.Context, remotePath string, days int) error {
+	return r.inner.Restore(ctx, remotePath, days)
+}
+
+// Close closes the wrapped repository if it keeps a connection open
+func (r repository) Close() error {
+	if closer, ok := r.inner.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (r repository) MinStorageDays() int {
+	if policy, ok := r.inner.(backup.StoragePolicy); ok {
+		return policy.MinStorageDays()
+	}
+	return 0
+}
+
+func (r repository) PricePerGBMonth() float64 {
+	if policy, ok := r.inner.(backup.StoragePolicy); ok {
+		return policy.PricePerGBMonth()
+	}
+	return 0
+}
+
+// encrypt streams the file into a temporary file with the same modification time and returns its path. The
+// remotes upload files, which they read again to retry and in parallel parts, so the encrypted content is not
+// streamed to them
+func (r repository) encrypt(localPath string) (string, error) {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	dst, err := os.CreateTemp(r.tempDir, ".glacier-backup-*.enc")
+	if err != nil {
+		return "", err
+	}
+
+	err = r.encryptTo(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(dst.Name(), info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		_ = os.Remove(dst.Name())
+		return "", fmt.Errorf("error encrypting %v: %w", localPath, err)
+	}
+
+	return dst.Name(), nil
+}
+
+func (r repository) encryptTo(dst io.Writer, src io.Reader) error {
+	w, err := newWriter(dst, r.contentKey)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (r repository) decrypt(encryptedPath string, path string) error {
+	src, err := os.Open(encryptedPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	plain, err := newReader(src, r.contentKey)
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, plain)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+	}
+	return err
+}
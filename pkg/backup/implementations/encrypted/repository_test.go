@@ -0,0 +1,134 @@
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"github.com/closmarfer/glacier-backup/pkg/backup/implementations/local"
+)
+
+func TestRepository(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "glacier-encrypted-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	inner, err := local.NewRepository(local.Config{DestinationPath: filepath.Join(tmpDir, "remote")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := NewRepository(Config{Secret: []byte("passphrase"), ObfuscateKeys: true}, inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, size := range []int{0, chunkSize, 2*chunkSize + 1} {
+		content := randomBytes(t, size)
+		path := filepath.Join(tmpDir, "photo.jpg")
+		err = ioutil.WriteFile(path, content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := repo.(backup.KeyMapper).RemoteKey(path)
+		if strings.Contains(key, "photo") {
+			t.Errorf("the key %v reveals the path", key)
+		}
+		err = repo.PutGlacier(ctx, path, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := inner.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size > 0 && bytes.Contains([]byte(stored), content) {
+			t.Errorf("size %d: the content is stored in plain text", size)
+		}
+
+		info, err := repo.Head(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(size) {
+			t.Errorf("size %d: Head returned %d", size, info.Size)
+		}
+
+		restored := filepath.Join(tmpDir, "restored.jpg")
+		err = repo.Download(ctx, key, restored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(restored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("size %d: restored content is different", size)
+		}
+	}
+}
+
+// uploadedFiles records the paths of the files uploaded to the wrapped repository
+type uploadedFiles struct {
+	backup.RemoteFilesRepository
+	paths []string
+}
+
+func (u *uploadedFiles) PutGlacier(ctx context.Context, localPath string, remotePath string) error {
+	u.paths = append(u.paths, localPath)
+	return u.RemoteFilesRepository.PutGlacier(ctx, localPath, remotePath)
+}
+
+func TestRepository_tempDir(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "glacier-encrypted-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	inner, err := local.NewRepository(local.Config{DestinationPath: filepath.Join(tmpDir, "remote")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded := &uploadedFiles{RemoteFilesRepository: inner}
+	tempDir := filepath.Join(tmpDir, "temp")
+	err = os.Mkdir(tempDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := NewRepository(Config{Secret: []byte("passphrase"), TempDir: tempDir}, uploaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(tmpDir, "photo.jpg")
+	err = ioutil.WriteFile(path, randomBytes(t, chunkSize), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.PutGlacier(context.Background(), path, "photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uploaded.paths) != 1 || filepath.Dir(uploaded.paths[0]) != tempDir {
+		t.Errorf("got uploaded files %v, want one encrypted in %v", uploaded.paths, tempDir)
+	}
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("the encrypted files have not been removed: %v", entries)
+	}
+}
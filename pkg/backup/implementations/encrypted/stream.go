@@ -0,0 +1,202 @@
+package encrypted
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted files start with the magic header and a random salt used to derive the key of the file.
+// The content follows split in chunks encrypted with AES-GCM. The nonce of each chunk is its position
+// and a flag marking the last one, so reordered or truncated files cannot be decrypted
+const (
+	magic     = "GLBKENC1"
+	saltSize  = 32
+	chunkSize = 64 * 1024
+	tagSize   = 16
+)
+
+var ErrNotEncrypted = errors.New("file is not encrypted")
+
+var errCorrupted = errors.New("error decrypting file: wrong key or corrupted file")
+
+// plainSize returns the size of the content of an encrypted file. Every chunk, including the last one,
+// which may be empty, is followed by its authentication tag
+func plainSize(encryptedSize int64) int64 {
+	sealedChunkSize := int64(chunkSize + tagSize)
+	size := encryptedSize - int64(len(magic)+saltSize)
+	if size < tagSize {
+		return 0
+	}
+	chunks := size / sealedChunkSize
+	if rest := size % sealedChunkSize; rest != 0 {
+		return chunks*chunkSize + rest - tagSize
+	}
+	return chunks * chunkSize
+}
+
+func newAEAD(contentKey []byte, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(contentKey, salt))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func deriveKey(key []byte, info []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(info)
+	return mac.Sum(nil)
+}
+
+func chunkNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// writer encrypts the written content. Close must be called to write the last chunk
+type writer struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+}
+
+func newWriter(dst io.Writer, contentKey []byte) (*writer, error) {
+	salt := make([]byte, saltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(contentKey, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = dst.Write(append([]byte(magic), salt...))
+	if err != nil {
+		return nil, err
+	}
+
+	return &writer{dst: dst, aead: aead, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// A full chunk is only written when more content arrives, because the last one must be flagged
+		if len(w.buf) == chunkSize {
+			err := w.flush(false)
+			if err != nil {
+				return n, err
+			}
+		}
+		c := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (w *writer) Close() error {
+	return w.flush(true)
+}
+
+func (w *writer) flush(final bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.counter, final), w.buf, nil)
+	w.counter++
+	w.buf = w.buf[:0]
+	_, err := w.dst.Write(sealed)
+	return err
+}
+
+// reader decrypts the content written by writer
+type reader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	chunk   []byte
+	plain   []byte
+	pending []byte
+	counter uint64
+	done    bool
+}
+
+func newReader(src io.Reader, contentKey []byte) (*reader, error) {
+	buffered := bufio.NewReader(src)
+
+	header := make([]byte, len(magic)+saltSize)
+	_, err := io.ReadFull(buffered, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && string(header[:len(magic)]) != magic) {
+		return nil, ErrNotEncrypted
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(contentKey, header[len(magic):])
+	if err != nil {
+		return nil, err
+	}
+
+	return &reader{
+		src:   buffered,
+		aead:  aead,
+		chunk: make([]byte, chunkSize+aead.Overhead()),
+		plain: make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		err := r.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *reader) next() error {
+	n, err := io.ReadFull(r.src, r.chunk)
+	final := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		final = true
+	case err != nil:
+		return err
+	default:
+		_, err = r.src.Peek(1)
+		if err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, err := r.aead.Open(r.plain[:0], chunkNonce(r.counter, final), r.chunk[:n], nil)
+	if err != nil {
+		return fmt.Errorf("%w (chunk %d)", errCorrupted, r.counter)
+	}
+	r.counter++
+	r.pending = plain
+	r.done = final
+	return nil
+}
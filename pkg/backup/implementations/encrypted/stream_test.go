@@ -0,0 +1,164 @@
+package encrypted
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{7}, 32)
+
+func encryptBytes(t *testing.T, content []byte, key []byte) []byte {
+	t.Helper()
+	var encrypted bytes.Buffer
+	w, err := newWriter(&encrypted, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Small writes check that the chunks are split independently of the writes
+	for len(content) > 0 {
+		n := min(len(content), 1000)
+		_, err = w.Write(content[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		content = content[n:]
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted.Bytes()
+}
+
+func decryptBytes(encrypted []byte, key []byte) ([]byte, error) {
+	r, err := newReader(bytes.NewReader(encrypted), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func randomBytes(t *testing.T, size int) []byte {
+	t.Helper()
+	content := make([]byte, size)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// sealedChunk returns the encrypted chunk at the given position
+func sealedChunk(encrypted []byte, position int) []byte {
+	start := len(magic) + saltSize + position*(chunkSize+tagSize)
+	return encrypted[start : start+chunkSize+tagSize]
+}
+
+func TestStream(t *testing.T) {
+	sizes := []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 2 * chunkSize, 3*chunkSize + 100}
+
+	t.Run("should decrypt the encrypted content", func(t *testing.T) {
+		for _, size := range sizes {
+			content := randomBytes(t, size)
+			encrypted := encryptBytes(t, content, testKey)
+
+			decrypted, err := decryptBytes(encrypted, testKey)
+			if err != nil {
+				t.Fatalf("size %d: %v", size, err)
+			}
+			if !bytes.Equal(decrypted, content) {
+				t.Errorf("size %d: decrypted content is different", size)
+			}
+		}
+	})
+
+	t.Run("should compute the plain size from the encrypted size", func(t *testing.T) {
+		for _, size := range sizes {
+			encrypted := encryptBytes(t, randomBytes(t, size), testKey)
+			if got := plainSize(int64(len(encrypted))); got != int64(size) {
+				t.Errorf("plain size of %d encrypted bytes is %d, want %d", len(encrypted), got, size)
+			}
+		}
+	})
+
+	t.Run("should use a different salt for every file", func(t *testing.T) {
+		content := []byte("same content")
+		if bytes.Equal(encryptBytes(t, content, testKey), encryptBytes(t, content, testKey)) {
+			t.Error("the same content is encrypted to the same bytes")
+		}
+	})
+
+	t.Run("should fail with a wrong key", func(t *testing.T) {
+		encrypted := encryptBytes(t, []byte("content"), testKey)
+
+		_, err := decryptBytes(encrypted, bytes.Repeat([]byte{8}, 32))
+		if !errors.Is(err, errCorrupted) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("should fail on a file that is not encrypted", func(t *testing.T) {
+		for _, content := range [][]byte{nil, []byte("short"), bytes.Repeat([]byte("plain text"), 10)} {
+			_, err := decryptBytes(content, testKey)
+			if !errors.Is(err, ErrNotEncrypted) {
+				t.Errorf("unexpected error %v", err)
+			}
+		}
+	})
+
+	t.Run("should fail on a modified chunk", func(t *testing.T) {
+		encrypted := encryptBytes(t, randomBytes(t, 2*chunkSize+10), testKey)
+		sealedChunk(encrypted, 1)[100] ^= 1
+
+		_, err := decryptBytes(encrypted, testKey)
+		if !errors.Is(err, errCorrupted) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("should fail on reordered chunks", func(t *testing.T) {
+		encrypted := encryptBytes(t, randomBytes(t, 2*chunkSize+10), testKey)
+		first := append([]byte(nil), sealedChunk(encrypted, 0)...)
+		copy(sealedChunk(encrypted, 0), sealedChunk(encrypted, 1))
+		copy(sealedChunk(encrypted, 1), first)
+
+		_, err := decryptBytes(encrypted, testKey)
+		if !errors.Is(err, errCorrupted) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("should fail on truncated files", func(t *testing.T) {
+		encrypted := encryptBytes(t, randomBytes(t, 2*chunkSize+10), testKey)
+		header := len(magic) + saltSize
+		lengths := map[string]int{
+			"without chunks":               header,
+			"in the middle of a chunk":     header + 1000,
+			"after the first chunk":        header + chunkSize + tagSize,
+			"after the second chunk":       header + 2*(chunkSize+tagSize),
+			"without the last tag byte":    len(encrypted) - 1,
+			"inside the tag of last chunk": len(encrypted) - tagSize + 1,
+		}
+		for name, length := range lengths {
+			_, err := decryptBytes(encrypted[:length], testKey)
+			if !errors.Is(err, errCorrupted) {
+				t.Errorf("%v: unexpected error %v", name, err)
+			}
+		}
+	})
+
+	t.Run("should fail on content appended to the file", func(t *testing.T) {
+		content := randomBytes(t, chunkSize)
+		encrypted := encryptBytes(t, content, testKey)
+		// A full last chunk followed by the chunk of another file encrypted with the same key
+		encrypted = append(encrypted, encryptBytes(t, []byte("more"), testKey)[len(magic)+saltSize:]...)
+
+		_, err := decryptBytes(encrypted, testKey)
+		if !errors.Is(err, errCorrupted) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
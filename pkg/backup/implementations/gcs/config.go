@@ -0,0 +1,49 @@
+package gcs
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+type Config struct {
+	Bucket string `yaml:"bucket"`
+	// CredentialsFile is a service account key file. Application default credentials are used if it is empty
+	CredentialsFile string `yaml:"credentialsFile"`
+	// Endpoint replaces the Cloud Storage API, e.g. http://localhost:4443/storage/v1/ to use a local fake server.
+	// Requests to a custom endpoint are not authenticated
+	Endpoint string `yaml:"endpoint"`
+}
+
+const (
+	bucketKey          = "GLACIER_BACKUP_GCS_BUCKET"
+	credentialsFileKey = "GLACIER_BACKUP_GCS_CREDENTIALS_FILE"
+	endpointKey        = "GLACIER_BACKUP_GCS_ENDPOINT"
+)
+
+// NewConfig decodes the customConfig block of the gcs remote. Environment variables override its values
+func NewConfig(customConfig backup.CustomConfig) (Config, error) {
+	cfg := Config{}
+	err := customConfig.Decode(&cfg)
+	if err != nil {
+		return Config{}, fmt.Errorf("error decoding gcs configuration: %w", err)
+	}
+
+	overrides := map[string]*string{
+		bucketKey:          &cfg.Bucket,
+		credentialsFileKey: &cfg.CredentialsFile,
+		endpointKey:        &cfg.Endpoint,
+	}
+	for key, value := range overrides {
+		if v := os.Getenv(key); v != "" {
+			*value = v
+		}
+	}
+
+	if cfg.Bucket == "" {
+		return Config{}, fmt.Errorf("bucket or environment variable %s must be set", bucketKey)
+	}
+
+	return cfg, nil
+}
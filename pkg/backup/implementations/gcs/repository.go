@@ -0,0 +1,225 @@
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	archiveStorageClass  = "ARCHIVE"
+	standardStorageClass = "STANDARD"
+)
+
+const (
+	archiveMinStorageDays  = 365
+	archivePricePerGBMonth = 0.0012
+)
+
+// repository stores the files in a Cloud Storage bucket. Unlike Deep Archive, objects in the ARCHIVE
+// storage class can be downloaded at once, so they never need to be restored
+type repository struct {
+	config Config
+	client *storage.Client
+}
+
+func NewRepository(config Config, client *storage.Client) backup.RemoteFilesRepository {
+	return repository{config: config, client: client}
+}
+
+// MinStorageDays is the minimum storage duration billed for ARCHIVE objects
+func (repo repository) MinStorageDays() int {
+	return archiveMinStorageDays
+}
+
+// PricePerGBMonth is the ARCHIVE storage price in the cheapest regions, used to estimate early deletion charges
+func (repo repository) PricePerGBMonth() float64 {
+	return archivePricePerGBMonth
+}
+
+func (repo repository) PutGlacier(ctx context.Context, localPath string, remotePath string) error {
+	return repo.put(ctx, localPath, remotePath, archiveStorageClass)
+}
+
+func (repo repository) PutEditable(ctx context.Context, localPath string, remotePath string) error {
+	return repo.put(ctx, localPath, remotePath, standardStorageClass)
+}
+
+func (repo repository) put(ctx context.Context, localPath string, remotePath string, storageClass string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("error reading file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading file info: %w", err)
+	}
+
+	// Canceling the context is the only way to abort the upload without creating the object
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := repo.object(remotePath).NewWriter(ctx)
+	w.StorageClass = storageClass
+	w.Metadata = map[string]string{
+		backup.ModTimeMetadataKey: strconv.FormatInt(info.ModTime().Unix(), 10),
+	}
+
+	_, err = io.Copy(w, backup.LimitReader(ctx, file))
+	if err != nil {
+		cancel()
+		_ = w.Close()
+		return fmt.Errorf("error uploading %v: %w", remotePath, err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("error uploading %v: %w", remotePath, err)
+	}
+	return nil
+}
+
+func (repo repository) Delete(ctx context.Context, remotePath string) error {
+	err := repo.object(remotePath).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return backup.NewFileNotFoundError(remotePath)
+	}
+	return err
+}
+
+// GetVersioned returns the content of the object, versioned by its generation
+func (repo repository) GetVersioned(ctx context.Context, key string) ([]byte, string, error) {
+	r, err := repo.reader(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("error downloading %v: %w", key, err)
+	}
+	return content, strconv.FormatInt(r.Attrs.Generation, 10), nil
+}
+
+// PutIfMatch uses the preconditions of Cloud Storage, which fail if the generation of the object is not the
+// expected one
+func (repo repository) PutIfMatch(ctx context.Context, key string, content []byte, version string) (string, error) {
+	conditions := storage.Conditions{DoesNotExist: true}
+	if version != "" {
+		generation, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid generation %q of %v: %w", version, key, err)
+		}
+		conditions = storage.Conditions{GenerationMatch: generation}
+	}
+
+	w := repo.object(key).If(conditions).NewWriter(ctx)
+	w.StorageClass = standardStorageClass
+	_, err := w.Write(content)
+	if err != nil {
+		_ = w.Close()
+		return "", fmt.Errorf("error uploading %v: %w", key, err)
+	}
+	err = w.Close()
+	var apiError *googleapi.Error
+	if errors.As(err, &apiError) && apiError.Code == http.StatusPreconditionFailed {
+		return "", fmt.Errorf("%w: %v", backup.ErrObjectModified, err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error uploading %v: %w", key, err)
+	}
+	return strconv.FormatInt(w.Attrs().Generation, 10), nil
+}
+
+func (repo repository) Get(ctx context.Context, remotePath string) (string, error) {
+	r, err := repo.reader(ctx, remotePath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	buff := new(bytes.Buffer)
+	_, err = buff.ReadFrom(r)
+	if err != nil {
+		return "", fmt.Errorf("error downloading %v: %w", remotePath, err)
+	}
+	return buff.String(), nil
+}
+
+func (repo repository) Download(ctx context.Context, key string, path string) error {
+	r, err := repo.reader(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, r)
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("error downloading %v: %w", key, err)
+	}
+
+	return file.Close()
+}
+
+func (repo repository) Head(ctx context.Context, remotePath string) (backup.ObjectInfo, error) {
+	attrs, err := repo.object(remotePath).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return backup.ObjectInfo{}, backup.NewFileNotFoundError(remotePath)
+	}
+	if err != nil {
+		return backup.ObjectInfo{}, err
+	}
+
+	info := backup.ObjectInfo{
+		Size:      attrs.Size,
+		ModTime:   attrs.Updated.UTC(),
+		Available: true,
+		// Composite objects do not have an MD5
+		MD5: hex.EncodeToString(attrs.MD5),
+	}
+	if mtime, ok := attrs.Metadata[backup.ModTimeMetadataKey]; ok {
+		seconds, err := strconv.ParseInt(mtime, 10, 64)
+		if err == nil {
+			info.ModTime = time.Unix(seconds, 0).UTC()
+		}
+	}
+
+	return info, nil
+}
+
+// Restore does nothing, ARCHIVE objects are always available
+func (repo repository) Restore(ctx context.Context, remotePath string, days int) error {
+	return nil
+}
+
+func (repo repository) reader(ctx context.Context, remotePath string) (*storage.Reader, error) {
+	r, err := repo.object(remotePath).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, backup.NewFileNotFoundError(remotePath)
+	}
+	return r, err
+}
+
+func (repo repository) object(remotePath string) *storage.ObjectHandle {
+	return repo.client.Bucket(repo.config.Bucket).Object(backup.ObjectKey(remotePath))
+}
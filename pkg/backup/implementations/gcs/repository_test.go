@@ -0,0 +1,381 @@
+package gcs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"google.golang.org/api/option"
+)
+
+const testBucket = "backup-bucket"
+
+type fakeObject struct {
+	content      []byte
+	storageClass string
+	metadata     map[string]string
+	updated      time.Time
+	generation   int64
+}
+
+// fakeGCS implements the requests of the JSON API used by the repository, and the XML API used by the
+// client to download objects
+type fakeGCS struct {
+	mu          sync.Mutex
+	objects     map[string]fakeObject
+	generations int64
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	uploadPrefix := "/upload/storage/v1/b/" + testBucket + "/o"
+	objectPrefix := "/storage/v1/b/" + testBucket + "/o/"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == uploadPrefix:
+		f.upload(w, r)
+	case strings.HasPrefix(r.URL.Path, objectPrefix):
+		name := strings.TrimPrefix(r.URL.Path, objectPrefix)
+		object, ok := f.objects[name]
+		switch {
+		case !ok:
+			writeError(w, http.StatusNotFound)
+		case r.Method == http.MethodDelete:
+			delete(f.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet && r.URL.Query().Get("alt") == "media":
+			_, _ = w.Write(object.content)
+		case r.Method == http.MethodGet:
+			writeObject(w, name, object)
+		default:
+			writeError(w, http.StatusMethodNotAllowed)
+		}
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/"+testBucket+"/"):
+		object, ok := f.objects[strings.TrimPrefix(r.URL.Path, "/"+testBucket+"/")]
+		if !ok {
+			writeError(w, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.content)))
+		w.Header().Set("X-Goog-Generation", strconv.FormatInt(object.generation, 10))
+		_, _ = w.Write(object.content)
+	default:
+		writeError(w, http.StatusNotImplemented)
+	}
+}
+
+// upload stores the object of a multipart upload, the files of the tests are smaller than a resumable upload chunk
+func (f *fakeGCS) upload(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("uploadType") != "multipart" {
+		writeError(w, http.StatusNotImplemented)
+		return
+	}
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+	parts := multipart.NewReader(r.Body, params["boundary"])
+
+	var attrs struct {
+		Name         string            `json:"name"`
+		StorageClass string            `json:"storageClass"`
+		Metadata     map[string]string `json:"metadata"`
+	}
+	part, err := parts.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&attrs)
+	}
+	var content []byte
+	if err == nil {
+		part, err = parts.NextPart()
+	}
+	if err == nil {
+		content, err = io.ReadAll(part)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+
+	// ifGenerationMatch=0 requires the object not to exist
+	if match := r.URL.Query().Get("ifGenerationMatch"); match != "" {
+		if strconv.FormatInt(f.objects[attrs.Name].generation, 10) != match {
+			writeError(w, http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	f.generations++
+	object := fakeObject{
+		content:      content,
+		storageClass: attrs.StorageClass,
+		metadata:     attrs.Metadata,
+		updated:      time.Now(),
+		generation:   f.generations,
+	}
+	f.objects[attrs.Name] = object
+	writeObject(w, attrs.Name, object)
+}
+
+func writeObject(w http.ResponseWriter, name string, object fakeObject) {
+	sum := md5.Sum(object.content)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"kind":         "storage#object",
+		"bucket":       testBucket,
+		"name":         name,
+		"generation":   strconv.FormatInt(object.generation, 10),
+		"size":         strconv.Itoa(len(object.content)),
+		"md5Hash":      base64.StdEncoding.EncodeToString(sum[:]),
+		"storageClass": object.storageClass,
+		"metadata":     object.metadata,
+		"updated":      object.updated.UTC().Format(time.RFC3339Nano),
+	})
+}
+
+func writeError(w http.ResponseWriter, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{"code": code, "message": http.StatusText(code)},
+	})
+}
+
+func newTestRepository(t *testing.T) (backup.RemoteFilesRepository, *fakeGCS) {
+	t.Helper()
+	fake := &fakeGCS{objects: map[string]fakeObject{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	// The same options the service provider uses for a custom endpoint
+	client, err := storage.NewClient(context.Background(),
+		option.WithEndpoint(server.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return NewRepository(Config{Bucket: testBucket, Endpoint: server.URL + "/storage/v1/"}, client), fake
+}
+
+func TestRepository(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "glacier-gcs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := []byte("content of the photo")
+	localPath := filepath.Join(tmpDir, "beach.jpg")
+	err = ioutil.WriteFile(localPath, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = os.Chtimes(localPath, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum(content)
+
+	t.Run("should upload the files to the archive storage class with their modification time", func(t *testing.T) {
+		repo, fake := newTestRepository(t)
+
+		err := repo.PutGlacier(ctx, "/photos/beach.jpg", "")
+		if err == nil {
+			t.Fatal("expected an error uploading a file that does not exist")
+		}
+
+		err = repo.PutGlacier(ctx, localPath, "/photos/beach.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		object, ok := fake.objects["photos/beach.jpg"]
+		if !ok {
+			t.Fatalf("object not uploaded: %v", fake.objects)
+		}
+		if object.storageClass != archiveStorageClass || string(object.content) != string(content) {
+			t.Errorf("unexpected object %+v", object)
+		}
+		if object.metadata[backup.ModTimeMetadataKey] != strconv.FormatInt(modTime.Unix(), 10) {
+			t.Errorf("unexpected metadata %v", object.metadata)
+		}
+
+		info, err := repo.Head(ctx, "/photos/beach.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := backup.ObjectInfo{Size: int64(len(content)), ModTime: modTime, Available: true, MD5: hex.EncodeToString(sum[:])}
+		if info != want {
+			t.Errorf("Head returned %+v, want %+v", info, want)
+		}
+	})
+
+	t.Run("should upload the editable files to the standard storage class", func(t *testing.T) {
+		repo, fake := newTestRepository(t)
+
+		err := repo.PutEditable(ctx, localPath, "backup.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fake.objects["backup.db"].storageClass != standardStorageClass {
+			t.Errorf("unexpected storage class %v", fake.objects["backup.db"].storageClass)
+		}
+
+		got, err := repo.Get(ctx, "backup.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(content) {
+			t.Errorf("Get returned %q", got)
+		}
+	})
+
+	t.Run("should download the archived files without restoring them", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+
+		err := repo.PutGlacier(ctx, localPath, "/photos/beach.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.Restore(ctx, "/photos/beach.jpg", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		downloaded := filepath.Join(tmpDir, "downloaded.jpg")
+		err = repo.Download(ctx, "/photos/beach.jpg", downloaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(downloaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(content) {
+			t.Errorf("downloaded %q", got)
+		}
+	})
+
+	t.Run("should report the missing objects as not found", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+
+		var notFound backup.FileNotFoundError
+		_, err := repo.Head(ctx, "/photos/missing.jpg")
+		if !errors.As(err, &notFound) {
+			t.Errorf("Head returned %v", err)
+		}
+		_, err = repo.Get(ctx, "/photos/missing.jpg")
+		if !errors.As(err, &notFound) {
+			t.Errorf("Get returned %v", err)
+		}
+		err = repo.Download(ctx, "/photos/missing.jpg", filepath.Join(tmpDir, "missing.jpg"))
+		if !errors.As(err, &notFound) {
+			t.Errorf("Download returned %v", err)
+		}
+		err = repo.Delete(ctx, "/photos/missing.jpg")
+		if !errors.As(err, &notFound) {
+			t.Errorf("Delete returned %v", err)
+		}
+	})
+
+	t.Run("should delete the objects", func(t *testing.T) {
+		repo, fake := newTestRepository(t)
+
+		err := repo.PutGlacier(ctx, localPath, "/photos/beach.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.Delete(ctx, "/photos/beach.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fake.objects) != 0 {
+			t.Errorf("objects not deleted: %v", fake.objects)
+		}
+	})
+}
+
+func TestRepository_PutIfMatch(t *testing.T) {
+	ctx := context.Background()
+	const key = "backup.db.lock"
+
+	t.Run("should create the object only if it does not exist", func(t *testing.T) {
+		r, _ := newTestRepository(t)
+		repo := r.(backup.ConditionalWriter)
+
+		version, err := repo.PutIfMatch(ctx, key, []byte("first"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = repo.PutIfMatch(ctx, key, []byte("second"), "")
+		if !errors.Is(err, backup.ErrObjectModified) {
+			t.Errorf("got error %v, want %v", err, backup.ErrObjectModified)
+		}
+
+		content, current, err := repo.GetVersioned(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "first" || current != version {
+			t.Errorf("got %q with version %v, want %q with version %v", content, current, "first", version)
+		}
+	})
+
+	t.Run("should replace the object only if it has the expected generation", func(t *testing.T) {
+		r, fake := newTestRepository(t)
+		repo := r.(backup.ConditionalWriter)
+
+		first, err := repo.PutIfMatch(ctx, key, []byte("first"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := repo.PutIfMatch(ctx, key, []byte("second"), first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second == first {
+			t.Errorf("the generation has not changed")
+		}
+		_, err = repo.PutIfMatch(ctx, key, []byte("third"), first)
+		if !errors.Is(err, backup.ErrObjectModified) {
+			t.Errorf("got error %v, want %v", err, backup.ErrObjectModified)
+		}
+		if string(fake.objects[key].content) != "second" || fake.objects[key].storageClass != standardStorageClass {
+			t.Errorf("unexpected object %+v", fake.objects[key])
+		}
+	})
+
+	t.Run("should report the missing objects as not found", func(t *testing.T) {
+		r, _ := newTestRepository(t)
+
+		var notFound backup.FileNotFoundError
+		_, _, err := r.(backup.ConditionalWriter).GetVersioned(ctx, key)
+		if !errors.As(err, &notFound) {
+			t.Errorf("GetVersioned returned %v", err)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package local
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+const (
+	guardSuffix = ".guard"
+	// guardTimeout is the age of a guard file left by a run that crashed while replacing the object
+	guardTimeout = 10 * time.Second
+	guardRetry   = 50 * time.Millisecond
+)
+
+// GetVersioned returns the content of the object, versioned by its hash
+func (r repository) GetVersioned(_ context.Context, key string) ([]byte, string, error) {
+	content, err := os.ReadFile(r.getPath(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, "", backup.NewFileNotFoundError(key)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return content, contentVersion(content), nil
+}
+
+// PutIfMatch creates the object with O_EXCL, or replaces it holding a guard file created with O_EXCL, so two runs
+// cannot replace the same version
+func (r repository) PutIfMatch(ctx context.Context, key string, content []byte, version string) (string, error) {
+	path := r.getPath(key)
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	if version == "" {
+		return createExclusive(path, content)
+	}
+
+	release, err := acquireGuard(ctx, path+guardSuffix)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	current, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", backup.ErrObjectModified
+	}
+	if err != nil {
+		return "", err
+	}
+	if contentVersion(current) != version {
+		return "", backup.ErrObjectModified
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return "", err
+	}
+	return contentVersion(content), nil
+}
+
+func createExclusive(path string, content []byte) (string, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		return "", backup.ErrObjectModified
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return "", err
+	}
+	return contentVersion(content), nil
+}
+
+// acquireGuard waits until the guard file can be created and returns the function removing it. Guards older than
+// guardTimeout are removed
+func acquireGuard(ctx context.Context, path string) (func(), error) {
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_ = file.Close()
+			return func() { _ = os.Remove(path) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+
+		info, err := os.Stat(path)
+		if err == nil && time.Since(info.ModTime()) > guardTimeout {
+			_ = os.Remove(path)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("error waiting for %v: %w", path, ctx.Err())
+		case <-time.After(guardRetry):
+		}
+	}
+}
+
+func contentVersion(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
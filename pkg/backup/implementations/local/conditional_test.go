@@ -0,0 +1,177 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+func TestRepository_PutIfMatch(t *testing.T) {
+	ctx := context.Background()
+	const key = "backup.db.lock"
+
+	t.Run("should create the object only if it does not exist", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+
+		version, err := repo.PutIfMatch(ctx, key, []byte("first"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = repo.PutIfMatch(ctx, key, []byte("second"), "")
+		if !errors.Is(err, backup.ErrObjectModified) {
+			t.Errorf("got error %v, want %v", err, backup.ErrObjectModified)
+		}
+
+		content, current, err := repo.GetVersioned(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "first" || current != version {
+			t.Errorf("got %q with version %v, want %q with version %v", content, current, "first", version)
+		}
+	})
+
+	t.Run("should replace the object only if it has the expected version", func(t *testing.T) {
+		repo, root := newTestRepository(t)
+
+		first, err := repo.PutIfMatch(ctx, key, []byte("first"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := repo.PutIfMatch(ctx, key, []byte("second"), first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second == first {
+			t.Errorf("the version has not changed")
+		}
+		_, err = repo.PutIfMatch(ctx, key, []byte("third"), first)
+		if !errors.Is(err, backup.ErrObjectModified) {
+			t.Errorf("got error %v, want %v", err, backup.ErrObjectModified)
+		}
+
+		content, _, err := repo.GetVersioned(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "second" {
+			t.Errorf("got %q, want %q", content, "second")
+		}
+		// Neither the guard nor the temporary files are left
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("unexpected files %v", entries)
+		}
+	})
+
+	t.Run("should not replace a deleted object", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+
+		version, err := repo.PutIfMatch(ctx, key, []byte("first"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.Delete(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = repo.PutIfMatch(ctx, key, []byte("second"), version)
+		if !errors.Is(err, backup.ErrObjectModified) {
+			t.Errorf("got error %v, want %v", err, backup.ErrObjectModified)
+		}
+		_, _, err = repo.GetVersioned(ctx, key)
+		var notFound backup.FileNotFoundError
+		if !errors.As(err, &notFound) {
+			t.Errorf("got error %v, want not found", err)
+		}
+	})
+
+	t.Run("should let only one of the concurrent writers replace a version", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+
+		version, err := repo.PutIfMatch(ctx, key, []byte("first"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const writers = 10
+		var wg sync.WaitGroup
+		errs := make(chan error, writers)
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := repo.PutIfMatch(ctx, key, []byte{byte('a' + i)}, version)
+				errs <- err
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+
+		replaced := 0
+		for err := range errs {
+			if err == nil {
+				replaced++
+			} else if !errors.Is(err, backup.ErrObjectModified) {
+				t.Errorf("unexpected error %v", err)
+			}
+		}
+		if replaced != 1 {
+			t.Errorf("the version has been replaced %v times", replaced)
+		}
+	})
+
+	t.Run("should remove the guard left by a run that crashed", func(t *testing.T) {
+		repo, root := newTestRepository(t)
+
+		version, err := repo.PutIfMatch(ctx, key, []byte("first"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		guard := filepath.Join(root, key+guardSuffix)
+		err = ioutil.WriteFile(guard, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-2 * guardTimeout)
+		err = os.Chtimes(guard, old, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = repo.PutIfMatch(ctx, key, []byte("second"), version)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("should stop waiting for the guard of another run when the context is done", func(t *testing.T) {
+		repo, root := newTestRepository(t)
+
+		version, err := repo.PutIfMatch(ctx, key, []byte("first"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(root, key+guardSuffix), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, 3*guardRetry)
+		defer cancel()
+		_, err = repo.PutIfMatch(timeoutCtx, key, []byte("second"), version)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
@@ -3,25 +3,32 @@ package local
 import (
 	"fmt"
 	"os"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
 )
 
 type Config struct {
-	DestinationPath string
+	DestinationPath string `yaml:"localPath"`
 }
 
 const (
 	destinationPathKey = "GLACIER_BACKUP_LOCAL_DESTINATION_PATH"
 )
 
-var requiredVariables = []string{destinationPathKey}
+// NewConfig decodes the customConfig block of the local remote. Environment variables override its values
+func NewConfig(customConfig backup.CustomConfig) (Config, error) {
+	cfg := Config{}
+	err := customConfig.Decode(&cfg)
+	if err != nil {
+		return Config{}, fmt.Errorf("error decoding local configuration: %w", err)
+	}
+
+	if v := os.Getenv(destinationPathKey); v != "" {
+		cfg.DestinationPath = v
+	}
 
-func NewConfig() (Config, error) {
-	for _, v := range requiredVariables {
-		if os.Getenv(v) == "" {
-			return Config{}, fmt.Errorf("environment variable %s must be set", v)
-		}
+	if cfg.DestinationPath == "" {
+		return Config{}, fmt.Errorf("localPath or environment variable %s must be set", destinationPathKey)
 	}
-	return Config{
-		DestinationPath: os.Getenv(destinationPathKey),
-	}, nil
+	return cfg, nil
 }
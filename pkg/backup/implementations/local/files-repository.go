@@ -2,11 +2,18 @@ package local
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"github.com/closmarfer/glacier-backup/pkg/backup/internal/ctxio"
 )
 
 type repository struct {
@@ -18,12 +25,47 @@ func NewRepository(cfg Config) (backup.RemoteFilesRepository, error) {
 	return repository{destinationPath: cfg.DestinationPath, separator: string(os.PathSeparator)}, nil
 }
 
-func (r repository) Download(_ context.Context, key string, path string) error {
-	file, err := os.ReadFile(r.destinationPath + r.separator + key)
+func (r repository) Download(ctx context.Context, key string, path string) error {
+	return r.copy(ctx, r.getPath(key), path, 0600)
+}
+
+func (r repository) Head(_ context.Context, remotePath string) (backup.ObjectInfo, error) {
+	info, err := os.Stat(r.getPath(remotePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return backup.ObjectInfo{}, backup.NewFileNotFoundError(remotePath)
+	}
 	if err != nil {
-		return err
+		return backup.ObjectInfo{}, err
 	}
-	return os.WriteFile(path, file, 0600)
+	return backup.ObjectInfo{
+		Size:      info.Size(),
+		ModTime:   info.ModTime().UTC(),
+		Available: true,
+	}, nil
+}
+
+func (r repository) SHA256(ctx context.Context, remotePath string) (string, error) {
+	file, err := os.Open(r.getPath(remotePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", backup.NewFileNotFoundError(remotePath)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, ctxio.NewReader(ctx, file))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Restore does nothing because local files are never archived
+func (r repository) Restore(ctx context.Context, remotePath string, _ int) error {
+	_, err := r.Head(ctx, remotePath)
+	return err
 }
 
 func (r repository) Delete(_ context.Context, remotePath string) error {
@@ -31,36 +73,72 @@ func (r repository) Delete(_ context.Context, remotePath string) error {
 	return os.Remove(newPath)
 }
 
-func (r repository) PutGlacier(ctx context.Context, localPath string) error {
-	return r.put(ctx, localPath, localPath)
+func (r repository) PutGlacier(ctx context.Context, localPath string, remotePath string) error {
+	return r.put(ctx, localPath, remotePath)
 }
 
-func (r repository) PutEditable(_ context.Context, localPath string, remotePath string) error {
-	fileContents, err := os.ReadFile(localPath)
+func (r repository) PutEditable(ctx context.Context, localPath string, remotePath string) error {
+	return r.copy(ctx, localPath, r.getPath(remotePath), 0644)
+}
+
+func (r repository) put(ctx context.Context, localPath string, remotePath string) error {
+	newPath := r.getPath(remotePath)
+
+	parts := strings.Split(newPath, r.separator)
+
+	parts2 := parts[0 : len(parts)-1]
+
+	newPath2 := strings.Join(parts2, r.separator)
+
+	err := os.MkdirAll(newPath2, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = r.copy(ctx, localPath, newPath, 0644)
+	if err != nil {
+		return err
+	}
+
+	// The modification time is kept so restored files get their original one
+	info, err := os.Stat(localPath)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(r.destinationPath+r.separator+remotePath, fileContents, os.ModePerm)
+	return os.Chtimes(newPath, info.ModTime(), info.ModTime())
 }
 
-func (r repository) put(_ context.Context, localPath string, remotePath string) error {
-	fileContents, err := os.ReadFile(localPath)
+// copy streams the file into a temporary file renamed once it is complete,
+// so a canceled copy never leaves a truncated file in the destination
+func (r repository) copy(ctx context.Context, source string, destination string, perm os.FileMode) error {
+	src, err := os.Open(source)
 	if err != nil {
 		return err
 	}
-	newPath := r.getPath(remotePath)
+	defer src.Close()
 
-	parts := strings.Split(newPath, r.separator)
+	tmp, err := os.CreateTemp(filepath.Dir(destination), "."+filepath.Base(destination)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
 
-	parts2 := parts[0 : len(parts)-1]
+	_, err = io.Copy(tmp, ctxio.NewReader(ctx, backup.LimitReader(ctx, src)))
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
 
-	newPath2 := strings.Join(parts2, r.separator)
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
 
-	err = os.MkdirAll(newPath2, os.ModePerm)
+	err = os.Chmod(tmp.Name(), perm)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(newPath, fileContents, os.ModePerm)
+
+	return os.Rename(tmp.Name(), destination)
 }
 
 // cleanPath it prevents error on Windows systems
@@ -0,0 +1,125 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestRepository(t *testing.T) (repository, string) {
+	t.Helper()
+	tmpDir, err := ioutil.TempDir("", "glacier-local-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	return repository{destinationPath: tmpDir, separator: string(os.PathSeparator)}, tmpDir
+}
+
+func TestRepository_copy(t *testing.T) {
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("content"), 100000)
+	modTime := time.Date(2020, 8, 1, 10, 0, 0, 0, time.UTC)
+
+	writeLocalFile := func(t *testing.T) string {
+		t.Helper()
+		tmpDir, err := ioutil.TempDir("", "glacier-local-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+		path := filepath.Join(tmpDir, "beach.jpg")
+		err = ioutil.WriteFile(path, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("should copy the file with its modification time and download it", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+		localPath := writeLocalFile(t)
+
+		err := repo.PutGlacier(ctx, localPath, "/photos/beach.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := repo.Head(ctx, "/photos/beach.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(len(content)) || !info.ModTime.Equal(modTime) {
+			t.Errorf("got %v bytes modified at %v, want %v bytes modified at %v", info.Size, info.ModTime, len(content), modTime)
+		}
+
+		downloaded := filepath.Join(filepath.Dir(localPath), "restored.jpg")
+		err = repo.Download(ctx, "/photos/beach.jpg", downloaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(downloaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("got %v bytes, want the uploaded %v", len(got), len(content))
+		}
+	})
+
+	t.Run("should not leave any file when the copy is canceled", func(t *testing.T) {
+		repo, root := newTestRepository(t)
+		localPath := writeLocalFile(t)
+
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		err := repo.PutEditable(ctx, localPath, "backup.db")
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got error %v, want %v", err, context.Canceled)
+		}
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("got %v files in the remote, want none", len(entries))
+		}
+	})
+
+	t.Run("should keep the previous object when the copy is canceled", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+		localPath := writeLocalFile(t)
+
+		err := repo.PutEditable(ctx, localPath, "backup.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(localPath, []byte("new database"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		err = repo.PutEditable(ctx, localPath, "backup.db")
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got error %v, want %v", err, context.Canceled)
+		}
+		got, err := ioutil.ReadFile(repo.getPath("backup.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("the previous object has been modified")
+		}
+	})
+}
@@ -3,31 +3,164 @@ package s3
 import (
 	"fmt"
 	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/closmarfer/glacier-backup/pkg/backup"
 )
 
 type Config struct {
-	Bucket      string
-	Region      string
-	ProfileName string
+	Bucket      string `yaml:"bucket"`
+	Region      string `yaml:"region"`
+	ProfileName string `yaml:"profileName"`
+	// RestoreTier is the retrieval tier used to restore archived objects: Bulk, Standard or Expedited
+	RestoreTier string `yaml:"restoreTier"`
+	// Files bigger than MultipartThresholdMB are uploaded in parts of PartSizeMB,
+	// sending PartConcurrency parts at the same time
+	MultipartThresholdMB int64 `yaml:"multipartThresholdMB"`
+	PartSizeMB           int64 `yaml:"partSizeMB"`
+	PartConcurrency      int   `yaml:"partConcurrency"`
+	// Endpoint replaces the AWS endpoint to use an S3-compatible store such as MinIO, Wasabi, Backblaze B2 or Ceph.
+	// Most of them require UsePathStyle, which puts the bucket in the path instead of the host name
+	Endpoint     string `yaml:"endpoint"`
+	UsePathStyle bool   `yaml:"usePathStyle"`
+	// CABundle is a PEM file with the certificates trusted to connect to the endpoint, e.g. a self-signed one
+	CABundle       string               `yaml:"caBundle"`
+	StorageClasses StorageClassesConfig `yaml:"storageClasses"`
+}
+
+// StorageClassesConfig maps the archived and editable objects to the storage classes supported by the store.
+// DEEP_ARCHIVE is only available in AWS
+type StorageClassesConfig struct {
+	Glacier  string `yaml:"glacier"`
+	Editable string `yaml:"editable"`
 }
 
 const (
 	bucketsKey = "GLACIER_BACKUP_S3_BUCKETS"
 	regionKey  = "GLACIER_BACKUP_S3_REGION"
 	profileKey = "GLACIER_BACKUP_S3_PROFILE"
+	// restoreTierKey is optional, Bulk is the cheapest tier available for Deep Archive
+	restoreTierKey = "GLACIER_BACKUP_S3_RESTORE_TIER"
+
+	multipartThresholdKey = "GLACIER_BACKUP_S3_MULTIPART_THRESHOLD_MB"
+	partSizeKey           = "GLACIER_BACKUP_S3_PART_SIZE_MB"
+	partConcurrencyKey    = "GLACIER_BACKUP_S3_PART_CONCURRENCY"
+
+	endpointKey             = "GLACIER_BACKUP_S3_ENDPOINT"
+	usePathStyleKey         = "GLACIER_BACKUP_S3_USE_PATH_STYLE"
+	caBundleKey             = "GLACIER_BACKUP_S3_CA_BUNDLE"
+	glacierStorageClassKey  = "GLACIER_BACKUP_S3_GLACIER_STORAGE_CLASS"
+	editableStorageClassKey = "GLACIER_BACKUP_S3_EDITABLE_STORAGE_CLASS"
 )
 
-var requiredVariables = []string{bucketsKey, regionKey, profileKey}
+const (
+	defaultRestoreTier          = "Bulk"
+	defaultMultipartThresholdMB = 100
+	defaultPartSizeMB           = 64
+	defaultPartConcurrency      = 4
+	// minPartSizeMB is the minimum size of a part accepted by S3
+	minPartSizeMB = 5
+	megabyte      = 1024 * 1024
+)
+
+// NewConfig decodes the customConfig block of the s3 remote. Environment variables override its values
+func NewConfig(customConfig backup.CustomConfig) (Config, error) {
+	cfg := Config{
+		RestoreTier:          defaultRestoreTier,
+		MultipartThresholdMB: defaultMultipartThresholdMB,
+		PartSizeMB:           defaultPartSizeMB,
+		PartConcurrency:      defaultPartConcurrency,
+		StorageClasses: StorageClassesConfig{
+			Glacier:  string(types.StorageClassDeepArchive),
+			Editable: string(types.StorageClassStandard),
+		},
+	}
+	err := customConfig.Decode(&cfg)
+	if err != nil {
+		return Config{}, fmt.Errorf("error decoding s3 configuration: %w", err)
+	}
+
+	overrides := map[string]*string{
+		bucketsKey:     &cfg.Bucket,
+		regionKey:      &cfg.Region,
+		profileKey:     &cfg.ProfileName,
+		restoreTierKey: &cfg.RestoreTier,
+
+		endpointKey:             &cfg.Endpoint,
+		caBundleKey:             &cfg.CABundle,
+		glacierStorageClassKey:  &cfg.StorageClasses.Glacier,
+		editableStorageClassKey: &cfg.StorageClasses.Editable,
+	}
+	for key, value := range overrides {
+		if v := os.Getenv(key); v != "" {
+			*value = v
+		}
+	}
+
+	numericOverrides := map[string]*int64{
+		multipartThresholdKey: &cfg.MultipartThresholdMB,
+		partSizeKey:           &cfg.PartSizeMB,
+	}
+	for key, value := range numericOverrides {
+		if v := os.Getenv(key); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return Config{}, fmt.Errorf("environment variable %s must be a number: %w", key, err)
+			}
+			*value = n
+		}
+	}
+	if v := os.Getenv(partConcurrencyKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("environment variable %s must be a number: %w", partConcurrencyKey, err)
+		}
+		cfg.PartConcurrency = n
+	}
+	if v := os.Getenv(usePathStyleKey); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("environment variable %s must be true or false: %w", usePathStyleKey, err)
+		}
+		cfg.UsePathStyle = b
+	}
+
+	if cfg.PartSizeMB < minPartSizeMB {
+		return Config{}, fmt.Errorf("partSizeMB must be at least %d", minPartSizeMB)
+	}
+	if cfg.PartConcurrency < 1 {
+		return Config{}, fmt.Errorf("partConcurrency must be at least 1")
+	}
+	if cfg.StorageClasses.Glacier == "" || cfg.StorageClasses.Editable == "" {
+		return Config{}, fmt.Errorf("storageClasses.glacier and storageClasses.editable cannot be empty")
+	}
 
-func NewConfig() (Config, error) {
-	for _, v := range requiredVariables {
-		if os.Getenv(v) == "" {
-			return Config{}, fmt.Errorf("environment variable %s must be set", v)
+	required := []struct {
+		field string
+		key   string
+	}{
+		{"bucket", bucketsKey},
+		{"region", regionKey},
+		{"profileName", profileKey},
+	}
+	for _, r := range required {
+		// S3-compatible stores usually take the credentials from the environment instead of a profile
+		if r.key == profileKey && cfg.Endpoint != "" {
+			continue
+		}
+		if *overrides[r.key] == "" {
+			return Config{}, fmt.Errorf("%v or environment variable %s must be set", r.field, r.key)
 		}
 	}
-	return Config{
-		Bucket:      os.Getenv(bucketsKey),
-		Region:      os.Getenv(regionKey),
-		ProfileName: os.Getenv(profileKey),
-	}, nil
+
+	return cfg, nil
+}
+
+func (c Config) multipartThreshold() int64 {
+	return c.MultipartThresholdMB * megabyte
+}
+
+func (c Config) partSize() int64 {
+	return c.PartSizeMB * megabyte
 }
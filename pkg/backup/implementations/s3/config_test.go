@@ -0,0 +1,183 @@
+package s3
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"gopkg.in/yaml.v3"
+)
+
+func decodeCustomConfig(t *testing.T, content string) backup.CustomConfig {
+	t.Helper()
+	var customConfig backup.CustomConfig
+	err := yaml.Unmarshal([]byte(content), &customConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return customConfig
+}
+
+func TestNewConfig(t *testing.T) {
+	defaults := Config{
+		Bucket:               "my-bucket",
+		Region:               "eu-west-1",
+		ProfileName:          "default",
+		RestoreTier:          defaultRestoreTier,
+		MultipartThresholdMB: defaultMultipartThresholdMB,
+		PartSizeMB:           defaultPartSizeMB,
+		PartConcurrency:      defaultPartConcurrency,
+		StorageClasses:       StorageClassesConfig{Glacier: "DEEP_ARCHIVE", Editable: "STANDARD"},
+	}
+	required := "bucket: my-bucket\nregion: eu-west-1\nprofileName: default\n"
+
+	tests := []struct {
+		name   string
+		config string
+		env    map[string]string
+		want   func(cfg *Config)
+	}{
+		{
+			name:   "should use the default values",
+			config: required,
+			want:   func(cfg *Config) {},
+		},
+		{
+			name:   "should replace the storage classes",
+			config: required + "storageClasses:\n  glacier: GLACIER_IR\n  editable: STANDARD_IA\n",
+			want: func(cfg *Config) {
+				cfg.StorageClasses = StorageClassesConfig{Glacier: "GLACIER_IR", Editable: "STANDARD_IA"}
+			},
+		},
+		{
+			name:   "should keep the default storage class that is not replaced",
+			config: required + "storageClasses:\n  glacier: STANDARD\n",
+			want: func(cfg *Config) {
+				cfg.StorageClasses.Glacier = "STANDARD"
+			},
+		},
+		{
+			name:   "should replace the storage classes with the environment variables",
+			config: required + "storageClasses:\n  glacier: GLACIER_IR\n",
+			env:    map[string]string{glacierStorageClassKey: "STANDARD", editableStorageClassKey: "REDUCED_REDUNDANCY"},
+			want: func(cfg *Config) {
+				cfg.StorageClasses = StorageClassesConfig{Glacier: "STANDARD", Editable: "REDUCED_REDUNDANCY"}
+			},
+		},
+		{
+			name:   "should not require a profile with an endpoint",
+			config: "bucket: my-bucket\nregion: us-east-1\nendpoint: http://localhost:9000\nusePathStyle: true\n",
+			want: func(cfg *Config) {
+				cfg.Region = "us-east-1"
+				cfg.ProfileName = ""
+				cfg.Endpoint = "http://localhost:9000"
+				cfg.UsePathStyle = true
+			},
+		},
+		{
+			name:   "should take the endpoint and the path style from the environment variables",
+			config: "bucket: my-bucket\nregion: eu-west-1\n",
+			env:    map[string]string{endpointKey: "http://localhost:9000", usePathStyleKey: "true"},
+			want: func(cfg *Config) {
+				cfg.ProfileName = ""
+				cfg.Endpoint = "http://localhost:9000"
+				cfg.UsePathStyle = true
+			},
+		},
+		{
+			name:   "should replace the multipart options",
+			config: required + "multipartThresholdMB: 10\npartSizeMB: 5\n",
+			env:    map[string]string{partConcurrencyKey: "2"},
+			want: func(cfg *Config) {
+				cfg.MultipartThresholdMB = 10
+				cfg.PartSizeMB = 5
+				cfg.PartConcurrency = 2
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, err := NewConfig(decodeCustomConfig(t, tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := defaults
+			tt.want(&want)
+			if cfg != want {
+				t.Errorf("got %+v, want %+v", cfg, want)
+			}
+		})
+	}
+}
+
+func TestNewConfig_invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		env    map[string]string
+		error  string
+	}{
+		{
+			name:   "should fail without a bucket",
+			config: "region: eu-west-1\nprofileName: default\n",
+			error:  "bucket or environment variable " + bucketsKey,
+		},
+		{
+			name:   "should fail without a profile for AWS",
+			config: "bucket: my-bucket\nregion: eu-west-1\n",
+			error:  "profileName or environment variable " + profileKey,
+		},
+		{
+			name:   "should fail with an empty storage class",
+			config: "bucket: my-bucket\nregion: eu-west-1\nprofileName: default\nstorageClasses:\n  glacier: \"\"\n",
+			error:  "storageClasses.glacier and storageClasses.editable cannot be empty",
+		},
+		{
+			name:   "should fail with parts smaller than the S3 minimum",
+			config: "bucket: my-bucket\nregion: eu-west-1\nprofileName: default\npartSizeMB: 4\n",
+			error:  "partSizeMB must be at least 5",
+		},
+		{
+			name:   "should fail with a path style that is not a boolean",
+			config: "bucket: my-bucket\nregion: eu-west-1\nprofileName: default\n",
+			env:    map[string]string{usePathStyleKey: "yes please"},
+			error:  "environment variable " + usePathStyleKey + " must be true or false",
+		},
+		{
+			name:   "should fail with a wrong type",
+			config: "bucket: my-bucket\nregion: eu-west-1\nprofileName: default\nstorageClasses: DEEP_ARCHIVE\n",
+			error:  "error decoding s3 configuration",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			_, err := NewConfig(decodeCustomConfig(t, tt.config))
+			if err == nil || !strings.Contains(err.Error(), tt.error) {
+				t.Errorf("got error %v, want %q", err, tt.error)
+			}
+		})
+	}
+}
+
+// clearEnv removes the overrides of the environment running the tests
+func clearEnv(t *testing.T) {
+	t.Helper()
+	keys := []string{
+		bucketsKey, regionKey, profileKey, restoreTierKey,
+		multipartThresholdKey, partSizeKey, partConcurrencyKey,
+		endpointKey, usePathStyleKey, caBundleKey, glacierStorageClassKey, editableStorageClassKey,
+	}
+	for _, key := range keys {
+		t.Setenv(key, "")
+	}
+}
@@ -3,21 +3,45 @@ package s3
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	http2 "net/http"
 	"os"
-	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 	"github.com/closmarfer/glacier-backup/pkg/backup"
 )
 
+const abortTimeout = 30 * time.Second
+
+// storagePolicy is the minimum storage duration and the price of an AWS storage class
+type storagePolicy struct {
+	minStorageDays  int
+	pricePerGBMonth float64
+}
+
+// storagePolicies contains the classes billing a minimum storage duration. The prices are the ones of us-east-1
+var storagePolicies = map[types.StorageClass]storagePolicy{
+	types.StorageClassDeepArchive: {minStorageDays: 180, pricePerGBMonth: 0.00099},
+	types.StorageClassGlacier:     {minStorageDays: 90, pricePerGBMonth: 0.0036},
+	types.StorageClassGlacierIr:   {minStorageDays: 90, pricePerGBMonth: 0.004},
+	types.StorageClassStandardIa:  {minStorageDays: 30, pricePerGBMonth: 0.0125},
+	types.StorageClassOnezoneIa:   {minStorageDays: 30, pricePerGBMonth: 0.01},
+}
+
 type repository struct {
 	config Config
 	client *s3.Client
@@ -40,35 +64,231 @@ func NewS3Repository(config Config, client *s3.Client) backup.RemoteFilesReposit
 	return repository{config: config, client: client}
 }
 
-func (repo repository) PutGlacier(ctx context.Context, localPath string) error {
-	return repo.put(ctx, localPath, localPath, types.StorageClassDeepArchive)
+// MinStorageDays is the minimum storage duration billed for the storage class of the archived objects
+func (repo repository) MinStorageDays() int {
+	return storagePolicies[repo.glacierStorageClass()].minStorageDays
+}
+
+// PricePerGBMonth is the price of the storage class of the archived objects, used to estimate early deletion charges
+func (repo repository) PricePerGBMonth() float64 {
+	return storagePolicies[repo.glacierStorageClass()].pricePerGBMonth
+}
+
+func (repo repository) PutGlacier(ctx context.Context, localPath string, remotePath string) error {
+	_, err := repo.put(ctx, localPath, remotePath, repo.glacierStorageClass())
+	return err
+}
+
+// PutGlacierChecksum returns the SHA-256 validated by S3. The ones of multipart uploads are computed from the ones
+// of the parts, so the whole file is hashed before uploading them
+func (repo repository) PutGlacierChecksum(ctx context.Context, localPath string, remotePath string) (string, error) {
+	return repo.put(ctx, localPath, remotePath, repo.glacierStorageClass())
 }
 
 func (repo repository) PutEditable(ctx context.Context, localPath string, remotePath string) error {
-	return repo.put(ctx, localPath, remotePath, types.StorageClassStandard)
+	_, err := repo.put(ctx, localPath, remotePath, types.StorageClass(repo.config.StorageClasses.Editable))
+	return err
 }
 
-func (repo repository) put(ctx context.Context, localPath string, remotePath string, s types.StorageClass) error {
-	if string(remotePath[0]) == "/" {
-		remotePath = remotePath[1:]
+func (repo repository) glacierStorageClass() types.StorageClass {
+	return types.StorageClass(repo.config.StorageClasses.Glacier)
+}
+
+// put sends the SHA-256 of the content, so S3 rejects the upload if it does not match the received content
+func (repo repository) put(ctx context.Context, localPath string, remotePath string, s types.StorageClass) (string, error) {
+	remotePath = backup.ObjectKey(remotePath)
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return "", fmt.Errorf("error reading file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("error reading file info: %w", err)
+	}
+
+	input := &s3.PutObjectInput{
+		ACL:               types.ObjectCannedACLPrivate,
+		Bucket:            aws.String(repo.config.Bucket),
+		Key:               aws.String(remotePath),
+		Body:              backup.LimitReader(ctx, file),
+		StorageClass:      s,
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+		Metadata: map[string]string{
+			backup.ModTimeMetadataKey: strconv.FormatInt(info.ModTime().Unix(), 10),
+		},
+	}
+
+	if info.Size() < repo.config.multipartThreshold() {
+		output, err := repo.client.PutObject(ctx, input)
+		if err != nil {
+			return "", err
+		}
+		return hexChecksum(output.ChecksumSHA256), nil
+	}
+
+	// S3 validates the checksum of every part. The uploader reads the parts concurrently from the file, so the
+	// whole file is hashed in a separate pass, which does not move the offset the uploader starts reading from
+	hash := sha256.New()
+	_, err = io.Copy(hash, io.NewSectionReader(file, 0, info.Size()))
+	if err != nil {
+		return "", fmt.Errorf("error hashing file: %w", err)
+	}
+	err = repo.putMultipart(ctx, input)
+	if err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// putMultipart streams the file in parts. Uploaded parts are billed until the upload is completed
+// or aborted, so a failed upload is always aborted, even if the context has been canceled
+func (repo repository) putMultipart(ctx context.Context, input *s3.PutObjectInput) error {
+	uploader := manager.NewUploader(repo.client, func(u *manager.Uploader) {
+		u.PartSize = repo.config.partSize()
+		u.Concurrency = repo.config.PartConcurrency
+		// The uploader aborts using the upload context, which fails when it has been canceled
+		u.LeavePartsOnError = true
+	})
+
+	_, err := uploader.Upload(ctx, input)
 
-	if runtime.GOOS == "windows" {
-		remotePath = repo.cleanPath(remotePath)
+	var failure manager.MultiUploadFailure
+	if errors.As(err, &failure) {
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortTimeout)
+		defer cancel()
+
+		_, abortErr := repo.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+			Bucket:   input.Bucket,
+			Key:      input.Key,
+			UploadId: aws.String(failure.UploadID()),
+		})
+		if abortErr != nil {
+			return fmt.Errorf("%w (error aborting multipart upload %v: %v)", err, failure.UploadID(), abortErr)
+		}
 	}
 
-	content, err := os.ReadFile(localPath)
+	return err
+}
+
+// GetVersioned returns the content of the object, versioned by its ETag
+func (repo repository) GetVersioned(ctx context.Context, key string) ([]byte, string, error) {
+	object, err := repo.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(repo.config.Bucket),
+		Key:    aws.String(backup.ObjectKey(key)),
+	})
 	if err != nil {
-		return fmt.Errorf("error reading file: %w", err)
+		var responseError *awshttp.ResponseError
+		if errors.As(err, &responseError) && responseError.ResponseError.HTTPStatusCode() == http2.StatusNotFound {
+			return nil, "", backup.NewFileNotFoundError(key)
+		}
+		return nil, "", err
+	}
+	defer object.Body.Close()
+
+	content, err := io.ReadAll(object.Body)
+	if err != nil {
+		return nil, "", err
 	}
+	return content, aws.ToString(object.ETag), nil
+}
 
-	_, err = repo.client.PutObject(ctx, &s3.PutObjectInput{
+// PutIfMatch uses the conditional writes of S3, which fail if the ETag of the object is not the expected one
+func (repo repository) PutIfMatch(ctx context.Context, key string, content []byte, version string) (string, error) {
+	input := &s3.PutObjectInput{
 		ACL:          types.ObjectCannedACLPrivate,
 		Bucket:       aws.String(repo.config.Bucket),
-		Key:          aws.String(remotePath),
+		Key:          aws.String(backup.ObjectKey(key)),
 		Body:         bytes.NewReader(content),
-		StorageClass: s,
+		StorageClass: types.StorageClass(repo.config.StorageClasses.Editable),
+	}
+	if version == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(version)
+	}
+
+	output, err := repo.client.PutObject(ctx, input)
+	var apiError smithy.APIError
+	if errors.As(err, &apiError) {
+		switch apiError.ErrorCode() {
+		// The object exists or has another ETag, has been deleted, or is being written by another request
+		case "PreconditionFailed", "NoSuchKey", "ConditionalRequestConflict":
+			return "", fmt.Errorf("%w: %v", backup.ErrObjectModified, err)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.ETag), nil
+}
+
+func (repo repository) Head(ctx context.Context, remotePath string) (backup.ObjectInfo, error) {
+	object, err := repo.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(repo.config.Bucket),
+		Key:          aws.String(backup.ObjectKey(remotePath)),
+		ChecksumMode: types.ChecksumModeEnabled,
 	})
+	if err != nil {
+		var responseError *awshttp.ResponseError
+		if errors.As(err, &responseError) && responseError.ResponseError.HTTPStatusCode() == http2.StatusNotFound {
+			return backup.ObjectInfo{}, backup.NewFileNotFoundError(remotePath)
+		}
+		return backup.ObjectInfo{}, err
+	}
+
+	info := backup.ObjectInfo{
+		Size:      aws.ToInt64(object.ContentLength),
+		ModTime:   aws.ToTime(object.LastModified).UTC(),
+		Available: true,
+	}
+
+	if mtime, ok := object.Metadata[backup.ModTimeMetadataKey]; ok {
+		seconds, err := strconv.ParseInt(mtime, 10, 64)
+		if err == nil {
+			info.ModTime = time.Unix(seconds, 0).UTC()
+		}
+	}
+
+	// The checksums of multipart uploads are computed from the checksums of the parts
+	if object.ChecksumType != types.ChecksumTypeComposite {
+		info.SHA256 = hexChecksum(object.ChecksumSHA256)
+	}
+	// The ETag is the MD5 of the content, except for multipart uploads and objects encrypted with KMS or customer keys
+	etag := strings.Trim(aws.ToString(object.ETag), `"`)
+	if len(etag) == 2*md5.Size && object.ServerSideEncryption != types.ServerSideEncryptionAwsKms && object.SSECustomerAlgorithm == nil {
+		info.MD5 = etag
+	}
+
+	if object.StorageClass == types.StorageClassDeepArchive || object.StorageClass == types.StorageClassGlacier {
+		// The restore header is absent until a restore is requested and contains
+		// ongoing-request="false" once the temporary copy is ready
+		restore := aws.ToString(object.Restore)
+		info.Restoring = strings.Contains(restore, `ongoing-request="true"`)
+		info.Available = strings.Contains(restore, `ongoing-request="false"`)
+	}
+
+	return info, nil
+}
+
+func (repo repository) Restore(ctx context.Context, remotePath string, days int) error {
+	_, err := repo.client.RestoreObject(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(repo.config.Bucket),
+		Key:    aws.String(backup.ObjectKey(remotePath)),
+		RestoreRequest: &types.RestoreRequest{
+			Days: aws.Int32(int32(days)),
+			GlacierJobParameters: &types.GlacierJobParameters{
+				Tier: types.Tier(repo.config.RestoreTier),
+			},
+		},
+	})
+
+	var apiError smithy.APIError
+	if errors.As(err, &apiError) && apiError.ErrorCode() == "RestoreAlreadyInProgress" {
+		return nil
+	}
 
 	return err
 }
@@ -82,11 +302,36 @@ func (repo repository) Get(ctx context.Context, remotePath string) (string, erro
 }
 
 func (repo repository) Download(ctx context.Context, key string, path string) error {
-	buff, err := repo.getBuffer(ctx, key)
+	object, err := repo.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(repo.config.Bucket),
+		Key:    aws.String(backup.ObjectKey(key)),
+	})
+	if err != nil {
+		var responseError *awshttp.ResponseError
+		if errors.As(err, &responseError) && responseError.ResponseError.HTTPStatusCode() == http2.StatusNotFound {
+			return backup.NewFileNotFoundError(key)
+		}
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			fmt.Println("error closing body: " + err.Error())
+		}
+	}(object.Body)
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, buff.Bytes(), 0644)
+
+	_, err = io.Copy(file, object.Body)
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("error downloading %v: %w", key, err)
+	}
+
+	return file.Close()
 }
 
 func (repo repository) getBuffer(ctx context.Context, remotePath string) (*bytes.Buffer, error) {
@@ -114,7 +359,11 @@ func (repo repository) getBuffer(ctx context.Context, remotePath string) (*bytes
 	return buff, err
 }
 
-func (repo repository) cleanPath(path string) string {
-	s := strings.Replace(path, "\\", "/", -1)
-	return strings.Replace(s, ":/", "/", 1)
+// hexChecksum converts a base64 encoded SHA-256 returned by S3 to hex, it returns an empty string if it is not valid
+func hexChecksum(checksum *string) string {
+	sum, err := base64.StdEncoding.DecodeString(aws.ToString(checksum))
+	if err != nil || len(sum) != sha256.Size {
+		return ""
+	}
+	return hex.EncodeToString(sum)
 }
@@ -0,0 +1,565 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+// The credentials of the MinIO container of the README. GLACIER_BACKUP_MINIO_ENDPOINT replaces the default endpoint,
+// and AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY the credentials
+const (
+	minioEndpointKey = "GLACIER_BACKUP_MINIO_ENDPOINT"
+	minioEndpoint    = "http://127.0.0.1:9000"
+	minioAccessKey   = "minio"
+	minioSecretKey   = "minio123"
+)
+
+// newTestClient creates the client the service provider creates for the configuration, using the given credentials.
+// httpClient replaces the default one when it is not nil
+func newTestClient(t *testing.T, cfg Config, accessKey string, secretKey string, httpClient *http.Client) *s3.Client {
+	t.Helper()
+	opts := []func(*config.LoadOptions) error{
+		config.WithRegion(cfg.Region),
+		config.WithCredentialsProvider(aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: accessKey, SecretAccessKey: secretKey}, nil
+		})),
+	}
+	s3Configuration, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s3.NewFromConfig(s3Configuration, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+		o.UsePathStyle = cfg.UsePathStyle
+		if httpClient != nil {
+			o.HTTPClient = httpClient
+		}
+	})
+}
+
+func writeTestFile(t *testing.T, dir string, name string, content []byte, modTime time.Time) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+type recordedRequest struct {
+	method       string
+	host         string
+	path         string
+	storageClass string
+}
+
+// recorder accepts every request, storing the ones received
+type recorder struct {
+	mu       sync.Mutex
+	requests []recordedRequest
+}
+
+func (rec *recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.requests = append(rec.requests, recordedRequest{
+		method:       r.Method,
+		host:         r.Host,
+		path:         r.URL.Path,
+		storageClass: r.Header.Get("X-Amz-Storage-Class"),
+	})
+	w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+}
+
+func TestRepository_endpoint(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "glacier-s3-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	localPath := writeTestFile(t, tmpDir, "beach.jpg", []byte("content of the photo"), time.Now())
+
+	rec := &recorder{}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	// Every host is resolved to the server, so the bucket can be put in the host name
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}}
+
+	tests := []struct {
+		name         string
+		config       string
+		wantHost     string
+		wantPath     string
+		wantGlacier  string
+		wantEditable string
+	}{
+		{
+			name:         "should put the bucket in the path",
+			config:       "bucket: my-bucket\nregion: us-east-1\nendpoint: http://store.test\nusePathStyle: true\n",
+			wantHost:     "store.test",
+			wantPath:     "/my-bucket/photos/beach.jpg",
+			wantGlacier:  "DEEP_ARCHIVE",
+			wantEditable: "STANDARD",
+		},
+		{
+			name:         "should put the bucket in the host name",
+			config:       "bucket: my-bucket\nregion: us-east-1\nendpoint: http://store.test\n",
+			wantHost:     "my-bucket.store.test",
+			wantPath:     "/photos/beach.jpg",
+			wantGlacier:  "DEEP_ARCHIVE",
+			wantEditable: "STANDARD",
+		},
+		{
+			name: "should send the configured storage classes",
+			config: "bucket: my-bucket\nregion: us-east-1\nendpoint: http://store.test\nusePathStyle: true\n" +
+				"storageClasses:\n  glacier: STANDARD\n  editable: REDUCED_REDUNDANCY\n",
+			wantHost:     "store.test",
+			wantPath:     "/my-bucket/photos/beach.jpg",
+			wantGlacier:  "STANDARD",
+			wantEditable: "REDUCED_REDUNDANCY",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			cfg, err := NewConfig(decodeCustomConfig(t, tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo := NewS3Repository(cfg, newTestClient(t, cfg, "key", "secret", httpClient))
+			rec.requests = nil
+
+			err = repo.PutGlacier(ctx, localPath, "/photos/beach.jpg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = repo.PutEditable(ctx, localPath, "/photos/beach.jpg")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(rec.requests) != 2 {
+				t.Fatalf("unexpected requests %+v", rec.requests)
+			}
+			for i, wantClass := range []string{tt.wantGlacier, tt.wantEditable} {
+				want := recordedRequest{method: http.MethodPut, host: tt.wantHost, path: tt.wantPath, storageClass: wantClass}
+				if rec.requests[i] != want {
+					t.Errorf("got request %+v, want %+v", rec.requests[i], want)
+				}
+			}
+		})
+	}
+}
+
+// multipartServer answers the requests of a multipart upload, counting the bytes of the parts
+type multipartServer struct {
+	mu       sync.Mutex
+	parts    int
+	received int64
+	// puts counts the objects uploaded in a single request
+	puts int
+	// failParts rejects every part, and aborted records the abort of the upload
+	failParts bool
+	aborted   bool
+}
+
+func (m *multipartServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		_, _ = io.WriteString(w, `<InitiateMultipartUploadResult><Bucket>my-bucket</Bucket><Key>big.bin</Key>`+
+			`<UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		n, _ := io.Copy(io.Discard, r.Body)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.failParts {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = io.WriteString(w, `<Error><Code>InvalidPart</Code><Message>rejected</Message></Error>`)
+			return
+		}
+		m.parts++
+		m.received += n
+		w.Header().Set("ETag", `"part-`+query.Get("partNumber")+`"`)
+	case r.Method == http.MethodPut:
+		n, _ := io.Copy(io.Discard, r.Body)
+		m.mu.Lock()
+		m.puts++
+		m.received += n
+		m.mu.Unlock()
+		w.Header().Set("ETag", `"object"`)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		m.mu.Lock()
+		m.aborted = true
+		m.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		_, _ = io.WriteString(w, `<CompleteMultipartUploadResult><Bucket>my-bucket</Bucket><Key>big.bin</Key>`+
+			`<ETag>"upload-1-3"</ETag></CompleteMultipartUploadResult>`)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestRepository_multipart(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "glacier-s3-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	const partSize = 5 * 1024 * 1024
+	content := make([]byte, 3*partSize-1024)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	localPath := writeTestFile(t, tmpDir, "big.bin", content, time.Now())
+
+	srv := &multipartServer{}
+	server := httptest.NewServer(srv)
+	defer server.Close()
+
+	clearEnv(t)
+	cfg, err := NewConfig(decodeCustomConfig(t, "bucket: my-bucket\nregion: us-east-1\nendpoint: "+server.URL+
+		"\nusePathStyle: true\nmultipartThresholdMB: 5\npartSizeMB: 5\npartConcurrency: 2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewS3Repository(cfg, newTestClient(t, cfg, "key", "secret", nil)).(backup.ChecksumPutter)
+
+	for _, limited := range []bool{false, true} {
+		ctx := context.Background()
+		if limited {
+			ctx = backup.WithBandwidthLimiter(ctx, backup.NewBandwidthLimiter(backup.UploadConfig{BandwidthKBps: 1024 * 1024}))
+		}
+		srv.parts, srv.received = 0, 0
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		sum, err := repo.PutGlacierChecksum(ctx, localPath, "big.bin")
+		runtime.ReadMemStats(&after)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run(fmt.Sprintf("should upload every part, limited %v", limited), func(t *testing.T) {
+			if srv.parts != 3 || srv.received != int64(len(content)) {
+				t.Errorf("got %v parts with %v bytes, want 3 with %v", srv.parts, srv.received, len(content))
+			}
+		})
+
+		t.Run(fmt.Sprintf("should return the SHA-256 of the whole file, limited %v", limited), func(t *testing.T) {
+			want := sha256.Sum256(content)
+			if sum != hex.EncodeToString(want[:]) {
+				t.Errorf("got checksum %v, want %v", sum, hex.EncodeToString(want[:]))
+			}
+		})
+
+		// The uploader copies the parts of readers that are not files into buffers of the part size
+		t.Run(fmt.Sprintf("should read the parts from the file without buffering them, limited %v", limited), func(t *testing.T) {
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > partSize {
+				t.Errorf("allocated %v MB uploading %v MB", allocated/1024/1024, len(content)/1024/1024)
+			}
+		})
+	}
+}
+
+func TestRepository_multipartThreshold(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "glacier-s3-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srv := &multipartServer{}
+	server := httptest.NewServer(srv)
+	defer server.Close()
+
+	clearEnv(t)
+	cfg, err := NewConfig(decodeCustomConfig(t, "bucket: my-bucket\nregion: us-east-1\nendpoint: "+server.URL+
+		"\nusePathStyle: true\nmultipartThresholdMB: 5\npartSizeMB: 5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewS3Repository(cfg, newTestClient(t, cfg, "key", "secret", nil))
+
+	const threshold = 5 * 1024 * 1024
+	tests := []struct {
+		name      string
+		size      int
+		wantPuts  int
+		wantParts int
+	}{
+		{name: "should upload the files smaller than the threshold in a single request", size: threshold - 1, wantPuts: 1},
+		{name: "should upload the bigger files in parts", size: threshold + 1, wantParts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			localPath := writeTestFile(t, tmpDir, "big.bin", make([]byte, tt.size), time.Now())
+			srv.puts, srv.parts, srv.received = 0, 0, 0
+
+			err := repo.PutGlacier(context.Background(), localPath, "big.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if srv.puts != tt.wantPuts || srv.parts != tt.wantParts || srv.received != int64(tt.size) {
+				t.Errorf("got %v requests and %v parts with %v bytes, want %v and %v with %v",
+					srv.puts, srv.parts, srv.received, tt.wantPuts, tt.wantParts, tt.size)
+			}
+		})
+	}
+
+	t.Run("should abort the failed multipart uploads", func(t *testing.T) {
+		localPath := writeTestFile(t, tmpDir, "big.bin", make([]byte, threshold+1), time.Now())
+		srv.failParts = true
+		defer func() { srv.failParts = false }()
+
+		err := repo.PutGlacier(context.Background(), localPath, "big.bin")
+		if err == nil {
+			t.Fatal("the upload has not failed")
+		}
+		if !srv.aborted {
+			t.Errorf("the upload has not been aborted")
+		}
+	})
+}
+
+// newMinioRepository creates a repository using a new bucket of MinIO, deleted after the test.
+// The test is skipped if MinIO is not running
+func newMinioRepository(t *testing.T, customConfig string) (backup.RemoteFilesRepository, *s3.Client, Config) {
+	t.Helper()
+	endpoint := minioEndpoint
+	if v := os.Getenv(minioEndpointKey); v != "" {
+		endpoint = v
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, time.Second)
+	if err != nil {
+		t.Skipf("MinIO is not available at %v: %v", endpoint, err)
+	}
+	_ = conn.Close()
+
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" {
+		accessKey, secretKey = minioAccessKey, minioSecretKey
+	}
+
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := "glacier-backup-test-" + hex.EncodeToString(suffix)
+
+	clearEnv(t)
+	cfg, err := NewConfig(decodeCustomConfig(t,
+		"bucket: "+bucket+"\nregion: us-east-1\nendpoint: "+endpoint+"\nusePathStyle: true\n"+customConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, cfg, accessKey, secretKey, nil)
+
+	ctx := context.Background()
+	_, err = client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		objects, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(bucket)})
+		if err == nil {
+			for _, object := range objects.Contents {
+				_, _ = client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: object.Key})
+			}
+		}
+		_, _ = client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: aws.String(bucket)})
+	})
+
+	return NewS3Repository(cfg, client), client, cfg
+}
+
+func TestRepository_minio(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "glacier-s3-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := []byte("content of the photo")
+	modTime := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	localPath := writeTestFile(t, tmpDir, "beach.jpg", content, modTime)
+	sum := sha256.Sum256(content)
+
+	t.Run("should upload the files with the configured storage classes", func(t *testing.T) {
+		repo, client, cfg := newMinioRepository(t, "storageClasses:\n  glacier: REDUCED_REDUNDANCY\n")
+
+		checksum, err := repo.(backup.ChecksumPutter).PutGlacierChecksum(ctx, localPath, "/photos/beach.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Stores not returning the checksum are verified hashing the local file
+		if checksum != "" && checksum != hex.EncodeToString(sum[:]) {
+			t.Errorf("unexpected checksum %v", checksum)
+		}
+
+		object, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(cfg.Bucket), Key: aws.String("photos/beach.jpg")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if object.StorageClass != types.StorageClassReducedRedundancy {
+			t.Errorf("unexpected storage class %v", object.StorageClass)
+		}
+
+		info, err := repo.Head(ctx, "/photos/beach.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(len(content)) || !info.ModTime.Equal(modTime) || !info.Available || info.Restoring {
+			t.Errorf("unexpected object %+v", info)
+		}
+		if info.SHA256 != "" && info.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("unexpected checksum %v", info.SHA256)
+		}
+		// The classes of MinIO have no minimum storage duration
+		if days := repo.(backup.StoragePolicy).MinStorageDays(); days != 0 {
+			t.Errorf("unexpected minimum storage duration %v", days)
+		}
+
+		err = repo.PutEditable(ctx, localPath, "backup.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		object, err = client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(cfg.Bucket), Key: aws.String("backup.db")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// S3 only returns the storage class when it is not STANDARD
+		if object.StorageClass != "" && object.StorageClass != types.StorageClassStandard {
+			t.Errorf("unexpected storage class %v", object.StorageClass)
+		}
+		got, err := repo.Get(ctx, "backup.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(content) {
+			t.Errorf("Get returned %q", got)
+		}
+	})
+
+	t.Run("should fail with the storage classes not supported by the store", func(t *testing.T) {
+		repo, _, _ := newMinioRepository(t, "")
+
+		err := repo.PutGlacier(ctx, localPath, "/photos/beach.jpg")
+		var apiError smithy.APIError
+		if !errors.As(err, &apiError) || apiError.ErrorCode() != "InvalidStorageClass" {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("should upload the big files in parts", func(t *testing.T) {
+		repo, _, _ := newMinioRepository(t, "storageClasses:\n  glacier: STANDARD\nmultipartThresholdMB: 5\npartSizeMB: 5\n")
+
+		big := make([]byte, 11*megabyte)
+		_, err := rand.Read(big)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bigPath := writeTestFile(t, tmpDir, "video.mp4", big, modTime)
+		bigSum := sha256.Sum256(big)
+
+		checksum, err := repo.(backup.ChecksumPutter).PutGlacierChecksum(ctx, bigPath, "/videos/video.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checksum != hex.EncodeToString(bigSum[:]) {
+			t.Errorf("unexpected checksum %v", checksum)
+		}
+
+		info, err := repo.Head(ctx, "/videos/video.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(len(big)) || !info.ModTime.Equal(modTime) {
+			t.Errorf("unexpected object %+v", info)
+		}
+
+		downloaded := filepath.Join(tmpDir, "downloaded.mp4")
+		err = repo.Download(ctx, "/videos/video.mp4", downloaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(downloaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, big) {
+			t.Error("downloaded content is different")
+		}
+	})
+
+	t.Run("should report the missing objects as not found", func(t *testing.T) {
+		repo, _, _ := newMinioRepository(t, "")
+
+		var notFound backup.FileNotFoundError
+		_, err := repo.Head(ctx, "/photos/missing.jpg")
+		if !errors.As(err, &notFound) {
+			t.Errorf("Head returned %v", err)
+		}
+		_, err = repo.Get(ctx, "/photos/missing.jpg")
+		if !errors.As(err, &notFound) {
+			t.Errorf("Get returned %v", err)
+		}
+		err = repo.Download(ctx, "/photos/missing.jpg", filepath.Join(tmpDir, "missing.jpg"))
+		if !errors.As(err, &notFound) {
+			t.Errorf("Download returned %v", err)
+		}
+		err = repo.Delete(ctx, "/photos/missing.jpg")
+		if err != nil {
+			t.Errorf("Delete returned %v", err)
+		}
+	})
+}
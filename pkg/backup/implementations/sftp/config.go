@@ -0,0 +1,112 @@
+package sftp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+type Config struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+	User string `yaml:"user"`
+	// PrivateKeyFile authenticates the user, PrivateKeyPassphrase decrypts it if it is encrypted
+	PrivateKeyFile       string `yaml:"privateKeyFile"`
+	PrivateKeyPassphrase string `yaml:"privateKeyPassphrase"`
+	// KnownHostsFile must contain the key of the host, ~/.ssh/known_hosts by default
+	KnownHostsFile string `yaml:"knownHostsFile"`
+	// BasePath is the directory of the server where the files are stored, like the localPath of the local remote
+	BasePath string `yaml:"basePath"`
+	// TimeoutSeconds limits the connection to the server, so an unreachable one does not block the run
+	TimeoutSeconds int `yaml:"timeoutSeconds"`
+}
+
+const (
+	hostKey                 = "GLACIER_BACKUP_SFTP_HOST"
+	portKey                 = "GLACIER_BACKUP_SFTP_PORT"
+	userKey                 = "GLACIER_BACKUP_SFTP_USER"
+	privateKeyFileKey       = "GLACIER_BACKUP_SFTP_PRIVATE_KEY_FILE"
+	privateKeyPassphraseKey = "GLACIER_BACKUP_SFTP_PRIVATE_KEY_PASSPHRASE"
+	knownHostsFileKey       = "GLACIER_BACKUP_SFTP_KNOWN_HOSTS_FILE"
+	basePathKey             = "GLACIER_BACKUP_SFTP_BASE_PATH"
+	timeoutSecondsKey       = "GLACIER_BACKUP_SFTP_TIMEOUT_SECONDS"
+)
+
+const (
+	defaultPort           = 22
+	defaultTimeoutSeconds = 30
+)
+
+// NewConfig decodes the customConfig block of the sftp remote. Environment variables override its values
+func NewConfig(customConfig backup.CustomConfig) (Config, error) {
+	cfg := Config{Port: defaultPort, TimeoutSeconds: defaultTimeoutSeconds}
+	err := customConfig.Decode(&cfg)
+	if err != nil {
+		return Config{}, fmt.Errorf("error decoding sftp configuration: %w", err)
+	}
+
+	overrides := map[string]*string{
+		hostKey:                 &cfg.Host,
+		userKey:                 &cfg.User,
+		privateKeyFileKey:       &cfg.PrivateKeyFile,
+		privateKeyPassphraseKey: &cfg.PrivateKeyPassphrase,
+		knownHostsFileKey:       &cfg.KnownHostsFile,
+		basePathKey:             &cfg.BasePath,
+	}
+	for key, value := range overrides {
+		if v := os.Getenv(key); v != "" {
+			*value = v
+		}
+	}
+	for key, value := range map[string]*int{portKey: &cfg.Port, timeoutSecondsKey: &cfg.TimeoutSeconds} {
+		if v := os.Getenv(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return Config{}, fmt.Errorf("environment variable %s must be a number: %w", key, err)
+			}
+			*value = n
+		}
+	}
+	if cfg.TimeoutSeconds <= 0 {
+		return Config{}, fmt.Errorf("timeoutSeconds must be positive")
+	}
+
+	if cfg.KnownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return Config{}, fmt.Errorf("error getting the default known hosts file: %w", err)
+		}
+		cfg.KnownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	required := []struct {
+		field string
+		key   string
+	}{
+		{"host", hostKey},
+		{"user", userKey},
+		{"privateKeyFile", privateKeyFileKey},
+		{"basePath", basePathKey},
+	}
+	for _, r := range required {
+		if *overrides[r.key] == "" {
+			return Config{}, fmt.Errorf("%v or environment variable %s must be set", r.field, r.key)
+		}
+	}
+
+	return cfg, nil
+}
+
+// Timeout returns how long connecting to the server can take
+func (c Config) Timeout() time.Duration {
+	return time.Duration(c.TimeoutSeconds) * time.Second
+}
+
+// Address returns the host and port to connect to
+func (c Config) Address() string {
+	return fmt.Sprintf("%v:%d", c.Host, c.Port)
+}
@@ -0,0 +1,47 @@
+package sftp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"gopkg.in/yaml.v3"
+)
+
+func TestNewConfig_timeout(t *testing.T) {
+	required := "host: nas.local\nuser: kenobi\nprivateKeyFile: /keys/id_ed25519\nknownHostsFile: /keys/known_hosts\nbasePath: /backups\n"
+
+	tests := []struct {
+		name    string
+		config  string
+		env     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "should connect with a timeout of 30 seconds by default", config: required, want: 30 * time.Second},
+		{name: "should replace the timeout", config: required + "timeoutSeconds: 5\n", want: 5 * time.Second},
+		{name: "should replace the timeout with the environment variable", config: required + "timeoutSeconds: 5\n", env: "10", want: 10 * time.Second},
+		{name: "should fail without a positive timeout", config: required + "timeoutSeconds: 0\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{hostKey, portKey, userKey, privateKeyFileKey, privateKeyPassphraseKey, knownHostsFileKey, basePathKey} {
+				t.Setenv(key, "")
+			}
+			t.Setenv(timeoutSecondsKey, tt.env)
+
+			var customConfig backup.CustomConfig
+			err := yaml.Unmarshal([]byte(tt.config), &customConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := NewConfig(customConfig)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.Timeout() != tt.want {
+				t.Errorf("got timeout %v, want %v", cfg.Timeout(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package sftp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"github.com/closmarfer/glacier-backup/pkg/backup/internal/ctxio"
+	"github.com/pkg/sftp"
+)
+
+// repository stores the files in a directory of an SSH server, using the same layout as the local remote
+type repository struct {
+	basePath string
+	client   *sftp.Client
+	// conn is the SSH connection of the client, closing the client only ends the SFTP session
+	conn io.Closer
+}
+
+func NewRepository(cfg Config, client *sftp.Client, conn io.Closer) backup.RemoteFilesRepository {
+	return repository{basePath: cfg.BasePath, client: client, conn: conn}
+}
+
+// Close ends the SFTP session and closes the SSH connection
+func (r repository) Close() error {
+	return errors.Join(r.client.Close(), r.conn.Close())
+}
+
+func (r repository) PutGlacier(ctx context.Context, localPath string, remotePath string) error {
+	return r.put(ctx, localPath, remotePath)
+}
+
+func (r repository) PutEditable(ctx context.Context, localPath string, remotePath string) error {
+	return r.put(ctx, localPath, remotePath)
+}
+
+// put uploads the file into a temporary file renamed once it is complete,
+// so a canceled upload never leaves a truncated file in the server
+func (r repository) put(ctx context.Context, localPath string, remotePath string) error {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("error reading file: %w", err)
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading file info: %w", err)
+	}
+
+	destination := r.getPath(remotePath)
+	err = r.client.MkdirAll(path.Dir(destination))
+	if err != nil {
+		return fmt.Errorf("error creating directory of %v: %w", remotePath, err)
+	}
+
+	suffix := make([]byte, 8)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(path.Dir(destination), "."+path.Base(destination)+"."+hex.EncodeToString(suffix)+".tmp")
+
+	err = r.upload(ctx, backup.LimitReader(ctx, src), tmp)
+	if err == nil {
+		err = r.client.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = r.rename(tmp, destination)
+	}
+	if err != nil {
+		_ = r.client.Remove(tmp)
+		return fmt.Errorf("error uploading %v: %w", remotePath, err)
+	}
+	return nil
+}
+
+func (r repository) upload(ctx context.Context, src io.Reader, remotePath string) error {
+	dst, err := r.client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, ctxio.NewReader(ctx, src))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rename replaces the destination. Servers without the posix-rename extension refuse to overwrite files
+func (r repository) rename(source string, destination string) error {
+	err := r.client.PosixRename(source, destination)
+	if err == nil {
+		return nil
+	}
+
+	err = r.client.Remove(destination)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return r.client.Rename(source, destination)
+}
+
+func (r repository) Delete(_ context.Context, remotePath string) error {
+	err := r.client.Remove(r.getPath(remotePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (r repository) Get(_ context.Context, remotePath string) (string, error) {
+	file, err := r.client.Open(r.getPath(remotePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", backup.NewFileNotFoundError(remotePath)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return "", fmt.Errorf("error downloading %v: %w", remotePath, err)
+	}
+	return string(content), nil
+}
+
+func (r repository) Download(ctx context.Context, key string, localPath string) error {
+	src, err := r.client.Open(r.getPath(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return backup.NewFileNotFoundError(key)
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, ctxio.NewReader(ctx, src))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(localPath)
+		return fmt.Errorf("error downloading %v: %w", key, err)
+	}
+	return nil
+}
+
+func (r repository) Head(_ context.Context, remotePath string) (backup.ObjectInfo, error) {
+	info, err := r.client.Stat(r.getPath(remotePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return backup.ObjectInfo{}, backup.NewFileNotFoundError(remotePath)
+	}
+	if err != nil {
+		return backup.ObjectInfo{}, err
+	}
+	return backup.ObjectInfo{
+		Size:      info.Size(),
+		ModTime:   info.ModTime().UTC(),
+		Available: true,
+	}, nil
+}
+
+// Restore does nothing because the files are never archived
+func (r repository) Restore(ctx context.Context, remotePath string, _ int) error {
+	_, err := r.Head(ctx, remotePath)
+	return err
+}
+
+// getPath mirrors the layout of the local remote. The server paths always use slashes
+func (r repository) getPath(remotePath string) string {
+	remotePath = strings.Replace(remotePath, "\\", "/", -1)
+	remotePath = strings.Replace(remotePath, ":", "/", 1)
+	return path.Join(r.basePath, remotePath)
+}
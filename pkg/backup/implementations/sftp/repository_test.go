@@ -0,0 +1,253 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"github.com/closmarfer/glacier-backup/pkg/backup/implementations/local"
+	"github.com/pkg/sftp"
+)
+
+// newTestRepository connects the repository to an in-process SFTP server storing the files in basePath.
+// The returned channel is closed when the server ends
+func newTestRepository(t *testing.T, basePath string) (backup.RemoteFilesRepository, <-chan struct{}) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+
+	server, err := sftp.NewServer(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = server.Serve()
+	}()
+
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepository(Config{BasePath: basePath}, client, clientConn)
+	t.Cleanup(func() {
+		_ = repo.(io.Closer).Close()
+		_ = server.Close()
+	})
+	return repo, done
+}
+
+func newTempDir(t *testing.T) string {
+	t.Helper()
+	tmpDir, err := ioutil.TempDir("", "glacier-sftp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	return tmpDir
+}
+
+// listFiles returns the paths of the files inside root, relative to it
+func listFiles(t *testing.T, root string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		files = append(files, rel)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestRepository(t *testing.T) {
+	ctx := context.Background()
+
+	localDir := newTempDir(t)
+	localPath := filepath.Join(localDir, "beach.jpg")
+	err := ioutil.WriteFile(localPath, []byte("content of the photo"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = os.Chtimes(localPath, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should replace the file with the uploaded temporary file", func(t *testing.T) {
+		basePath := newTempDir(t)
+		repo, _ := newTestRepository(t, basePath)
+
+		destination := filepath.Join(basePath, "photos", "beach.jpg")
+		err := os.MkdirAll(filepath.Dir(destination), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(destination, []byte("previous version"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = repo.PutGlacier(ctx, localPath, "/photos/beach.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadFile(destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "content of the photo" {
+			t.Errorf("unexpected content %q", content)
+		}
+		// No temporary file is left next to it
+		if files := listFiles(t, basePath); len(files) != 1 {
+			t.Errorf("unexpected files %v", files)
+		}
+
+		info, err := repo.Head(ctx, "/photos/beach.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(len(content)) || !info.ModTime.Equal(modTime) || !info.Available {
+			t.Errorf("unexpected object %+v", info)
+		}
+	})
+
+	t.Run("should not leave any file when the upload is canceled", func(t *testing.T) {
+		basePath := newTempDir(t)
+		repo, _ := newTestRepository(t, basePath)
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		err := repo.PutGlacier(canceled, localPath, "/photos/beach.jpg")
+		if err == nil {
+			t.Fatal("expected an error uploading with a canceled context")
+		}
+		if files := listFiles(t, basePath); len(files) != 0 {
+			t.Errorf("unexpected files %v", files)
+		}
+	})
+
+	t.Run("should download the uploaded files", func(t *testing.T) {
+		repo, _ := newTestRepository(t, newTempDir(t))
+
+		err := repo.PutEditable(ctx, localPath, "backup.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := repo.Get(ctx, "backup.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "content of the photo" {
+			t.Errorf("Get returned %q", got)
+		}
+
+		downloaded := filepath.Join(newTempDir(t), "backup.db")
+		err = repo.Download(ctx, "backup.db", downloaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadFile(downloaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "content of the photo" {
+			t.Errorf("downloaded %q", content)
+		}
+	})
+
+	t.Run("should report the missing files as not found and ignore deleting them", func(t *testing.T) {
+		repo, _ := newTestRepository(t, newTempDir(t))
+
+		var notFound backup.FileNotFoundError
+		_, err := repo.Head(ctx, "/photos/missing.jpg")
+		if !errors.As(err, &notFound) {
+			t.Errorf("Head returned %v", err)
+		}
+		_, err = repo.Get(ctx, "/photos/missing.jpg")
+		if !errors.As(err, &notFound) {
+			t.Errorf("Get returned %v", err)
+		}
+		err = repo.Restore(ctx, "/photos/missing.jpg", 1)
+		if !errors.As(err, &notFound) {
+			t.Errorf("Restore returned %v", err)
+		}
+		err = repo.Delete(ctx, "/photos/missing.jpg")
+		if err != nil {
+			t.Errorf("Delete returned %v", err)
+		}
+	})
+
+	t.Run("should store the files with the layout of the local remote", func(t *testing.T) {
+		sftpBase := newTempDir(t)
+		repo, _ := newTestRepository(t, sftpBase)
+		localBase := newTempDir(t)
+		localRepo, err := local.NewRepository(local.Config{DestinationPath: localBase})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := []string{
+			"/photos/2020/beach.jpg@20250101T000000Z",
+			"backup.db",
+			"bundles/20250101T000000Z-0123456789abcdef.tar",
+			"data/0123456789abcdef",
+			"D:/documents/cv.pdf",
+		}
+		for _, key := range keys {
+			err = repo.PutGlacier(ctx, localPath, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = localRepo.PutGlacier(ctx, localPath, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		sftpFiles, localFiles := listFiles(t, sftpBase), listFiles(t, localBase)
+		if strings.Join(sftpFiles, ",") != strings.Join(localFiles, ",") {
+			t.Errorf("sftp files %v, local files %v", sftpFiles, localFiles)
+		}
+	})
+
+	t.Run("should convert the Windows paths", func(t *testing.T) {
+		r := repository{basePath: "/backups"}
+		if got := r.getPath(`C:\Users\me\cv.pdf`); got != "/backups/C/Users/me/cv.pdf" {
+			t.Errorf("unexpected path %v", got)
+		}
+	})
+
+	t.Run("should close the connection", func(t *testing.T) {
+		repo, done := newTestRepository(t, newTempDir(t))
+
+		err := repo.(io.Closer).Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("the server is still connected")
+		}
+	})
+}
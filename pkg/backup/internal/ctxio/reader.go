@@ -0,0 +1,25 @@
+package ctxio
+
+import (
+	"context"
+	"io"
+)
+
+// reader stops reading when the context is canceled
+type reader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+// NewReader returns a reader of r failing with the error of ctx once it is canceled, so copies of big files can be
+// stopped between reads
+func NewReader(ctx context.Context, r io.Reader) io.Reader {
+	return reader{ctx: ctx, reader: r}
+}
+
+func (c reader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
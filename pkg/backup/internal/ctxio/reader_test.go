@@ -0,0 +1,48 @@
+package ctxio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+// cancelingReader cancels the context after the first read
+type cancelingReader struct {
+	reader io.Reader
+	cancel context.CancelFunc
+}
+
+func (c cancelingReader) Read(p []byte) (int, error) {
+	defer c.cancel()
+	return c.reader.Read(p)
+}
+
+func TestNewReader(t *testing.T) {
+	content := bytes.Repeat([]byte("content"), 100000)
+
+	t.Run("should read everything while the context is not canceled", func(t *testing.T) {
+		got, err := io.ReadAll(NewReader(context.Background(), bytes.NewReader(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("got %v bytes, want %v", len(got), len(content))
+		}
+	})
+
+	t.Run("should stop reading once the context is canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var dst bytes.Buffer
+		n, err := io.Copy(&dst, NewReader(ctx, cancelingReader{reader: bytes.NewReader(content), cancel: cancel}))
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got error %v, want %v", err, context.Canceled)
+		}
+		if n == 0 || n == int64(len(content)) {
+			t.Errorf("copied %v bytes, want only the first read", n)
+		}
+	})
+}
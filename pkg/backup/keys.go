@@ -0,0 +1,20 @@
+package backup
+
+import (
+	"runtime"
+	"strings"
+)
+
+// ModTimeMetadataKey is the metadata of the objects storing the modification time of the local file as unix seconds,
+// so restored files get their original one
+const ModTimeMetadataKey = "mtime"
+
+// ObjectKey converts a local path into the key of its object in the remotes storing keys instead of paths. The
+// leading slash is removed, and the Windows paths use slashes without the colon of the drive
+func ObjectKey(path string) string {
+	if runtime.GOOS == "windows" {
+		path = strings.Replace(path, "\\", "/", -1)
+		path = strings.Replace(path, ":/", "/", 1)
+	}
+	return strings.TrimPrefix(path, "/")
+}
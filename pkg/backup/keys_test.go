@@ -0,0 +1,22 @@
+package backup
+
+import "testing"
+
+func TestObjectKey(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "should remove the leading slash", path: "/photos/beach.jpg", want: "photos/beach.jpg"},
+		{name: "should keep the relative keys", path: "backup.db", want: "backup.db"},
+		{name: "should only remove one slash", path: "//photos/beach.jpg", want: "/photos/beach.jpg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ObjectKey(tt.path); got != tt.want {
+				t.Errorf("got key %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package backup
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// lockTTL is how long the lock of a run that stopped refreshing it is kept before another run can take it over
+	lockTTL             = 15 * time.Minute
+	lockRefreshInterval = 5 * time.Minute
+	lockSuffix          = ".lock"
+	lockAttempts        = 3
+	lockReleaseTimeout  = 30 * time.Second
+)
+
+// ErrObjectModified is returned by ConditionalWriter when the object is not the expected version
+var ErrObjectModified = errors.New("the object has been modified")
+
+// Lock is the object stored next to the state database while a run is using it
+type Lock struct {
+	// Owner identifies the run holding the lock
+	Owner     string    `json:"owner"`
+	Hostname  string    `json:"hostname"`
+	PID       int       `json:"pid"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// LockedError is returned when another run holds the lock of the state database
+type LockedError struct {
+	Lock Lock
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("the database is being used by %v (pid %d) since %v, the lock expires at %v if it is not refreshed",
+		e.Lock.Hostname, e.Lock.PID, e.Lock.CreatedAt.Format(defaultDateLayout), e.Lock.ExpiresAt.Format(defaultDateLayout))
+}
+
+// remoteLock is the lock held by this run, refreshed until it is released
+type remoteLock struct {
+	repo    RemoteFilesRepository
+	writer  ConditionalWriter
+	key     string
+	mu      sync.Mutex
+	lock    Lock
+	version string
+	// lost is not nil when another run has taken over the lock
+	lost error
+	stop func()
+}
+
+// acquireLock creates the lock object, or takes it over if it has expired. It returns nil without error, warning
+// that the database is not protected, if the repository does not support conditional writes
+func acquireLock(ctx context.Context, repo RemoteFilesRepository, key string) (*remoteLock, error) {
+	writer, ok := repo.(ConditionalWriter)
+	if !ok {
+		warnUnlocked()
+		return nil, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	owner := make([]byte, 8)
+	_, err = rand.Read(owner)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	l := &remoteLock{
+		repo:   repo,
+		writer: writer,
+		key:    key,
+		lock: Lock{
+			Owner:     hex.EncodeToString(owner),
+			Hostname:  hostname,
+			PID:       os.Getpid(),
+			CreatedAt: now,
+			ExpiresAt: now.Add(lockTTL),
+		},
+	}
+	content, err := json.Marshal(l.lock)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt < lockAttempts; attempt++ {
+		l.version, err = writer.PutIfMatch(ctx, key, content, "")
+		if errors.Is(err, errors.ErrUnsupported) {
+			warnUnlocked()
+			return nil, nil
+		}
+		if err == nil {
+			l.keepAlive()
+			return l, nil
+		}
+		if !errors.Is(err, ErrObjectModified) {
+			return nil, err
+		}
+
+		current, version, err := writer.GetVersioned(ctx, key)
+		var notFound FileNotFoundError
+		if errors.As(err, &notFound) {
+			// Released meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// A lock that cannot be read is not refreshed by anyone, so it is taken over as an expired one
+		var held Lock
+		if json.Unmarshal(current, &held) == nil && time.Now().Before(held.ExpiresAt) {
+			return nil, &LockedError{Lock: held}
+		}
+
+		fmt.Printf("Taking over the expired lock of %v (pid %d)\n", held.Hostname, held.PID)
+		l.version, err = writer.PutIfMatch(ctx, key, content, version)
+		if err == nil {
+			l.keepAlive()
+			return l, nil
+		}
+		if !errors.Is(err, ErrObjectModified) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("the lock %v is being modified by other runs", key)
+}
+
+// LockDatabase holds the lock of the state database stored with the given key, like the runs opening it, until the
+// returned function is called
+func LockDatabase(ctx context.Context, repo RemoteFilesRepository, key string) (func(ctx context.Context) error, error) {
+	l, err := acquireLock(ctx, repo, key+lockSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context) error {
+		if l == nil {
+			return nil
+		}
+		return l.release(ctx)
+	}, nil
+}
+
+func warnUnlocked() {
+	fmt.Println("Warning: the remote does not support conditional writes, so the database is not locked. " +
+		"Do not run another backup of the same remote at the same time")
+}
+
+// keepAlive refreshes the lock until it is released
+func (l *remoteLock) keepAlive() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		tick := time.NewTicker(lockRefreshInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				err := l.refresh(ctx)
+				if err != nil && ctx.Err() == nil {
+					fmt.Printf("Error refreshing the lock of the database: %v\n", err)
+				}
+			}
+		}
+	}()
+
+	l.stop = func() {
+		cancel()
+		<-done
+	}
+}
+
+// refresh extends the expiration of the lock. It returns an error if another run has taken it over, as it
+// happens when this run could not refresh it for longer than lockTTL
+func (l *remoteLock) refresh(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.lost != nil {
+		return l.lost
+	}
+
+	lock := l.lock
+	lock.ExpiresAt = time.Now().UTC().Add(lockTTL)
+	content, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	version, err := l.writer.PutIfMatch(ctx, l.key, content, l.version)
+	if errors.Is(err, ErrObjectModified) {
+		l.lost = fmt.Errorf("the lock of the database has been taken over by another run")
+		return l.lost
+	}
+	if err != nil {
+		return err
+	}
+	l.lock, l.version = lock, version
+	return nil
+}
+
+// release deletes the lock unless another run has taken it over
+func (l *remoteLock) release(ctx context.Context) error {
+	l.stop()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.lost != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lockReleaseTimeout)
+	defer cancel()
+
+	_, version, err := l.writer.GetVersioned(ctx, l.key)
+	var notFound FileNotFoundError
+	if errors.As(err, &notFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if version != l.version {
+		return nil
+	}
+	return l.repo.Delete(ctx, l.key)
+}
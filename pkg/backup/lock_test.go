@@ -0,0 +1,217 @@
+package backup_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+// newLockTestChecker returns a checker of the database stored in the remote, with its local copy in dir
+func newLockTestChecker(dir string, repo backup.RemoteFilesRepository) *backup.SQLiteChecker {
+	return backup.NewSQLiteChecker(backup.SqliteConfig{
+		Path:   filepath.Join(dir, "backup.db"),
+		Key:    "backup.db",
+		Copies: 1,
+	}, repo)
+}
+
+func readLock(t *testing.T, path string) backup.Lock {
+	t.Helper()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock backup.Lock
+	err = json.Unmarshal(content, &lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lock
+}
+
+func writeLock(t *testing.T, path string, lock backup.Lock) {
+	t.Helper()
+	content, err := json.Marshal(lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// unlockableRepository hides the conditional writes of the repository
+type unlockableRepository struct {
+	backup.RemoteFilesRepository
+}
+
+func TestSQLiteChecker_Open_lock(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T) (string, string, backup.RemoteFilesRepository) {
+		tmpDir, err := ioutil.TempDir("", "glacier-lock-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(tmpDir) })
+		remotePath := filepath.Join(tmpDir, "remote")
+		return tmpDir, filepath.Join(remotePath, "backup.db.lock"), newLocalRepository(t, remotePath)
+	}
+
+	t.Run("should hold the lock while the database is open", func(t *testing.T) {
+		tmpDir, lockPath, repo := setup(t)
+
+		checker := newLockTestChecker(filepath.Join(tmpDir, "first"), repo)
+		err := checker.Open(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lock := readLock(t, lockPath)
+		if lock.PID != os.Getpid() || lock.Owner == "" || !lock.ExpiresAt.After(time.Now()) {
+			t.Errorf("unexpected lock %+v", lock)
+		}
+
+		err = checker.Close(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+			t.Errorf("the lock has not been released: %v", err)
+		}
+	})
+
+	t.Run("should not open the database locked by another run", func(t *testing.T) {
+		tmpDir, lockPath, repo := setup(t)
+
+		first := newLockTestChecker(filepath.Join(tmpDir, "first"), repo)
+		err := first.Open(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		held := readLock(t, lockPath)
+
+		second := newLockTestChecker(filepath.Join(tmpDir, "second"), repo)
+		err = second.Open(ctx)
+		var locked *backup.LockedError
+		if !errors.As(err, &locked) {
+			t.Fatalf("got error %v, want a locked error", err)
+		}
+		if locked.Lock.Owner != held.Owner {
+			t.Errorf("got lock %+v, want %+v", locked.Lock, held)
+		}
+		// The run failing to lock the database does not release the lock of the other one
+		if readLock(t, lockPath).Owner != held.Owner {
+			t.Errorf("the lock has been modified")
+		}
+
+		err = first.Close(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = second.Open(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = second.Close(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("should take over an expired lock", func(t *testing.T) {
+		tmpDir, lockPath, repo := setup(t)
+
+		err := os.MkdirAll(filepath.Dir(lockPath), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expired := backup.Lock{
+			Owner:     "killed",
+			Hostname:  "other",
+			PID:       1,
+			CreatedAt: time.Now().Add(-time.Hour),
+			ExpiresAt: time.Now().Add(-time.Minute),
+		}
+		writeLock(t, lockPath, expired)
+
+		checker := newLockTestChecker(filepath.Join(tmpDir, "first"), repo)
+		err = checker.Open(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer checker.Close(ctx)
+
+		lock := readLock(t, lockPath)
+		if lock.Owner == expired.Owner || lock.PID != os.Getpid() {
+			t.Errorf("the expired lock has not been taken over: %+v", lock)
+		}
+	})
+
+	t.Run("should not upload the database after losing the lock, nor release the lock of the other run", func(t *testing.T) {
+		tmpDir, lockPath, repo := setup(t)
+
+		checker := newLockTestChecker(filepath.Join(tmpDir, "first"), repo)
+		err := checker.Open(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Another run takes over the lock, as it happens when this run stops refreshing it for too long
+		other := backup.Lock{
+			Owner:     "other",
+			Hostname:  "other",
+			PID:       1,
+			CreatedAt: time.Now(),
+			ExpiresAt: time.Now().Add(time.Hour),
+		}
+		writeLock(t, lockPath, other)
+
+		err = checker.Checkpoint(ctx)
+		if err == nil || !strings.Contains(err.Error(), "taken over") {
+			t.Errorf("got error %v, want the lock taken over", err)
+		}
+		err = checker.Close(ctx)
+		if err == nil || !strings.Contains(err.Error(), "database not uploaded") {
+			t.Errorf("got error %v, want the database not uploaded", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(filepath.Dir(lockPath), "backup.db")); !os.IsNotExist(err) {
+			t.Errorf("the database has been uploaded: %v", err)
+		}
+		if lock := readLock(t, lockPath); lock.Owner != other.Owner {
+			t.Errorf("the lock of the other run has been replaced by %+v", lock)
+		}
+	})
+
+	t.Run("should not lock the remotes without conditional writes", func(t *testing.T) {
+		tmpDir, lockPath, repo := setup(t)
+		unlockable := unlockableRepository{repo}
+
+		first := newLockTestChecker(filepath.Join(tmpDir, "first"), unlockable)
+		err := first.Open(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer first.Close(ctx)
+		second := newLockTestChecker(filepath.Join(tmpDir, "second"), unlockable)
+		err = second.Open(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer second.Close(ctx)
+
+		if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+			t.Errorf("unexpected lock: %v", err)
+		}
+	})
+}
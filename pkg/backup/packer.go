@@ -0,0 +1,432 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	bundlesPrefix           = "bundles/"
+	compressedBundleSuffix  = ".tar.zst"
+	defaultPackMaxFileKB    = 256
+	defaultPackBundleSizeMB = 256
+)
+
+// PackingConfig groups the small files in tar bundles, so they are uploaded as a single object
+type PackingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Files smaller than MaxFileSizeKB are packed
+	MaxFileSizeKB int64 `yaml:"maxFileSizeKB"`
+	// A bundle is uploaded when its size reaches BundleSizeMB
+	BundleSizeMB int64 `yaml:"bundleSizeMB"`
+	// Compress the bundles using zstd
+	Compress bool `yaml:"compress"`
+}
+
+func (c PackingConfig) maxFileSize() int64 {
+	if c.MaxFileSizeKB == 0 {
+		return defaultPackMaxFileKB * 1024
+	}
+	return c.MaxFileSizeKB * 1024
+}
+
+func (c PackingConfig) bundleSize() int64 {
+	if c.BundleSizeMB == 0 {
+		return defaultPackBundleSizeMB * 1024 * 1024
+	}
+	return c.BundleSizeMB * 1024 * 1024
+}
+
+// packer writes the small files received by the workers into a bundle and uploads it when it is full.
+// The files are only added to the checker once their bundle has been uploaded
+type packer struct {
+	mu      sync.Mutex
+	cfg     PackingConfig
+	repo    RemoteFilesRepository
+	checker ExistentFilesChecker
+	retries int
+	current *bundle
+	// replicaBundles contain the packed files missing in some replicas, by the replicas they are uploaded to
+	replicaBundles map[string]*bundle
+}
+
+func newPacker(cfg PackingConfig, repo RemoteFilesRepository, checker ExistentFilesChecker, retries int) *packer {
+	return &packer{cfg: cfg, repo: repo, checker: checker, retries: retries, replicaBundles: make(map[string]*bundle)}
+}
+
+func (p *packer) accepts(file LocalFile) bool {
+	return p != nil && p.cfg.Enabled && file.SizeBytes < p.cfg.maxFileSize()
+}
+
+func (p *packer) add(ctx context.Context, file LocalFile) error {
+	p.mu.Lock()
+	if p.current == nil {
+		b, err := newBundle(p.cfg.Compress)
+		if err != nil {
+			p.mu.Unlock()
+			return err
+		}
+		p.current = b
+	}
+
+	err := p.current.add(file)
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+
+	var full *bundle
+	if p.current.size() >= p.cfg.bundleSize() {
+		full = p.current
+		p.current = nil
+	}
+	p.mu.Unlock()
+
+	if full == nil {
+		return nil
+	}
+	return p.upload(ctx, full)
+}
+
+// addReplica packs an already uploaded file in a bundle only uploaded to the replicas lacking it, so the primary
+// remote, which keeps the file in its bundle, does not store it again
+func (p *packer) addReplica(ctx context.Context, file LocalFile, replicas []string) error {
+	name := strings.Join(replicas, ",")
+
+	p.mu.Lock()
+	b, ok := p.replicaBundles[name]
+	if !ok {
+		var err error
+		b, err = newBundle(p.cfg.Compress)
+		if err != nil {
+			p.mu.Unlock()
+			return err
+		}
+		b.replicas = replicas
+		p.replicaBundles[name] = b
+	}
+
+	err := b.add(file)
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+
+	full := b.size() >= p.cfg.bundleSize()
+	if full {
+		delete(p.replicaBundles, name)
+	}
+	p.mu.Unlock()
+
+	if !full {
+		return nil
+	}
+	return p.uploadReplicas(ctx, b)
+}
+
+// flush uploads the bundles being filled
+func (p *packer) flush(ctx context.Context) error {
+	p.mu.Lock()
+	b := p.current
+	p.current = nil
+	replicaBundles := p.replicaBundles
+	p.replicaBundles = make(map[string]*bundle)
+	p.mu.Unlock()
+
+	var errs []error
+	if b != nil {
+		errs = append(errs, p.upload(ctx, b))
+	}
+	for _, rb := range replicaBundles {
+		errs = append(errs, p.uploadReplicas(ctx, rb))
+	}
+	return errors.Join(errs...)
+}
+
+// discard removes the bundles being filled without uploading them, their files will be packed again in the next run
+func (p *packer) discard() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	bundles := make([]*bundle, 0, len(p.replicaBundles)+1)
+	if p.current != nil {
+		bundles = append(bundles, p.current)
+	}
+	for _, b := range p.replicaBundles {
+		bundles = append(bundles, b)
+	}
+	for _, b := range bundles {
+		_ = b.close()
+		_ = os.Remove(b.file.Name())
+	}
+	p.current = nil
+	p.replicaBundles = make(map[string]*bundle)
+}
+
+func (p *packer) upload(ctx context.Context, b *bundle) error {
+	defer os.Remove(b.file.Name())
+
+	err := b.close()
+	if err != nil {
+		return fmt.Errorf("error closing bundle %v: %w", b.key, err)
+	}
+
+	attempts, err := retry(ctx, p.retries, b.key, func() error {
+		return p.repo.PutGlacier(ctx, b.file.Name(), b.key)
+	})
+	if err != nil && !isReplicationError(err) {
+		if ctx.Err() == nil {
+			for _, file := range b.files {
+				p.checker.AddFailure(file.Path, err, attempts)
+			}
+		}
+		return fmt.Errorf("error putting bundle %v: %w", b.key, err)
+	}
+
+	p.checker.AddBundle(b.record())
+	var replicas []string
+	if replicator, ok := p.repo.(Replicator); ok {
+		replicas = uploadedReplicas(replicator.Replicas(), err)
+	}
+	now := time.Now().UTC()
+	for _, file := range b.files {
+		file.UploadedAt = now
+		file.Replicas = replicas
+		p.checker.Add(file)
+	}
+	if err != nil {
+		return fmt.Errorf("error putting bundle %v: %w", b.key, err)
+	}
+	return nil
+}
+
+// uploadReplicas uploads a bundle of files missing in some replicas only to them. The files are in the primary
+// remote, so the ones that cannot be uploaded are packed again in the next run instead of being recorded as failed
+func (p *packer) uploadReplicas(ctx context.Context, b *bundle) error {
+	defer os.Remove(b.file.Name())
+
+	err := b.close()
+	if err != nil {
+		return fmt.Errorf("error closing bundle %v: %w", b.key, err)
+	}
+
+	replicator, ok := p.repo.(Replicator)
+	if !ok {
+		return fmt.Errorf("error putting bundle %v: the remote has no replicas", b.key)
+	}
+	_, err = retry(ctx, p.retries, b.key, func() error {
+		return replicator.PutReplicas(ctx, b.file.Name(), b.key, b.replicas)
+	})
+
+	if uploaded := uploadedReplicas(b.replicas, err); len(uploaded) > 0 {
+		p.checker.AddBundle(b.record())
+		for _, file := range b.files {
+			p.checker.AddReplicaBundle(file, uploaded)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error putting bundle %v to replicas: %w", b.key, err)
+	}
+	return nil
+}
+
+// bundle is a tar file, optionally compressed, being filled with small files
+type bundle struct {
+	key     string
+	file    *os.File
+	written *countingWriter
+	// stored counts and hashes the bytes written to the file, compressed or not
+	stored     *countingWriter
+	hash       hash.Hash
+	compressor io.WriteCloser
+	tw         *tar.Writer
+	files      []FileRecord
+	// replicas are the only remotes the bundle is uploaded to, empty if it is uploaded to every remote
+	replicas []string
+}
+
+func newBundle(compress bool) (*bundle, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	key := bundlesPrefix + time.Now().UTC().Format(snapshotIDLayout) + "-" + hex.EncodeToString(id) + ".tar"
+	if compress {
+		key = key[:len(key)-len(".tar")] + compressedBundleSuffix
+	}
+
+	file, err := os.CreateTemp("", "glacier-backup-bundle-*.tar")
+	if err != nil {
+		return nil, err
+	}
+
+	b := &bundle{key: key, file: file, hash: sha256.New()}
+	b.stored = &countingWriter{w: io.MultiWriter(file, b.hash)}
+	var w io.Writer = b.stored
+	if compress {
+		encoder, err := zstd.NewWriter(b.stored)
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+			return nil, err
+		}
+		b.compressor = encoder
+		w = encoder
+	}
+	b.written = &countingWriter{w: w}
+	b.tw = tar.NewWriter(b.written)
+
+	return b, nil
+}
+
+func (b *bundle) add(file LocalFile) error {
+	// Packed files are small, reading them at once prevents writing a corrupted entry if they change meanwhile
+	content, err := os.ReadFile(file.Path)
+	if err != nil {
+		return fmt.Errorf("error reading file %v: %w", file.Path, err)
+	}
+	info, err := os.Stat(file.Path)
+	if err != nil {
+		return fmt.Errorf("error reading file info %v: %w", file.Path, err)
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = file.Path
+	header.Size = int64(len(content))
+
+	// Flush writes the padding of the previous entry, so the offset points to the header of this one
+	err = b.tw.Flush()
+	if err != nil {
+		return err
+	}
+	offset := b.written.n
+
+	err = b.tw.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = b.tw.Write(content)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(content)
+	b.files = append(b.files, FileRecord{
+		Path:         file.Path,
+		SizeBytes:    header.Size,
+		SHA256:       hex.EncodeToString(hash[:]),
+		BundleKey:    b.key,
+		BundleOffset: offset,
+	})
+	return nil
+}
+
+func (b *bundle) size() int64 {
+	return b.written.n
+}
+
+// record returns the size and hash of the closed bundle, as they are uploaded
+func (b *bundle) record() BundleRecord {
+	return BundleRecord{Key: b.key, SizeBytes: b.stored.n, SHA256: hex.EncodeToString(b.hash.Sum(nil))}
+}
+
+func (b *bundle) close() error {
+	err := b.tw.Close()
+	if err == nil && b.compressor != nil {
+		err = b.compressor.Close()
+	}
+	if closeErr := b.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// BundleCreatedAt returns the time the bundle was created, which is part of its key
+func BundleCreatedAt(key string) (time.Time, bool) {
+	name := strings.TrimPrefix(key, bundlesPrefix)
+	if len(name) < len(snapshotIDLayout) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(snapshotIDLayout, name[:len(snapshotIDLayout)])
+	return t, err == nil
+}
+
+// ExtractFromBundle writes the file whose tar header is at offset in the downloaded bundle to target,
+// keeping its original modification time
+func ExtractFromBundle(bundlePath string, bundleKey string, offset int64, target string) error {
+	file, err := os.Open(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(bundleKey, compressedBundleSuffix) {
+		decoder, err := zstd.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer decoder.Close()
+
+		_, err = io.CopyN(io.Discard, decoder, offset)
+		if err != nil {
+			return fmt.Errorf("error reading bundle %v: %w", bundleKey, err)
+		}
+		r = decoder
+	} else {
+		_, err = file.Seek(offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("error reading bundle %v: %w", bundleKey, err)
+	}
+
+	dst, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, tr)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error extracting %v from bundle %v: %w", header.Name, bundleKey, err)
+	}
+
+	return os.Chtimes(target, header.ModTime, header.ModTime)
+}
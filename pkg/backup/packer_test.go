@@ -0,0 +1,77 @@
+package backup_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+)
+
+func TestBackuper_Upload_bundles(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("should record the size and hash of the uploaded bundle, compressed %v", compress), func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "glacier-bundles-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			source := filepath.Join(tmpDir, "source")
+			err = os.MkdirAll(source, 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 5; i++ {
+				err = ioutil.WriteFile(filepath.Join(source, fmt.Sprintf("note%d.txt", i)), []byte(fmt.Sprintf("note number %d", i)), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			remotePath := filepath.Join(tmpDir, "remote")
+			dbDir := filepath.Join(tmpDir, "db")
+			cfg := backup.Config{
+				PathsToBackup: []string{source},
+				Packing:       backup.PackingConfig{Enabled: true, Compress: compress},
+				Upload:        backup.UploadConfig{Workers: 2},
+			}
+			err = runBackup(t, cfg, dbDir, newLocalRepository(t, remotePath))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys := listObjects(t, remotePath, "bundles/")
+			if len(keys) != 1 {
+				t.Fatalf("unexpected bundles %v", keys)
+			}
+			content, err := ioutil.ReadFile(filepath.Join(remotePath, keys[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256(content)
+
+			checker := backup.NewSQLiteChecker(backup.SqliteConfig{
+				Path:     filepath.Join(dbDir, "backup.db"),
+				Key:      "backup.db",
+				ReadOnly: true,
+			}, newLocalRepository(t, remotePath))
+			err = checker.Open(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer checker.Close(context.Background())
+
+			want := backup.BundleRecord{Key: keys[0], SizeBytes: int64(len(content)), SHA256: hex.EncodeToString(sum[:])}
+			bundles := checker.GetBundles()
+			if len(bundles) != 1 || bundles[keys[0]] != want {
+				t.Errorf("got bundles %+v, want %+v", bundles, want)
+			}
+		})
+	}
+}
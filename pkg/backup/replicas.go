@@ -0,0 +1,164 @@
+package backup
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ReplicationError is returned when a file has been uploaded to the primary remote but not to some replicas
+type ReplicationError struct {
+	// Failed contains the error of each replica the file could not be uploaded to
+	Failed map[string]error
+}
+
+func (e *ReplicationError) Error() string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := make([]string, 0, len(names))
+	for _, name := range names {
+		messages = append(messages, fmt.Sprintf("%v: %v", name, e.Failed[name]))
+	}
+	return "error uploading to replicas: " + strings.Join(messages, ", ")
+}
+
+// uploadedReplicas returns the replicas a file has been uploaded to, given the error of uploading it to them
+func uploadedReplicas(replicas []string, err error) []string {
+	if err == nil {
+		return replicas
+	}
+	var replicationErr *ReplicationError
+	if !errors.As(err, &replicationErr) {
+		return nil
+	}
+
+	var uploaded []string
+	for _, replica := range replicas {
+		if _, failed := replicationErr.Failed[replica]; !failed {
+			uploaded = append(uploaded, replica)
+		}
+	}
+	return uploaded
+}
+
+// isReplicationError returns true if the file has been uploaded to the primary remote despite the error
+func isReplicationError(err error) bool {
+	var replicationErr *ReplicationError
+	return errors.As(err, &replicationErr)
+}
+
+// AddReplicas records that the last version of the file has been uploaded to the replicas
+func (c *SQLiteChecker) AddReplicas(path string, replicas []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.inTransaction(func(tx *sql.Tx) error {
+		for _, replica := range replicas {
+			_, err := tx.Exec("INSERT or IGNORE INTO replicas (path, replica) VALUES (?, ?)", path, replica)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Error adding replicas to database: %v\n", err)
+	}
+}
+
+// AddReplicaBundle records that the last version of the file has been uploaded to the replicas in a bundle
+// the primary remote does not have
+func (c *SQLiteChecker) AddReplicaBundle(file FileRecord, replicas []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.inTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT or IGNORE INTO bundles (key) VALUES (?)", file.BundleKey)
+		if err != nil {
+			return err
+		}
+		for _, replica := range replicas {
+			_, err = tx.Exec("INSERT or IGNORE INTO replicas (path, replica) VALUES (?, ?)", file.Path, replica)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(
+				"INSERT or REPLACE INTO replica_bundle_files (path, replica, bundle_key, offset) VALUES (?, ?, ?, ?)",
+				file.Path,
+				replica,
+				file.BundleKey,
+				file.BundleOffset,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Error adding replica bundle to database: %v\n", err)
+	}
+}
+
+// MissingReplicas returns the last version of the file and the given replicas it has not been uploaded to.
+// Files never uploaded are not missing in any replica
+func (c *SQLiteChecker) MissingReplicas(path string, replicas []string) (FileRecord, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var file FileRecord
+	var timeStr string
+	err := c.db.QueryRow(`
+		SELECT f.path, f.remote_key, f.uploaded_at, f.size_bytes, f.sha256, COALESCE(b.bundle_key, ''), COALESCE(b.offset, 0)
+		FROM files f LEFT JOIN bundle_files b ON b.path = f.path
+		WHERE f.path = ?
+	`, path).Scan(&file.Path, &file.RemoteKey, &timeStr, &file.SizeBytes, &file.SHA256, &file.BundleKey, &file.BundleOffset)
+	if err == sql.ErrNoRows {
+		return FileRecord{}, nil
+	}
+	if err != nil {
+		fmt.Printf("Error getting file: %v\n", err)
+		return FileRecord{}, nil
+	}
+	file.UploadedAt, err = c.parseTime(timeStr)
+	if err != nil {
+		fmt.Printf("Error parsing time: %v\n", err)
+	}
+
+	rows, err := c.db.Query("SELECT replica FROM replicas WHERE path = ?", path)
+	if err != nil {
+		fmt.Printf("Error getting replicas: %v\n", err)
+		return file, nil
+	}
+	defer rows.Close()
+
+	uploaded := make(map[string]bool)
+	for rows.Next() {
+		var replica string
+		err := rows.Scan(&replica)
+		if err != nil {
+			fmt.Printf("Error scanning row: %v\n", err)
+			continue
+		}
+		uploaded[replica] = true
+	}
+	file.Replicas = make([]string, 0, len(uploaded))
+	for replica := range uploaded {
+		file.Replicas = append(file.Replicas, replica)
+	}
+	sort.Strings(file.Replicas)
+
+	var missing []string
+	for _, replica := range replicas {
+		if !uploaded[replica] {
+			missing = append(missing, replica)
+		}
+	}
+	return file, missing
+}
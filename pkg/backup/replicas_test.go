@@ -0,0 +1,220 @@
+package backup_test
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"github.com/closmarfer/glacier-backup/pkg/backup/implementations/composite"
+)
+
+// runBackup uploads the paths of the configuration with the database stored in dbDir
+func runBackup(t *testing.T, cfg backup.Config, dbDir string, repo backup.RemoteFilesRepository) error {
+	t.Helper()
+	checker := backup.NewSQLiteChecker(backup.SqliteConfig{
+		Path:   filepath.Join(dbDir, "backup.db"),
+		Key:    "backup.db",
+		Copies: 1,
+		Remote: cfg.SelectedRemote,
+	}, repo)
+	errChan := make(chan error, 100)
+	return backup.NewBackuper(repo, checker, cfg).Upload(context.Background(), errChan)
+}
+
+// listObjects returns the keys of the objects stored in the local remote with the given prefix
+func listObjects(t *testing.T, root string, prefix string) []string {
+	t.Helper()
+	var keys []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		key, err := filepath.Rel(root, path)
+		if strings.HasPrefix(filepath.ToSlash(key), prefix) {
+			keys = append(keys, filepath.ToSlash(key))
+		}
+		return err
+	})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestBackuper_Upload_replicas(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "glacier-replicas-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	source := filepath.Join(tmpDir, "source")
+	contents := map[string]string{
+		filepath.Join(source, "small1.txt"): "first small file",
+		filepath.Join(source, "small2.txt"): "second small file",
+		filepath.Join(source, "big.bin"):    strings.Repeat("big file ", 300),
+	}
+	err = os.MkdirAll(source, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The upload times are stored in seconds, so the files must be older to be unmodified in the next runs
+	modTime := time.Now().Add(-time.Hour)
+	for path, content := range contents {
+		err = ioutil.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	primaryPath := filepath.Join(tmpDir, "primary")
+	replicaPath := filepath.Join(tmpDir, "replica")
+	dbDir := filepath.Join(tmpDir, "db")
+	// The replica cannot create its folders inside a file
+	unavailable := filepath.Join(tmpDir, "unavailable")
+	err = ioutil.WriteFile(unavailable, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := backup.Config{
+		PathsToBackup:  []string{source},
+		SelectedRemote: "primary",
+		Packing:        backup.PackingConfig{Enabled: true, MaxFileSizeKB: 1},
+		Upload:         backup.UploadConfig{Workers: 1},
+	}
+	withReplica := func(path string) backup.RemoteFilesRepository {
+		return composite.NewRepository(newLocalRepository(t, primaryPath), []composite.Remote{
+			{Name: "replica", Repository: newLocalRepository(t, path)},
+		})
+	}
+
+	// The files only reach the primary remote while the replica is unavailable
+	err = runBackup(t, cfg, dbDir, withReplica(filepath.Join(unavailable, "replica")))
+	var replicationErr *backup.ReplicationError
+	if !errors.As(err, &replicationErr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	primaryBundles := listObjects(t, primaryPath, "bundles/")
+	if len(primaryBundles) != 1 {
+		t.Fatalf("unexpected bundles in the primary remote %v", primaryBundles)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = runBackup(t, cfg, dbDir, withReplica(replicaPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("should not upload the packed files to the primary remote again", func(t *testing.T) {
+		bundles := listObjects(t, primaryPath, "bundles/")
+		if len(bundles) != 1 || bundles[0] != primaryBundles[0] {
+			t.Errorf("unexpected bundles in the primary remote %v", bundles)
+		}
+	})
+
+	t.Run("should upload the missing files only once to the replica", func(t *testing.T) {
+		bundles := listObjects(t, replicaPath, "bundles/")
+		if len(bundles) != 1 || bundles[0] == primaryBundles[0] {
+			t.Errorf("unexpected bundles in the replica %v", bundles)
+		}
+		big := listObjects(t, replicaPath, strings.TrimPrefix(filepath.ToSlash(source), "/")+"/big.bin")
+		if len(big) != 1 {
+			t.Errorf("unexpected big files in the replica %v", big)
+		}
+	})
+
+	t.Run("should restore the packed files from the bundle of the replica", func(t *testing.T) {
+		replica := newLocalRepository(t, replicaPath)
+		checker := backup.NewSQLiteChecker(backup.SqliteConfig{
+			Path:     filepath.Join(tmpDir, "replica-db", "backup.db"),
+			Key:      "backup.db",
+			ReadOnly: true,
+			Remote:   "replica",
+		}, replica)
+		err := checker.Open(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer checker.Close(context.Background())
+
+		files := checker.GetFiles()
+		if len(files) != len(contents) {
+			t.Fatalf("unexpected files %v", files)
+		}
+		for path, content := range contents {
+			file := files[path]
+			if strings.HasSuffix(path, "big.bin") {
+				if file.BundleKey != "" {
+					t.Errorf("big file packed in %v", file.BundleKey)
+				}
+				continue
+			}
+			if file.BundleKey == primaryBundles[0] {
+				t.Errorf("file %v in the bundle of the primary remote", path)
+				continue
+			}
+
+			bundle := filepath.Join(tmpDir, "bundle")
+			err := replica.Download(context.Background(), file.BundleKey, bundle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(bundle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if record := checker.GetBundles()[file.BundleKey]; record.SizeBytes != info.Size() || record.SHA256 == "" {
+				t.Errorf("unexpected bundle %+v of %v bytes", record, info.Size())
+			}
+			target := filepath.Join(tmpDir, "restored")
+			err = backup.ExtractFromBundle(bundle, file.BundleKey, file.BundleOffset, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			restored, err := ioutil.ReadFile(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(restored) != content {
+				t.Errorf("restored %q from %v, want %q", restored, path, content)
+			}
+		}
+	})
+
+	t.Run("should keep the bundle of the primary remote for the files of the primary remote", func(t *testing.T) {
+		checker := backup.NewSQLiteChecker(backup.SqliteConfig{
+			Path:     filepath.Join(dbDir, "backup.db"),
+			Key:      "backup.db",
+			ReadOnly: true,
+			Remote:   "primary",
+		}, newLocalRepository(t, primaryPath))
+		err := checker.Open(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer checker.Close(context.Background())
+
+		for path, file := range checker.GetFiles() {
+			if !strings.HasSuffix(path, "big.bin") && file.BundleKey != primaryBundles[0] {
+				t.Errorf("file %v in bundle %v", path, file.BundleKey)
+			}
+		}
+		// The bundle of the replica is not deleted while it contains the last version of the files
+		if orphans := checker.OrphanBundles(); len(orphans) != 0 {
+			t.Errorf("unexpected orphan bundles %v", orphans)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"sort"
+	"time"
+)
+
+// RetentionConfig selects the snapshots kept by --prune. The versions only visible in other snapshots are deleted
+type RetentionConfig struct {
+	// KeepLast keeps the last snapshots
+	KeepLast int `yaml:"keepLast"`
+	// KeepDaily keeps the last snapshot of each of the last days with snapshots
+	KeepDaily int `yaml:"keepDaily"`
+	// KeepMonthly keeps the last snapshot of each of the last months with snapshots
+	KeepMonthly int `yaml:"keepMonthly"`
+}
+
+// Enabled returns true if any rule is set. Otherwise, pruning would delete every old version
+func (r RetentionConfig) Enabled() bool {
+	return r.KeepLast > 0 || r.KeepDaily > 0 || r.KeepMonthly > 0
+}
+
+// KeptSnapshots returns the IDs of the snapshots kept by any of the rules
+func (r RetentionConfig) KeptSnapshots(snapshots []Snapshot) map[string]bool {
+	newestFirst := append([]Snapshot(nil), snapshots...)
+	sort.Slice(newestFirst, func(i, j int) bool {
+		return newestFirst[i].CreatedAt.After(newestFirst[j].CreatedAt)
+	})
+
+	kept := make(map[string]bool)
+	for i := 0; i < r.KeepLast && i < len(newestFirst); i++ {
+		kept[newestFirst[i].ID] = true
+	}
+	keepPeriods(newestFirst, r.KeepDaily, time.DateOnly, kept)
+	keepPeriods(newestFirst, r.KeepMonthly, "2006-01", kept)
+
+	return kept
+}
+
+// keepPeriods keeps the newest snapshot of each of the last periods, the period of a snapshot is its time formatted using layout
+func keepPeriods(newestFirst []Snapshot, periods int, layout string, kept map[string]bool) {
+	last := ""
+	for _, snapshot := range newestFirst {
+		if periods == 0 {
+			return
+		}
+		period := snapshot.CreatedAt.UTC().Format(layout)
+		if period == last {
+			continue
+		}
+		kept[snapshot.ID] = true
+		last = period
+		periods--
+	}
+}
+
+// PrunableVersions returns the versions not visible in any kept snapshot. A version is visible in the snapshots
+// created from its upload until the next version of the file. The last version of a file is never pruned
+func PrunableVersions(versions []FileRecord, kept map[string]bool) []FileRecord {
+	sorted := append([]FileRecord(nil), versions...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Path != sorted[j].Path {
+			return sorted[i].Path < sorted[j].Path
+		}
+		return sorted[i].SnapshotID < sorted[j].SnapshotID
+	})
+
+	var prunable []FileRecord
+	for i, version := range sorted {
+		if i+1 == len(sorted) || sorted[i+1].Path != version.Path {
+			continue
+		}
+		if !visibleInKept(version.SnapshotID, sorted[i+1].SnapshotID, kept) {
+			prunable = append(prunable, version)
+		}
+	}
+	return prunable
+}
+
+// visibleInKept returns true if a kept snapshot is between from, included, and until. Snapshot IDs sort by time
+func visibleInKept(from string, until string, kept map[string]bool) bool {
+	for id := range kept {
+		if id >= from && id < until {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,21 @@
+package serviceprovider
+
+import (
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/closmarfer/glacier-backup/pkg/backup/implementations/azure"
+)
+
+func provideAzureContainerClient(cfg azure.Config) (*container.Client, error) {
+	if cfg.ConnectionString != "" {
+		return container.NewClientFromConnectionString(cfg.ConnectionString, cfg.Container, nil)
+	}
+
+	credential, err := container.NewSharedKeyCredential(cfg.AccountName, cfg.AccountKey)
+	if err != nil {
+		return nil, err
+	}
+	containerURL := strings.TrimSuffix(cfg.ServiceURL(), "/") + "/" + cfg.Container
+	return container.NewClientWithSharedKeyCredential(containerURL, credential, nil)
+}
@@ -4,23 +4,76 @@ import (
 	"fmt"
 
 	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"github.com/closmarfer/glacier-backup/pkg/backup/implementations/azure"
+	"github.com/closmarfer/glacier-backup/pkg/backup/implementations/composite"
+	"github.com/closmarfer/glacier-backup/pkg/backup/implementations/encrypted"
+	"github.com/closmarfer/glacier-backup/pkg/backup/implementations/gcs"
 	"github.com/closmarfer/glacier-backup/pkg/backup/implementations/local"
 	"github.com/closmarfer/glacier-backup/pkg/backup/implementations/s3"
+	"github.com/closmarfer/glacier-backup/pkg/backup/implementations/sftp"
 )
 
-func ProvideBackupConfiguration(selectedRemote string) (backup.Config, error) {
-	cfgDecoder := backup.NewConfigDecoder()
-	return cfgDecoder.LoadConfiguration(selectedRemote)
+func ProvideBackupConfiguration(configPath string, profile string, selectedRemote string) (backup.Config, error) {
+	cfgDecoder := backup.NewConfigDecoder(configPath)
+	return cfgDecoder.LoadConfiguration(profile, selectedRemote)
 }
 
 func ProvideRemoteFilesRepository(cfg backup.Config) (backup.RemoteFilesRepository, error) {
-	return makeRepositoryOrFail(cfg)
+	fmt.Printf("Selected remote: '%v'\n", cfg.SelectedRemote)
+	primary, err := provideRemote(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Replicas) == 0 {
+		return primary, nil
+	}
+
+	replicas := make([]composite.Remote, 0, len(cfg.Replicas))
+	for _, name := range cfg.Replicas {
+		fmt.Printf("Replica: '%v'\n", name)
+		replicaCfg := cfg
+		replicaCfg.SelectedRemote = name
+		repo, err := provideRemote(replicaCfg)
+		if err != nil {
+			return nil, fmt.Errorf("error creating replica '%v': %w", name, err)
+		}
+		replicas = append(replicas, composite.Remote{Name: name, Repository: repo})
+	}
+	return composite.NewRepository(primary, replicas), nil
+}
+
+// ProvideDestinationRepository creates the repository of the remote the objects are copied to by --replicate
+func ProvideDestinationRepository(cfg backup.Config, name string) (backup.RemoteFilesRepository, error) {
+	fmt.Printf("Destination remote: '%v'\n", name)
+	cfg.SelectedRemote = name
+	return provideRemote(cfg)
+}
+
+// provideRemote creates the repository of the selected remote, encrypting the files if it is enabled
+func provideRemote(cfg backup.Config) (backup.RemoteFilesRepository, error) {
+	repo, err := makeRepositoryOrFail(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if !cfg.Encryption.Enabled {
+		return repo, nil
+	}
+
+	encryptionCfg, err := encrypted.NewConfig(cfg.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	if encryptionCfg.TempDir == "" {
+		// The default temporary folder is often a small tmpfs, and each worker writes a whole encrypted file
+		encryptionCfg.TempDir = cfg.GlacierPath
+	}
+	return encrypted.NewRepository(encryptionCfg, repo)
 }
 
 func makeRepositoryOrFail(cfg backup.Config) (backup.RemoteFilesRepository, error) {
-	fmt.Printf("Selected remote: '%v'\n", cfg.SelectedRemote)
 	if cfg.IsLocal() {
-		c, err := local.NewConfig()
+		c, err := local.NewConfig(cfg.RemoteConfig(cfg.SelectedRemote))
 		if err != nil {
 			return nil, err
 		}
@@ -33,7 +86,7 @@ func makeRepositoryOrFail(cfg backup.Config) (backup.RemoteFilesRepository, erro
 	}
 
 	if cfg.IsS3() {
-		s3cfg, err := s3.NewConfig()
+		s3cfg, err := s3.NewConfig(cfg.RemoteConfig(cfg.SelectedRemote))
 		if err != nil {
 			return nil, err
 		}
@@ -52,5 +105,47 @@ func makeRepositoryOrFail(cfg backup.Config) (backup.RemoteFilesRepository, erro
 		return s3Repository, nil
 	}
 
+	if cfg.IsGCS() {
+		gcsCfg, err := gcs.NewConfig(cfg.RemoteConfig(cfg.SelectedRemote))
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := provideGCSClient(gcsCfg)
+		if err != nil {
+			return nil, fmt.Errorf("gcs client could not be created: %w", err)
+		}
+
+		return gcs.NewRepository(gcsCfg, client), nil
+	}
+
+	if cfg.IsAzure() {
+		azureCfg, err := azure.NewConfig(cfg.RemoteConfig(cfg.SelectedRemote))
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := provideAzureContainerClient(azureCfg)
+		if err != nil {
+			return nil, fmt.Errorf("azure client could not be created: %w", err)
+		}
+
+		return azure.NewRepository(azureCfg, client), nil
+	}
+
+	if cfg.IsSFTP() {
+		sftpCfg, err := sftp.NewConfig(cfg.RemoteConfig(cfg.SelectedRemote))
+		if err != nil {
+			return nil, err
+		}
+
+		client, conn, err := provideSFTPClient(sftpCfg)
+		if err != nil {
+			return nil, fmt.Errorf("sftp client could not be created: %w", err)
+		}
+
+		return sftp.NewRepository(sftpCfg, client, conn), nil
+	}
+
 	return nil, fmt.Errorf("not supported remote '%v'", cfg.SelectedRemote)
 }
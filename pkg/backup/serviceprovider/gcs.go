@@ -0,0 +1,20 @@
+package serviceprovider
+
+import (
+	"context"
+
+	"cloud.google.com/go/storage"
+	"github.com/closmarfer/glacier-backup/pkg/backup/implementations/gcs"
+	"google.golang.org/api/option"
+)
+
+func provideGCSClient(cfg gcs.Config) (*storage.Client, error) {
+	var opts []option.ClientOption
+	if cfg.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(cfg.Endpoint), option.WithoutAuthentication())
+	} else if cfg.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(cfg.CredentialsFile))
+	}
+
+	return storage.NewClient(context.Background(), opts...)
+}
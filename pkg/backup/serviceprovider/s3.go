@@ -2,22 +2,41 @@ package serviceprovider
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"os"
 
 	"github.com/closmarfer/glacier-backup/pkg/backup/implementations/s3"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	s3aws "github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 func provideS3Client(cfg s3.Config) (*s3aws.Client, error) {
-	s3Configuration, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(cfg.Region), config.WithSharedConfigProfile(cfg.ProfileName))
+	opts := []func(*config.LoadOptions) error{config.WithRegion(cfg.Region)}
+	if cfg.ProfileName != "" {
+		opts = append(opts, config.WithSharedConfigProfile(cfg.ProfileName))
+	}
+	if cfg.CABundle != "" {
+		bundle, err := os.Open(cfg.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle: %w", err)
+		}
+		defer bundle.Close()
+		opts = append(opts, config.WithCustomCABundle(bundle))
+	}
 
+	s3Configuration, err := config.LoadDefaultConfig(context.TODO(), opts...)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	client := s3aws.NewFromConfig(s3Configuration)
+	client := s3aws.NewFromConfig(s3Configuration, func(o *s3aws.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+		o.UsePathStyle = cfg.UsePathStyle
+	})
 
 	return client, nil
 }
@@ -0,0 +1,51 @@
+package serviceprovider
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup/implementations/sftp"
+	pkgsftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func provideSFTPClient(cfg sftp.Config) (*pkgsftp.Client, *ssh.Client, error) {
+	key, err := os.ReadFile(cfg.PrivateKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading private key: %w", err)
+	}
+
+	var signer ssh.Signer
+	if cfg.PrivateKeyPassphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(cfg.PrivateKeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing private key: %w", err)
+	}
+
+	// Unknown hosts are rejected, add them with ssh-keyscan or by connecting once with ssh
+	hostKeyCallback, err := knownhosts.New(cfg.KnownHostsFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading known hosts: %w", err)
+	}
+
+	conn, err := ssh.Dial("tcp", cfg.Address(), &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         cfg.Timeout(),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error connecting to %v: %w", cfg.Address(), err)
+	}
+
+	client, err := pkgsftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return client, conn, nil
+}
@@ -0,0 +1,245 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const snapshotIDLayout = "20060102T150405Z"
+
+// versionSeparator separates the key of a file from the snapshot of the version
+const versionSeparator = "@"
+
+// Snapshot is a backup run. It contains the versions of the files uploaded during the run
+type Snapshot struct {
+	ID        string
+	CreatedAt time.Time
+	Files     int
+	SizeBytes int64
+}
+
+// VersionKey returns the key of the version of a file uploaded in the snapshot,
+// so modified files never overwrite their previous versions
+func VersionKey(key string, snapshotID string) string {
+	if snapshotID == "" {
+		return key
+	}
+	return key + versionSeparator + snapshotID
+}
+
+// ParseSnapshotTime parses a snapshot ID, a date or a date and time in UTC. A date means the end of the day
+func ParseSnapshotTime(value string) (time.Time, error) {
+	for _, layout := range []string{snapshotIDLayout, time.RFC3339, defaultDateLayout} {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date '%v', use a snapshot ID or the format YYYY-MM-DD [HH:MM:SS]", value)
+	}
+	return t.Add(24*time.Hour - time.Second), nil
+}
+
+func (c *SQLiteChecker) createSnapshotTables(ctx context.Context) error {
+	_, err := c.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS snapshots (
+			id TEXT PRIMARY KEY,
+			created_at DATETIME NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS versions (
+			path TEXT NOT NULL,
+			snapshot_id TEXT NOT NULL,
+			remote_key TEXT NOT NULL,
+			uploaded_at DATETIME NOT NULL,
+			size_bytes BIGINT NOT NULL,
+			sha256 TEXT NOT NULL,
+			bundle_key TEXT NOT NULL,
+			bundle_offset BIGINT NOT NULL,
+			PRIMARY KEY (path, snapshot_id)
+		);
+		CREATE INDEX IF NOT EXISTS versions_bundle_key ON versions (bundle_key);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating snapshot tables: %w", err)
+	}
+
+	// The files uploaded before snapshots existed become the versions of an initial snapshot
+	var versions, files int
+	err = c.db.QueryRowContext(ctx, "SELECT (SELECT COUNT(*) FROM versions), (SELECT COUNT(*) FROM files)").Scan(&versions, &files)
+	if err != nil {
+		return fmt.Errorf("error counting versions: %w", err)
+	}
+	if versions > 0 || files == 0 {
+		return nil
+	}
+
+	var firstUpload string
+	err = c.db.QueryRowContext(ctx, "SELECT MIN(uploaded_at) FROM files").Scan(&firstUpload)
+	if err != nil {
+		return fmt.Errorf("error creating initial snapshot: %w", err)
+	}
+	createdAt, err := c.parseTime(firstUpload)
+	if err != nil {
+		return fmt.Errorf("error creating initial snapshot: %w", err)
+	}
+
+	id := createdAt.Format(snapshotIDLayout)
+	return c.inTransaction(func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO snapshots (id, created_at) VALUES (?, ?)", id, createdAt.Format(defaultDateLayout))
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO versions (path, snapshot_id, remote_key, uploaded_at, size_bytes, sha256, bundle_key, bundle_offset)
+			SELECT f.path, ?, f.remote_key, f.uploaded_at, f.size_bytes, f.sha256, COALESCE(b.bundle_key, ''), COALESCE(b.offset, 0)
+			FROM files f LEFT JOIN bundle_files b ON b.path = f.path
+		`, id)
+		return err
+	})
+}
+
+// BeginSnapshot creates the snapshot the files added afterwards belong to and returns its ID
+func (c *SQLiteChecker) BeginSnapshot(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now().UTC()
+	id := now.Format(snapshotIDLayout)
+	_, err := c.db.ExecContext(ctx, "INSERT OR IGNORE INTO snapshots (id, created_at) VALUES (?, ?)", id, now.Format(defaultDateLayout))
+	if err != nil {
+		return "", fmt.Errorf("error creating snapshot: %w", err)
+	}
+	c.snapshotID = id
+	return id, nil
+}
+
+func (c *SQLiteChecker) Snapshots() []Snapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var snapshots []Snapshot
+	rows, err := c.db.Query(`
+		SELECT s.id, s.created_at, COUNT(v.path), COALESCE(SUM(v.size_bytes), 0)
+		FROM snapshots s LEFT JOIN versions v ON v.snapshot_id = s.id
+		GROUP BY s.id, s.created_at
+		ORDER BY s.created_at
+	`)
+	if err != nil {
+		fmt.Printf("Error getting snapshots: %v\n", err)
+		return snapshots
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var snapshot Snapshot
+		var timeStr string
+		err := rows.Scan(&snapshot.ID, &timeStr, &snapshot.Files, &snapshot.SizeBytes)
+		if err != nil {
+			fmt.Printf("Error scanning row: %v\n", err)
+			continue
+		}
+		snapshot.CreatedAt, err = c.parseTime(timeStr)
+		if err != nil {
+			fmt.Printf("Error parsing time: %v\n", err)
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots
+}
+
+// GetFilesAt returns the last version of each file uploaded in the snapshots created until the given time
+func (c *SQLiteChecker) GetFilesAt(at time.Time) map[string]FileRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	files := make(map[string]FileRecord)
+	for _, version := range c.queryVersions(
+		"JOIN snapshots s ON s.id = v.snapshot_id WHERE s.created_at <= ? ORDER BY s.created_at",
+		at.UTC().Format(defaultDateLayout),
+	) {
+		files[version.Path] = version
+	}
+	return files
+}
+
+// GetVersions returns every version of the file, from the oldest to the newest
+func (c *SQLiteChecker) GetVersions(path string) []FileRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.queryVersions("WHERE v.path = ? ORDER BY v.snapshot_id", path)
+}
+
+// GetAllVersions returns every version of every file
+func (c *SQLiteChecker) GetAllVersions() []FileRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.queryVersions("ORDER BY v.path, v.snapshot_id")
+}
+
+func (c *SQLiteChecker) RemoveVersion(path string, snapshotID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.db.Exec("DELETE FROM versions WHERE path = ? AND snapshot_id = ?", path, snapshotID)
+	if err != nil {
+		fmt.Printf("Error removing version from database: %v\n", err)
+	}
+}
+
+func (c *SQLiteChecker) RemoveSnapshot(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.db.Exec("DELETE FROM snapshots WHERE id = ? AND id NOT IN (SELECT snapshot_id FROM versions)", id)
+	if err != nil {
+		fmt.Printf("Error removing snapshot from database: %v\n", err)
+	}
+}
+
+func (c *SQLiteChecker) queryVersions(condition string, args ...any) []FileRecord {
+	var versions []FileRecord
+	rows, err := c.db.Query(`
+		SELECT v.path, v.snapshot_id, v.remote_key, v.uploaded_at, v.size_bytes, v.sha256, v.bundle_key, v.bundle_offset
+		FROM versions v `+condition, args...)
+	if err != nil {
+		fmt.Printf("Error getting versions: %v\n", err)
+		return versions
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version FileRecord
+		var timeStr string
+		err := rows.Scan(
+			&version.Path,
+			&version.SnapshotID,
+			&version.RemoteKey,
+			&timeStr,
+			&version.SizeBytes,
+			&version.SHA256,
+			&version.BundleKey,
+			&version.BundleOffset,
+		)
+		if err != nil {
+			fmt.Printf("Error scanning row: %v\n", err)
+			continue
+		}
+		version.UploadedAt, err = c.parseTime(timeStr)
+		if err != nil {
+			fmt.Printf("Error parsing time: %v\n", err)
+			continue
+		}
+		versions = append(versions, version)
+	}
+
+	return versions
+}
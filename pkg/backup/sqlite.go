@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -14,8 +15,18 @@ import (
 const defaultDateLayout = "2006-01-02 15:04:05"
 
 type SqliteConfig struct {
-	Path string
-	Key  string
+	Path            string
+	Key             string
+	ChangeDetection ChangeDetection
+	// ReadOnly discards the changes made to the database instead of uploading it when it is closed
+	ReadOnly bool
+	// Copies is the number of timestamped copies of the database kept in the remote
+	Copies int
+	// NewDatabase starts with an empty database when the remote one and its copies cannot be loaded
+	NewDatabase bool
+	// Remote is the name of the selected remote. When it is a replica, the files packed again only for it are
+	// returned in the bundles it received
+	Remote string
 }
 
 type SQLiteChecker struct {
@@ -25,6 +36,17 @@ type SQLiteChecker struct {
 	mu         sync.Mutex
 	ignored    int
 	uploaded   int
+	// snapshotID is the snapshot the added files belong to
+	snapshotID string
+	// syncMu serializes the uploads of the database, which are made without holding mu
+	syncMu sync.Mutex
+	// syncedSHA256 is the hash of the remote database, empty if there is not one
+	syncedSHA256 string
+	// dbUploaded is true when the database has been uploaded since it was opened, so it is copied when it is closed
+	dbUploaded bool
+	closed     bool
+	// lock is held while the database is open, unless it is read only or the remote cannot lock it
+	lock *remoteLock
 }
 
 func NewSQLiteChecker(cfg SqliteConfig, repository RemoteFilesRepository) *SQLiteChecker {
@@ -34,15 +56,35 @@ func NewSQLiteChecker(cfg SqliteConfig, repository RemoteFilesRepository) *SQLit
 	}
 }
 
-func (c *SQLiteChecker) Open(ctx context.Context) error {
+func (c *SQLiteChecker) Open(ctx context.Context) (err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	err := c.repository.Download(ctx, c.cfg.Key, c.cfg.Path)
+	// The database is kept between runs in the application folder
+	err = os.MkdirAll(filepath.Dir(c.cfg.Path), 0700)
 	if err != nil {
-		fmt.Printf("No existing database found or error downloading: %v\n", err)
+		return fmt.Errorf("error creating database folder: %w", err)
 	}
 
+	if !c.cfg.ReadOnly {
+		c.lock, err = acquireLock(ctx, c.repository, c.cfg.Key+lockSuffix)
+		if err != nil {
+			return fmt.Errorf("error locking database: %w", err)
+		}
+		defer func() {
+			if err != nil {
+				c.releaseLock(ctx)
+			}
+		}()
+	}
+
+	err = c.load(ctx)
+	if err != nil {
+		return err
+	}
+	c.closed = false
+	c.dbUploaded = false
+
 	db, err := sql.Open("sqlite3", c.cfg.Path)
 	if err != nil {
 		return fmt.Errorf("error opening database: %w", err)
@@ -61,18 +103,213 @@ func (c *SQLiteChecker) Open(ctx context.Context) error {
 		return fmt.Errorf("error creating table: %w", err)
 	}
 
+	_, err = c.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS bundles (
+			key TEXT PRIMARY KEY
+		);
+		CREATE TABLE IF NOT EXISTS bundle_files (
+			path TEXT PRIMARY KEY,
+			bundle_key TEXT NOT NULL,
+			offset BIGINT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS bundle_files_bundle_key ON bundle_files (bundle_key);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating bundle tables: %w", err)
+	}
+
+	// Databases created by previous versions lack the columns added afterwards
+	err = c.addColumn(ctx, "files", "remote_key", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumn(ctx, "files", "sha256", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumn(ctx, "bundles", "size_bytes", "BIGINT NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumn(ctx, "bundles", "sha256", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	err = c.createSnapshotTables(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS trash (
+			path TEXT PRIMARY KEY,
+			deleted_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating trash table: %w", err)
+	}
+
+	_, err = c.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS kept (
+			path TEXT PRIMARY KEY
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating kept table: %w", err)
+	}
+
+	_, err = c.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS replicas (
+			path TEXT NOT NULL,
+			replica TEXT NOT NULL,
+			PRIMARY KEY (path, replica)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating replicas table: %w", err)
+	}
+
+	_, err = c.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS replica_bundle_files (
+			path TEXT NOT NULL,
+			replica TEXT NOT NULL,
+			bundle_key TEXT NOT NULL,
+			offset BIGINT NOT NULL,
+			PRIMARY KEY (path, replica)
+		);
+		CREATE INDEX IF NOT EXISTS replica_bundle_files_bundle_key ON replica_bundle_files (bundle_key);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating replica bundles table: %w", err)
+	}
+
+	_, err = c.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS failures (
+			path TEXT PRIMARY KEY,
+			error TEXT NOT NULL,
+			attempts INTEGER NOT NULL,
+			failed_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating failures table: %w", err)
+	}
+
+	return nil
+}
+
+// addColumn adds the column to the table if it does not exist
+func (c *SQLiteChecker) addColumn(ctx context.Context, table string, column string, definition string) error {
+	rows, err := c.db.QueryContext(ctx, "SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return fmt.Errorf("error reading columns of table %v: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return fmt.Errorf("error reading columns of table %v: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error reading columns of table %v: %w", table, err)
+	}
+
+	_, err = c.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v %v", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("error adding column %v to table %v: %w", column, table, err)
+	}
 	return nil
 }
 
-func (c *SQLiteChecker) Add(path string, uploadedAt time.Time, size int64) {
+func (c *SQLiteChecker) Add(file FileRecord) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	_, err := c.db.Exec(
-		"INSERT or REPLACE INTO files (`path`, uploaded_at, size_bytes) VALUES (?, ?, ?)",
-		path,
-		uploadedAt.Format(defaultDateLayout),
-		size,
-	)
+
+	err := c.inTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			"INSERT or REPLACE INTO files (`path`, remote_key, uploaded_at, size_bytes, sha256) VALUES (?, ?, ?, ?, ?)",
+			file.Path,
+			file.RemoteKey,
+			file.UploadedAt.Format(defaultDateLayout),
+			file.SizeBytes,
+			file.SHA256,
+		)
+		if err != nil {
+			return err
+		}
+		// A file uploaded again is no longer deleted
+		_, err = tx.Exec("DELETE FROM trash WHERE path = ?", file.Path)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM kept WHERE path = ?", file.Path)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM failures WHERE path = ?", file.Path)
+		if err != nil {
+			return err
+		}
+
+		// The replicas of the previous version do not have the new one
+		_, err = tx.Exec("DELETE FROM replicas WHERE path = ?", file.Path)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM replica_bundle_files WHERE path = ?", file.Path)
+		if err != nil {
+			return err
+		}
+		for _, replica := range file.Replicas {
+			_, err = tx.Exec("INSERT or IGNORE INTO replicas (path, replica) VALUES (?, ?)", file.Path, replica)
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.snapshotID != "" {
+			_, err = tx.Exec(
+				`INSERT or REPLACE INTO versions (path, snapshot_id, remote_key, uploaded_at, size_bytes, sha256, bundle_key, bundle_offset)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				file.Path,
+				c.snapshotID,
+				file.RemoteKey,
+				file.UploadedAt.Format(defaultDateLayout),
+				file.SizeBytes,
+				file.SHA256,
+				file.BundleKey,
+				file.BundleOffset,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		// A file packed before may be uploaded alone after growing, or packed again in another bundle
+		_, err = tx.Exec("DELETE FROM bundle_files WHERE path = ?", file.Path)
+		if err != nil || file.BundleKey == "" {
+			return err
+		}
+		_, err = tx.Exec("INSERT or IGNORE INTO bundles (key) VALUES (?)", file.BundleKey)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"INSERT INTO bundle_files (path, bundle_key, offset) VALUES (?, ?, ?)",
+			file.Path,
+			file.BundleKey,
+			file.BundleOffset,
+		)
+		return err
+	})
 	if err != nil {
 		fmt.Printf("Error adding file to database: %v\n", err)
 		return
@@ -84,22 +321,144 @@ func (c *SQLiteChecker) Remove(path string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	_, err := c.db.Exec("DELETE FROM files WHERE path = ?", path)
+	err := c.inTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM files WHERE path = ?", path)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM bundle_files WHERE path = ?", path)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM versions WHERE path = ?", path)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM trash WHERE path = ?", path)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM kept WHERE path = ?", path)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM replicas WHERE path = ?", path)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM replica_bundle_files WHERE path = ?", path)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM failures WHERE path = ?", path)
+		return err
+	})
 	if err != nil {
 		fmt.Printf("Error removing file from database: %v\n", err)
 	}
 }
 
-func (c *SQLiteChecker) Exists(path string, lastUpdated time.Time) bool {
+func (c *SQLiteChecker) AddBundle(bundle BundleRecord) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.db.Exec(`
+		INSERT INTO bundles (key, size_bytes, sha256) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET size_bytes = excluded.size_bytes, sha256 = excluded.sha256
+	`, bundle.Key, bundle.SizeBytes, bundle.SHA256)
+	if err != nil {
+		fmt.Printf("Error adding bundle to database: %v\n", err)
+	}
+}
+
+func (c *SQLiteChecker) GetBundles() map[string]BundleRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	bundles := make(map[string]BundleRecord)
+	rows, err := c.db.Query("SELECT key, size_bytes, sha256 FROM bundles")
+	if err != nil {
+		fmt.Printf("Error getting bundles: %v\n", err)
+		return bundles
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bundle BundleRecord
+		err := rows.Scan(&bundle.Key, &bundle.SizeBytes, &bundle.SHA256)
+		if err != nil {
+			fmt.Printf("Error scanning row: %v\n", err)
+			continue
+		}
+		bundles[bundle.Key] = bundle
+	}
+
+	return bundles
+}
+
+func (c *SQLiteChecker) OrphanBundles() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var keys []string
+	rows, err := c.db.Query(`
+		SELECT key FROM bundles
+		WHERE key NOT IN (SELECT bundle_key FROM bundle_files) AND key NOT IN (SELECT bundle_key FROM versions)
+			AND key NOT IN (SELECT bundle_key FROM replica_bundle_files)
+	`)
+	if err != nil {
+		fmt.Printf("Error getting bundles: %v\n", err)
+		return keys
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		err := rows.Scan(&key)
+		if err != nil {
+			fmt.Printf("Error scanning row: %v\n", err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+func (c *SQLiteChecker) RemoveBundle(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.db.Exec("DELETE FROM bundles WHERE key = ?", key)
+	if err != nil {
+		fmt.Printf("Error removing bundle from database: %v\n", err)
+	}
+}
+
+func (c *SQLiteChecker) inTransaction(fn func(tx *sql.Tx) error) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c *SQLiteChecker) Exists(file LocalFile) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	var storedTime time.Time
-	var timeStr string
+	var timeStr, storedHash string
+	var storedSize int64
 	err := c.db.QueryRow(
-		"SELECT uploaded_at FROM files WHERE path = ?",
-		path,
-	).Scan(&timeStr)
+		"SELECT uploaded_at, size_bytes, sha256 FROM files WHERE path = ?",
+		file.Path,
+	).Scan(&timeStr, &storedSize, &storedHash)
 	if err == sql.ErrNoRows {
 		return false
 	}
@@ -113,7 +472,30 @@ func (c *SQLiteChecker) Exists(path string, lastUpdated time.Time) bool {
 		fmt.Printf("Error parsing stored time: %v\n", err)
 	}
 
-	if lastUpdated.After(storedTime) {
+	unmodified := !file.ModTime.After(storedTime)
+	var exists bool
+	switch c.cfg.ChangeDetection {
+	case ChangeDetectionHash:
+		if storedHash != "" {
+			exists = storedHash == file.SHA256
+			break
+		}
+		// Files uploaded before storing hashes are compared by modification time and size,
+		// and their hash is stored so the next runs compare it
+		exists = unmodified && storedSize == file.SizeBytes
+		if exists {
+			_, err = c.db.Exec("UPDATE files SET sha256 = ? WHERE path = ?", file.SHA256, file.Path)
+			if err != nil {
+				fmt.Printf("Error storing file hash: %v\n", err)
+			}
+		}
+	case ChangeDetectionMTimeSize:
+		exists = unmodified && storedSize == file.SizeBytes
+	default:
+		exists = unmodified
+	}
+
+	if !exists {
 		return false
 	}
 
@@ -121,25 +503,45 @@ func (c *SQLiteChecker) Exists(path string, lastUpdated time.Time) bool {
 	return true
 }
 
+// Close uploads the database if it has changed. The local file is kept, so the next run does not download it
+// again if the remote one has not changed
 func (c *SQLiteChecker) Close(ctx context.Context) error {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.db == nil {
+	defer c.releaseLock(ctx)
+
+	if c.db == nil || c.closed {
 		return nil
 	}
 
-	err := c.repository.PutEditable(ctx, c.cfg.Path, c.cfg.Key)
+	c.closed = true
+	err := c.db.Close()
 	if err != nil {
-		return fmt.Errorf("error uploading database: %w", err)
+		return fmt.Errorf("error closing database: %w", err)
 	}
 
-	err = c.db.Close()
-	if err != nil {
-		return fmt.Errorf("error closing database: %w", err)
+	if c.cfg.ReadOnly {
+		return nil
+	}
+	err = c.upload(ctx, c.cfg.Path)
+	if err != nil || !c.dbUploaded {
+		return err
 	}
+	return c.copyDatabase(ctx, c.cfg.Path)
+}
 
-	return os.Remove(c.cfg.Path)
+func (c *SQLiteChecker) releaseLock(ctx context.Context) {
+	if c.lock == nil {
+		return
+	}
+	err := c.lock.release(ctx)
+	if err != nil {
+		fmt.Printf("Error releasing the lock of the database: %v\n", err)
+	}
+	c.lock = nil
 }
 
 func (c *SQLiteChecker) Ignored() int {
@@ -154,12 +556,17 @@ func (c *SQLiteChecker) Uploaded() int {
 	return c.uploaded
 }
 
-func (c *SQLiteChecker) GetFiles() map[string]time.Time {
+func (c *SQLiteChecker) GetFiles() map[string]FileRecord {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	files := make(map[string]time.Time)
-	rows, err := c.db.Query("SELECT path, uploaded_at FROM files")
+	files := make(map[string]FileRecord)
+	rows, err := c.db.Query(`
+		SELECT f.path, f.remote_key, f.uploaded_at, f.size_bytes, f.sha256,
+			COALESCE(r.bundle_key, b.bundle_key, ''), COALESCE(r.offset, b.offset, 0)
+		FROM files f LEFT JOIN bundle_files b ON b.path = f.path
+		LEFT JOIN replica_bundle_files r ON r.path = f.path AND r.replica = ?
+	`, c.cfg.Remote)
 	if err != nil {
 		fmt.Printf("Error getting files: %v\n", err)
 		return files
@@ -167,20 +574,21 @@ func (c *SQLiteChecker) GetFiles() map[string]time.Time {
 	defer rows.Close()
 
 	for rows.Next() {
-		var path, timeStr string
-		err := rows.Scan(&path, &timeStr)
+		var file FileRecord
+		var timeStr string
+		err := rows.Scan(&file.Path, &file.RemoteKey, &timeStr, &file.SizeBytes, &file.SHA256, &file.BundleKey, &file.BundleOffset)
 		if err != nil {
 			fmt.Printf("Error scanning row: %v\n", err)
 			continue
 		}
 
-		uploadedAt, err := c.parseTime(timeStr)
+		file.UploadedAt, err = c.parseTime(timeStr)
 		if err != nil {
 			fmt.Printf("Error parsing time: %v\n", err)
 			continue
 		}
 
-		files[path] = uploadedAt
+		files[file.Path] = file
 	}
 
 	return files
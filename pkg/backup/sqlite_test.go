@@ -0,0 +1,110 @@
+package backup_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/closmarfer/glacier-backup/pkg/backup"
+	"github.com/closmarfer/glacier-backup/pkg/backup/implementations/local"
+)
+
+func newLocalRepository(t *testing.T, path string) backup.RemoteFilesRepository {
+	t.Helper()
+	repo, err := local.NewRepository(local.Config{DestinationPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+// openTestChecker opens an empty database in a temporary folder with the given change detection
+func openTestChecker(t *testing.T, changeDetection backup.ChangeDetection) *backup.SQLiteChecker {
+	t.Helper()
+	tmpDir, err := ioutil.TempDir("", "glacier-sqlite-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	checker := backup.NewSQLiteChecker(backup.SqliteConfig{
+		Path:            filepath.Join(tmpDir, "backup.db"),
+		Key:             "backup.db",
+		ChangeDetection: changeDetection,
+	}, newLocalRepository(t, filepath.Join(tmpDir, "remote")))
+	err = checker.Open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { checker.Close(context.Background()) })
+	return checker
+}
+
+func TestSQLiteChecker_Exists(t *testing.T) {
+	const path = "/photos/beach.jpg"
+	uploadedAt := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	stored := backup.FileRecord{Path: path, UploadedAt: uploadedAt, SizeBytes: 5, SHA256: "stored"}
+	// legacy is a file uploaded before the hashes were stored
+	legacy := backup.FileRecord{Path: path, UploadedAt: uploadedAt, SizeBytes: 5}
+
+	unmodified := backup.LocalFile{Path: path, ModTime: uploadedAt.Add(-time.Hour), SizeBytes: 5, SHA256: "stored"}
+	touched := backup.LocalFile{Path: path, ModTime: uploadedAt.Add(time.Hour), SizeBytes: 5, SHA256: "stored"}
+	resized := backup.LocalFile{Path: path, ModTime: uploadedAt.Add(-time.Hour), SizeBytes: 6, SHA256: "stored"}
+	rewritten := backup.LocalFile{Path: path, ModTime: uploadedAt.Add(-time.Hour), SizeBytes: 5, SHA256: "changed"}
+
+	tests := []struct {
+		name            string
+		changeDetection backup.ChangeDetection
+		stored          backup.FileRecord
+		file            backup.LocalFile
+		want            bool
+		// wantHash is the hash stored after the check
+		wantHash string
+	}{
+		{name: "should skip an unmodified file by modification time", changeDetection: backup.ChangeDetectionMTime, stored: stored, file: unmodified, want: true, wantHash: "stored"},
+		{name: "should upload a file modified after its upload by modification time", changeDetection: backup.ChangeDetectionMTime, stored: stored, file: touched, want: false, wantHash: "stored"},
+		{name: "should ignore the size by modification time", changeDetection: backup.ChangeDetectionMTime, stored: stored, file: resized, want: true, wantHash: "stored"},
+		{name: "should skip an unmodified file by modification time and size", changeDetection: backup.ChangeDetectionMTimeSize, stored: stored, file: unmodified, want: true, wantHash: "stored"},
+		{name: "should upload a file with the same modification time and another size", changeDetection: backup.ChangeDetectionMTimeSize, stored: stored, file: resized, want: false, wantHash: "stored"},
+		{name: "should upload a file modified after its upload by modification time and size", changeDetection: backup.ChangeDetectionMTimeSize, stored: stored, file: touched, want: false, wantHash: "stored"},
+		{name: "should skip a touched file with the same hash", changeDetection: backup.ChangeDetectionHash, stored: stored, file: touched, want: true, wantHash: "stored"},
+		{name: "should upload a file with another hash and the same modification time", changeDetection: backup.ChangeDetectionHash, stored: stored, file: rewritten, want: false, wantHash: "stored"},
+		{name: "should store the hash of an unmodified file uploaded without it", changeDetection: backup.ChangeDetectionHash, stored: legacy, file: unmodified, want: true, wantHash: "stored"},
+		{name: "should upload a modified file uploaded without hash", changeDetection: backup.ChangeDetectionHash, stored: legacy, file: touched, want: false, wantHash: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := openTestChecker(t, tt.changeDetection)
+			checker.Add(tt.stored)
+
+			got := checker.Exists(tt.file)
+			if got != tt.want {
+				t.Errorf("got exists %v, want %v", got, tt.want)
+			}
+			if tt.want && checker.Ignored() != 1 {
+				t.Errorf("got %v ignored files, want 1", checker.Ignored())
+			}
+			if hash := checker.GetFiles()[path].SHA256; hash != tt.wantHash {
+				t.Errorf("got stored hash %q, want %q", hash, tt.wantHash)
+			}
+		})
+	}
+
+	t.Run("should compare the stored hash in the next checks", func(t *testing.T) {
+		checker := openTestChecker(t, backup.ChangeDetectionHash)
+		checker.Add(legacy)
+
+		if !checker.Exists(unmodified) {
+			t.Fatalf("the unmodified file uploaded without hash is not skipped")
+		}
+		if checker.Exists(rewritten) {
+			t.Errorf("the file with another hash than the stored one is skipped")
+		}
+		if !checker.Exists(touched) {
+			t.Errorf("the touched file with the stored hash is not skipped")
+		}
+	})
+}
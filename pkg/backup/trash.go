@@ -0,0 +1,116 @@
+package backup
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Trash marks the file as deleted locally. Its remote objects are kept until the trash is purged
+func (c *SQLiteChecker) Trash(path string, deletedAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.db.Exec(
+		"INSERT or IGNORE INTO trash (path, deleted_at) VALUES (?, ?)",
+		path,
+		deletedAt.UTC().Format(defaultDateLayout),
+	)
+	if err != nil {
+		fmt.Printf("Error moving file to trash: %v\n", err)
+	}
+}
+
+// Untrash marks the file as existing locally again
+func (c *SQLiteChecker) Untrash(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.inTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM trash WHERE path = ?", path)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM kept WHERE path = ?", path)
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Error removing file from trash: %v\n", err)
+	}
+}
+
+// Keep takes the file out of the trash. Otherwise, the next --cleanRemote would move it to the trash again
+// if it is still missing locally
+func (c *SQLiteChecker) Keep(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.inTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM trash WHERE path = ?", path)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT or IGNORE INTO kept (path) VALUES (?)", path)
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Error keeping file: %v\n", err)
+	}
+}
+
+// GetKept returns the files taken out of the trash with Keep
+func (c *SQLiteChecker) GetKept() map[string]bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	kept := make(map[string]bool)
+	rows, err := c.db.Query("SELECT path FROM kept")
+	if err != nil {
+		fmt.Printf("Error getting kept files: %v\n", err)
+		return kept
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var path string
+		err := rows.Scan(&path)
+		if err != nil {
+			fmt.Printf("Error scanning row: %v\n", err)
+			continue
+		}
+		kept[path] = true
+	}
+
+	return kept
+}
+
+// GetTrash returns the time each file in the trash was deleted
+func (c *SQLiteChecker) GetTrash() map[string]time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	trash := make(map[string]time.Time)
+	rows, err := c.db.Query("SELECT path, deleted_at FROM trash")
+	if err != nil {
+		fmt.Printf("Error getting trash: %v\n", err)
+		return trash
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var path, timeStr string
+		err := rows.Scan(&path, &timeStr)
+		if err != nil {
+			fmt.Printf("Error scanning row: %v\n", err)
+			continue
+		}
+		deletedAt, err := c.parseTime(timeStr)
+		if err != nil {
+			fmt.Printf("Error parsing time: %v\n", err)
+			continue
+		}
+		trash[path] = deletedAt
+	}
+
+	return trash
+}